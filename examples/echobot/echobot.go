@@ -6,6 +6,7 @@ import (
 	"os"
 
 	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
 )
 
 func fail(msg string, args ...any) {
@@ -30,23 +31,22 @@ func main() {
 		fail("Error listening: %s", err.Error())
 	}
 
-	for {
-		msg, err := sub.Read()
-		if err != nil {
-			fail("failed to read message: %s", err.Error())
-		}
-
-		if msg.Message.Content.TypeName != "text" {
-			continue
-		}
-
-		fmt.Println("received: ", msg.Message.Content.Text.Body)
+	router := kbchat.NewRouter()
+	router.OnText(func(msg kbchat.SubscriptionMessage, text chat1.MsgTextContent) error {
+		fmt.Println("received: ", text.Body)
 
 		// uncomment to send chat messages in the original message's channel
 		/*
-			if _, err = kbc.SendMessage(msg.Message.Channel, msg.Message.Content.Text.Body); err != nil {
-				fail("error echo'ing message: %s", err.Error())
+			if _, err = kbc.SendMessage(msg.Message.Channel, text.Body); err != nil {
+				return fmt.Errorf("error echo'ing message: %s", err.Error())
 			}
 		*/
+		return nil
+	})
+	router.OnError(func(err error) {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+	})
+	if err := router.Run(sub); err != nil {
+		fail("failed to read message: %s", err.Error())
 	}
 }
@@ -1,8 +1,8 @@
 package kbchat
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 
 	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
@@ -64,62 +64,56 @@ func fmtBody(body string, args ...any) string {
 
 // GetConversations reads all conversations from the current user's inbox.
 func (a *API) GetConversations(unreadOnly bool) ([]chat1.ConvSummary, error) {
-	apiInput := fmt.Sprintf(`{"method":"list", "params": { "options": { "unread_only": %v}}}`, unreadOnly)
-	output, err := a.doFetch(apiInput)
-	if err != nil {
-		return nil, err
-	}
+	return a.GetConversationsContext(context.Background(), unreadOnly)
+}
 
+func (a *API) GetConversationsContext(ctx context.Context, unreadOnly bool) ([]chat1.ConvSummary, error) {
+	apiInput := fmt.Sprintf(`{"method":"list", "params": { "options": { "unread_only": %v}}}`, unreadOnly)
 	var inbox Inbox
-	if err := json.Unmarshal(output, &inbox); err != nil {
+	if err := a.doFetch(ctx, apiInput, &inbox.Result); err != nil {
 		return nil, err
-	} else if inbox.Error != nil {
-		return nil, errors.New(inbox.Error.Message)
 	}
 	return inbox.Result.Convs, nil
 }
 
 func (a *API) GetConversation(convID chat1.ConvIDStr) (res chat1.ConvSummary, err error) {
+	return a.GetConversationContext(context.Background(), convID)
+}
+
+func (a *API) GetConversationContext(ctx context.Context, convID chat1.ConvIDStr) (res chat1.ConvSummary, err error) {
 	convIDEscaped, err := json.Marshal(convID)
 	if err != nil {
 		return res, err
 	}
 	apiInput := fmt.Sprintf(`{"method":"list", "params": { "options": { "conversation_id": %s}}}`, convIDEscaped)
-	output, err := a.doFetch(apiInput)
-	if err != nil {
-		return res, err
-	}
-
 	var inbox Inbox
-	if err := json.Unmarshal(output, &inbox); err != nil {
+	if err := a.doFetch(ctx, apiInput, &inbox.Result); err != nil {
 		return res, err
-	} else if inbox.Error != nil {
-		return res, errors.New(inbox.Error.Message)
 	} else if len(inbox.Result.Convs) == 0 {
-		return res, errors.New("conversation not found")
+		return res, Error{
+			Message:  "conversation not found",
+			Method:   "list",
+			category: ErrConversationNotFound,
+		}
 	}
 	return inbox.Result.Convs[0], nil
 }
 
 // GetTextMessages fetches all text messages from a given channel. Optionally can filter
-// on unread status.
+// on unread status. ReadThread pages through long conversations instead.
 func (a *API) GetTextMessages(channel chat1.ChatChannel, unreadOnly bool) ([]chat1.MsgSummary, error) {
+	return a.GetTextMessagesContext(context.Background(), channel, unreadOnly)
+}
+
+func (a *API) GetTextMessagesContext(ctx context.Context, channel chat1.ChatChannel, unreadOnly bool) ([]chat1.MsgSummary, error) {
 	channelBytes, err := json.Marshal(channel)
 	if err != nil {
 		return nil, err
 	}
 	apiInput := fmt.Sprintf(`{"method": "read", "params": {"options": {"channel": %s, "unread_only": %v}}}`, channelBytes, unreadOnly)
-	output, err := a.doFetch(apiInput)
-	if err != nil {
-		return nil, err
-	}
-
 	var thread Thread
-
-	if err := json.Unmarshal(output, &thread); err != nil {
-		return nil, fmt.Errorf("unable to decode thread: %v", err)
-	} else if thread.Error != nil {
-		return nil, errors.New(thread.Error.Message)
+	if err := a.doFetch(ctx, apiInput, &thread.Result); err != nil {
+		return nil, err
 	}
 
 	var res []chat1.MsgSummary
@@ -132,7 +126,44 @@ func (a *API) GetTextMessages(channel chat1.ChatChannel, unreadOnly bool) ([]cha
 	return res, nil
 }
 
+// peekThread reads a page of a conversation, newest messages first, without
+// marking it as read.
+func (a *API) peekThread(ctx context.Context, convID chat1.ConvIDStr, pagination *chat1.Pagination) (thread chat1.Thread, err error) {
+	err = a.peek(ctx, map[string]any{"conversation_id": convID}, pagination, &thread)
+	return thread, err
+}
+
+// peekChannel is like peekThread, for a conversation picked by channel.
+func (a *API) peekChannel(ctx context.Context, channel chat1.ChatChannel, pagination *chat1.Pagination) (thread chat1.Thread, err error) {
+	err = a.peek(ctx, map[string]any{"channel": channel}, pagination, &thread)
+	return thread, err
+}
+
+// peek reads a page of the conversation picked by opts into result.
+func (a *API) peek(ctx context.Context, opts map[string]any, pagination *chat1.Pagination, result any) error {
+	opts["peek"] = true
+	return a.readPage(ctx, opts, pagination, result)
+}
+
+func (a *API) readPage(ctx context.Context, opts map[string]any, pagination *chat1.Pagination, result any) error {
+	if pagination != nil {
+		opts["pagination"] = pagination
+	}
+	apiInput, err := json.Marshal(map[string]any{
+		"method": "read",
+		"params": map[string]any{"options": opts},
+	})
+	if err != nil {
+		return err
+	}
+	return a.doFetch(ctx, string(apiInput), result)
+}
+
 func (a *API) SendMessage(channel chat1.ChatChannel, body string, args ...any) (resp SendResponse, err error) {
+	return a.SendMessageContext(context.Background(), channel, body, args...)
+}
+
+func (a *API) SendMessageContext(ctx context.Context, channel chat1.ChatChannel, body string, args ...any) (resp SendResponse, err error) {
 	defer a.Trace(&err, "SendMessage")()
 	arg := newSendArg(sendMessageOptions{
 		Channel: channel,
@@ -140,17 +171,25 @@ func (a *API) SendMessage(channel chat1.ChatChannel, body string, args ...any) (
 			Body: fmtBody(body, args...),
 		},
 	})
-	return a.doSend(arg)
+	return a.doSend(ctx, arg)
 }
 
 func (a *API) Broadcast(body string, args ...any) (SendResponse, error) {
-	return a.SendMessage(chat1.ChatChannel{
+	return a.BroadcastContext(context.Background(), body, args...)
+}
+
+func (a *API) BroadcastContext(ctx context.Context, body string, args ...any) (SendResponse, error) {
+	return a.SendMessageContext(ctx, chat1.ChatChannel{
 		Name:   a.GetUsername(),
 		Public: true,
 	}, body, args...)
 }
 
 func (a *API) SendMessageByConvID(convID chat1.ConvIDStr, body string, args ...any) (resp SendResponse, err error) {
+	return a.SendMessageByConvIDContext(context.Background(), convID, body, args...)
+}
+
+func (a *API) SendMessageByConvIDContext(ctx context.Context, convID chat1.ConvIDStr, body string, args ...any) (resp SendResponse, err error) {
 	defer a.Trace(&err, "SendMessageByConvID")()
 	arg := newSendArg(sendMessageOptions{
 		ConversationID: convID,
@@ -158,11 +197,15 @@ func (a *API) SendMessageByConvID(convID chat1.ConvIDStr, body string, args ...a
 			Body: fmtBody(body, args...),
 		},
 	})
-	return a.doSend(arg)
+	return a.doSend(ctx, arg)
 }
 
 // SendMessageByTlfName sends a message on the given TLF name
 func (a *API) SendMessageByTlfName(tlfName string, body string, args ...any) (resp SendResponse, err error) {
+	return a.SendMessageByTlfNameContext(context.Background(), tlfName, body, args...)
+}
+
+func (a *API) SendMessageByTlfNameContext(ctx context.Context, tlfName string, body string, args ...any) (resp SendResponse, err error) {
 	defer a.Trace(&err, "SendMessageByTlfName")()
 	arg := newSendArg(sendMessageOptions{
 		Channel: chat1.ChatChannel{
@@ -172,10 +215,14 @@ func (a *API) SendMessageByTlfName(tlfName string, body string, args ...any) (re
 			Body: fmtBody(body, args...),
 		},
 	})
-	return a.doSend(arg)
+	return a.doSend(ctx, arg)
 }
 
 func (a *API) SendMessageByTeamName(teamName string, inChannel *string, body string, args ...any) (resp SendResponse, err error) {
+	return a.SendMessageByTeamNameContext(context.Background(), teamName, inChannel, body, args...)
+}
+
+func (a *API) SendMessageByTeamNameContext(ctx context.Context, teamName string, inChannel *string, body string, args ...any) (resp SendResponse, err error) {
 	defer a.Trace(&err, "SendMessageByTeamName")()
 	channel := "general"
 	if inChannel != nil {
@@ -191,10 +238,14 @@ func (a *API) SendMessageByTeamName(teamName string, inChannel *string, body str
 			Body: fmtBody(body, args...),
 		},
 	})
-	return a.doSend(arg)
+	return a.doSend(ctx, arg)
 }
 
 func (a *API) SendReply(channel chat1.ChatChannel, replyTo *chat1.MessageID, body string, args ...any) (SendResponse, error) {
+	return a.SendReplyContext(context.Background(), channel, replyTo, body, args...)
+}
+
+func (a *API) SendReplyContext(ctx context.Context, channel chat1.ChatChannel, replyTo *chat1.MessageID, body string, args ...any) (SendResponse, error) {
 	arg := newSendArg(sendMessageOptions{
 		Channel: channel,
 		Message: sendMessageBody{
@@ -202,10 +253,14 @@ func (a *API) SendReply(channel chat1.ChatChannel, replyTo *chat1.MessageID, bod
 		},
 		ReplyTo: replyTo,
 	})
-	return a.doSend(arg)
+	return a.doSend(ctx, arg)
 }
 
 func (a *API) SendReplyByConvID(convID chat1.ConvIDStr, replyTo *chat1.MessageID, body string, args ...any) (SendResponse, error) {
+	return a.SendReplyByConvIDContext(context.Background(), convID, replyTo, body, args...)
+}
+
+func (a *API) SendReplyByConvIDContext(ctx context.Context, convID chat1.ConvIDStr, replyTo *chat1.MessageID, body string, args ...any) (SendResponse, error) {
 	arg := newSendArg(sendMessageOptions{
 		ConversationID: convID,
 		Message: sendMessageBody{
@@ -213,10 +268,14 @@ func (a *API) SendReplyByConvID(convID chat1.ConvIDStr, replyTo *chat1.MessageID
 		},
 		ReplyTo: replyTo,
 	})
-	return a.doSend(arg)
+	return a.doSend(ctx, arg)
 }
 
 func (a *API) SendReplyByTlfName(tlfName string, replyTo *chat1.MessageID, body string, args ...any) (SendResponse, error) {
+	return a.SendReplyByTlfNameContext(context.Background(), tlfName, replyTo, body, args...)
+}
+
+func (a *API) SendReplyByTlfNameContext(ctx context.Context, tlfName string, replyTo *chat1.MessageID, body string, args ...any) (SendResponse, error) {
 	arg := newSendArg(sendMessageOptions{
 		Channel: chat1.ChatChannel{
 			Name: tlfName,
@@ -226,10 +285,14 @@ func (a *API) SendReplyByTlfName(tlfName string, replyTo *chat1.MessageID, body
 		},
 		ReplyTo: replyTo,
 	})
-	return a.doSend(arg)
+	return a.doSend(ctx, arg)
 }
 
 func (a *API) SendAttachmentByTeam(teamName string, inChannel *string, filename string, title string) (SendResponse, error) {
+	return a.SendAttachmentByTeamContext(context.Background(), teamName, inChannel, filename, title)
+}
+
+func (a *API) SendAttachmentByTeamContext(ctx context.Context, teamName string, inChannel *string, filename string, title string) (SendResponse, error) {
 	channel := "general"
 	if inChannel != nil {
 		channel = *inChannel
@@ -248,10 +311,14 @@ func (a *API) SendAttachmentByTeam(teamName string, inChannel *string, filename
 			},
 		},
 	}
-	return a.doSend(arg)
+	return a.doSend(ctx, arg)
 }
 
 func (a *API) SendAttachmentByConvID(convID chat1.ConvIDStr, filename string, title string) (SendResponse, error) {
+	return a.SendAttachmentByConvIDContext(context.Background(), convID, filename, title)
+}
+
+func (a *API) SendAttachmentByConvIDContext(ctx context.Context, convID chat1.ConvIDStr, filename string, title string) (SendResponse, error) {
 	arg := sendMessageArg{
 		Method: "attach",
 		Params: sendMessageParams{
@@ -262,7 +329,7 @@ func (a *API) SendAttachmentByConvID(convID chat1.ConvIDStr, filename string, ti
 			},
 		},
 	}
-	return a.doSend(arg)
+	return a.doSend(ctx, arg)
 }
 
 ////////////////////////////////////////////////////////
@@ -293,24 +360,36 @@ func newReactionArg(options reactionOptions) reactionArg {
 }
 
 func (a *API) ReactByChannel(channel chat1.ChatChannel, msgID chat1.MessageID, reaction string) (SendResponse, error) {
+	return a.ReactByChannelContext(context.Background(), channel, msgID, reaction)
+}
+
+func (a *API) ReactByChannelContext(ctx context.Context, channel chat1.ChatChannel, msgID chat1.MessageID, reaction string) (SendResponse, error) {
 	arg := newReactionArg(reactionOptions{
 		Message: sendMessageBody{Body: reaction},
 		MsgID:   msgID,
 		Channel: channel,
 	})
-	return a.doSend(arg)
+	return a.doSend(ctx, arg)
 }
 
 func (a *API) ReactByConvID(convID chat1.ConvIDStr, msgID chat1.MessageID, reaction string) (SendResponse, error) {
+	return a.ReactByConvIDContext(context.Background(), convID, msgID, reaction)
+}
+
+func (a *API) ReactByConvIDContext(ctx context.Context, convID chat1.ConvIDStr, msgID chat1.MessageID, reaction string) (SendResponse, error) {
 	arg := newReactionArg(reactionOptions{
 		Message:        sendMessageBody{Body: reaction},
 		MsgID:          msgID,
 		ConversationID: convID,
 	})
-	return a.doSend(arg)
+	return a.doSend(ctx, arg)
 }
 
 func (a *API) EditByConvID(convID chat1.ConvIDStr, msgID chat1.MessageID, text string) (SendResponse, error) {
+	return a.EditByConvIDContext(context.Background(), convID, msgID, text)
+}
+
+func (a *API) EditByConvIDContext(ctx context.Context, convID chat1.ConvIDStr, msgID chat1.MessageID, text string) (SendResponse, error) {
 	arg := reactionArg{
 		Method: "edit",
 		Params: reactionParams{Options: reactionOptions{
@@ -319,7 +398,7 @@ func (a *API) EditByConvID(convID chat1.ConvIDStr, msgID chat1.MessageID, text s
 			ConversationID: convID,
 		}},
 	}
-	return a.doSend(arg)
+	return a.doSend(ctx, arg)
 }
 
 ////////////////////////////////////////////////////////
@@ -342,21 +421,18 @@ type LeaveChannel struct {
 }
 
 func (a *API) ListChannels(teamName string) ([]string, error) {
+	return a.ListChannelsContext(context.Background(), teamName)
+}
+
+func (a *API) ListChannelsContext(ctx context.Context, teamName string) ([]string, error) {
 	teamNameEscaped, err := json.Marshal(teamName)
 	if err != nil {
 		return nil, err
 	}
 	apiInput := fmt.Sprintf(`{"method": "listconvsonname", "params": {"options": {"topic_type": "CHAT", "members_type": "team", "name": %s}}}`, teamNameEscaped)
-	output, err := a.doFetch(apiInput)
-	if err != nil {
-		return nil, err
-	}
-
 	var channelsList ChannelsList
-	if err := json.Unmarshal(output, &channelsList); err != nil {
+	if err := a.doFetch(ctx, apiInput, &channelsList.Result); err != nil {
 		return nil, err
-	} else if channelsList.Error != nil {
-		return nil, errors.New(channelsList.Error.Message)
 	}
 
 	var channels []string
@@ -367,6 +443,10 @@ func (a *API) ListChannels(teamName string) ([]string, error) {
 }
 
 func (a *API) JoinChannel(teamName string, channelName string) (chat1.EmptyRes, error) {
+	return a.JoinChannelContext(context.Background(), teamName, channelName)
+}
+
+func (a *API) JoinChannelContext(ctx context.Context, teamName string, channelName string) (chat1.EmptyRes, error) {
 	empty := chat1.EmptyRes{}
 
 	teamNameEscaped, err := json.Marshal(teamName)
@@ -379,23 +459,19 @@ func (a *API) JoinChannel(teamName string, channelName string) (chat1.EmptyRes,
 	}
 	apiInput := fmt.Sprintf(`{"method": "join", "params": {"options": {"channel": {"name": %s, "members_type": "team", "topic_name": %s}}}}`,
 		teamNameEscaped, channelNameEscaped)
-	output, err := a.doFetch(apiInput)
-	if err != nil {
-		return empty, err
-	}
-
 	joinChannel := JoinChannel{}
-	err = json.Unmarshal(output, &joinChannel)
-	if err != nil {
-		return empty, fmt.Errorf("failed to parse output from keybase team api: %v", err)
-	} else if joinChannel.Error != nil {
-		return empty, errors.New(joinChannel.Error.Message)
+	if err := a.doFetch(ctx, apiInput, &joinChannel.Result); err != nil {
+		return empty, err
 	}
 
 	return joinChannel.Result, nil
 }
 
 func (a *API) LeaveChannel(teamName string, channelName string) (chat1.EmptyRes, error) {
+	return a.LeaveChannelContext(context.Background(), teamName, channelName)
+}
+
+func (a *API) LeaveChannelContext(ctx context.Context, teamName string, channelName string) (chat1.EmptyRes, error) {
 	empty := chat1.EmptyRes{}
 
 	teamNameEscaped, err := json.Marshal(teamName)
@@ -408,17 +484,9 @@ func (a *API) LeaveChannel(teamName string, channelName string) (chat1.EmptyRes,
 	}
 	apiInput := fmt.Sprintf(`{"method": "leave", "params": {"options": {"channel": {"name": %s, "members_type": "team", "topic_name": %s}}}}`,
 		teamNameEscaped, channelNameEscaped)
-	output, err := a.doFetch(apiInput)
-	if err != nil {
-		return empty, err
-	}
-
 	leaveChannel := LeaveChannel{}
-	err = json.Unmarshal(output, &leaveChannel)
-	if err != nil {
-		return empty, fmt.Errorf("failed to parse output from keybase team api: %v", err)
-	} else if leaveChannel.Error != nil {
-		return empty, errors.New(leaveChannel.Error.Message)
+	if err := a.doFetch(ctx, apiInput, &leaveChannel.Result); err != nil {
+		return empty, err
 	}
 
 	return leaveChannel.Result, nil
@@ -429,6 +497,10 @@ func (a *API) LeaveChannel(teamName string, channelName string) (chat1.EmptyRes,
 ////////////////////////////////////////////////////////
 
 func (a *API) InChatSend(channel chat1.ChatChannel, body string, args ...any) (SendResponse, error) {
+	return a.InChatSendContext(context.Background(), channel, body, args...)
+}
+
+func (a *API) InChatSendContext(ctx context.Context, channel chat1.ChatChannel, body string, args ...any) (SendResponse, error) {
 	arg := newSendArg(sendMessageOptions{
 		Channel: channel,
 		Message: sendMessageBody{
@@ -436,10 +508,14 @@ func (a *API) InChatSend(channel chat1.ChatChannel, body string, args ...any) (S
 		},
 		ConfirmLumenSend: true,
 	})
-	return a.doSend(arg)
+	return a.doSend(ctx, arg)
 }
 
 func (a *API) InChatSendByConvID(convID chat1.ConvIDStr, body string, args ...any) (SendResponse, error) {
+	return a.InChatSendByConvIDContext(context.Background(), convID, body, args...)
+}
+
+func (a *API) InChatSendByConvIDContext(ctx context.Context, convID chat1.ConvIDStr, body string, args ...any) (SendResponse, error) {
 	arg := newSendArg(sendMessageOptions{
 		ConversationID: convID,
 		Message: sendMessageBody{
@@ -447,10 +523,14 @@ func (a *API) InChatSendByConvID(convID chat1.ConvIDStr, body string, args ...an
 		},
 		ConfirmLumenSend: true,
 	})
-	return a.doSend(arg)
+	return a.doSend(ctx, arg)
 }
 
 func (a *API) InChatSendByTlfName(tlfName string, body string, args ...any) (SendResponse, error) {
+	return a.InChatSendByTlfNameContext(context.Background(), tlfName, body, args...)
+}
+
+func (a *API) InChatSendByTlfNameContext(ctx context.Context, tlfName string, body string, args ...any) (SendResponse, error) {
 	arg := newSendArg(sendMessageOptions{
 		Channel: chat1.ChatChannel{
 			Name: tlfName,
@@ -460,7 +540,7 @@ func (a *API) InChatSendByTlfName(tlfName string, body string, args ...any) (Sen
 		},
 		ConfirmLumenSend: true,
 	})
-	return a.doSend(arg)
+	return a.doSend(ctx, arg)
 }
 
 ////////////////////////////////////////////////////////
@@ -498,7 +578,11 @@ func newAdvertiseCmdsMsgArg(ad Advertisement) advertiseCmdsMsgArg {
 }
 
 func (a *API) AdvertiseCommands(ad Advertisement) (SendResponse, error) {
-	return a.doSend(newAdvertiseCmdsMsgArg(ad))
+	return a.AdvertiseCommandsContext(context.Background(), ad)
+}
+
+func (a *API) AdvertiseCommandsContext(ctx context.Context, ad Advertisement) (SendResponse, error) {
+	return a.doSend(ctx, newAdvertiseCmdsMsgArg(ad))
 }
 
 type clearCmdsOptions struct {
@@ -515,7 +599,11 @@ type clearCmdsArg struct {
 }
 
 func (a *API) ClearCommands(filter *chat1.ClearCommandAPIParam) error {
-	_, err := a.doSend(clearCmdsArg{
+	return a.ClearCommandsContext(context.Background(), filter)
+}
+
+func (a *API) ClearCommandsContext(ctx context.Context, filter *chat1.ClearCommandAPIParam) error {
+	_, err := a.doSend(ctx, clearCmdsArg{
 		Method: "clearcommands",
 		Params: clearCmdsParams{
 			Options: clearCmdsOptions{
@@ -550,33 +638,35 @@ func newListCmdsArg(options listCmdsOptions) listCmdsArg {
 }
 
 func (a *API) ListCommands(channel chat1.ChatChannel) ([]chat1.UserBotCommandOutput, error) {
+	return a.ListCommandsContext(context.Background(), channel)
+}
+
+func (a *API) ListCommandsContext(ctx context.Context, channel chat1.ChatChannel) ([]chat1.UserBotCommandOutput, error) {
 	arg := newListCmdsArg(listCmdsOptions{
 		Channel: channel,
 	})
-	return a.listCommands(arg)
+	return a.listCommands(ctx, arg)
 }
 
 func (a *API) ListCommandsByConvID(convID chat1.ConvIDStr) ([]chat1.UserBotCommandOutput, error) {
+	return a.ListCommandsByConvIDContext(context.Background(), convID)
+}
+
+func (a *API) ListCommandsByConvIDContext(ctx context.Context, convID chat1.ConvIDStr) ([]chat1.UserBotCommandOutput, error) {
 	arg := newListCmdsArg(listCmdsOptions{
 		ConversationID: convID,
 	})
-	return a.listCommands(arg)
+	return a.listCommands(ctx, arg)
 }
 
-func (a *API) listCommands(arg listCmdsArg) ([]chat1.UserBotCommandOutput, error) {
+func (a *API) listCommands(ctx context.Context, arg listCmdsArg) ([]chat1.UserBotCommandOutput, error) {
 	bArg, err := json.Marshal(arg)
 	if err != nil {
 		return nil, err
 	}
-	output, err := a.doFetch(string(bArg))
-	if err != nil {
-		return nil, err
-	}
 	var res ListCommandsResponse
-	if err := json.Unmarshal(output, &res); err != nil {
+	if err := a.call(ctx, ChatAPIName, bArg, &res.Result); err != nil {
 		return nil, err
-	} else if res.Error != nil {
-		return nil, errors.New(res.Error.Message)
 	}
 	return res.Result.Commands, nil
 }
@@ -605,35 +695,35 @@ func newListMembersArg(options listMembersOptions) listMembersArg {
 }
 
 func (a *API) ListMembers(channel chat1.ChatChannel) (keybase1.TeamMembersDetails, error) {
+	return a.ListMembersContext(context.Background(), channel)
+}
+
+func (a *API) ListMembersContext(ctx context.Context, channel chat1.ChatChannel) (keybase1.TeamMembersDetails, error) {
 	arg := newListMembersArg(listMembersOptions{
 		Channel: channel,
 	})
-	return a.listMembers(arg)
+	return a.listMembers(ctx, arg)
 }
 
 func (a *API) ListMembersByConvID(conversationID chat1.ConvIDStr) (keybase1.TeamMembersDetails, error) {
+	return a.ListMembersByConvIDContext(context.Background(), conversationID)
+}
+
+func (a *API) ListMembersByConvIDContext(ctx context.Context, conversationID chat1.ConvIDStr) (keybase1.TeamMembersDetails, error) {
 	arg := newListMembersArg(listMembersOptions{
 		ConversationID: conversationID,
 	})
-	return a.listMembers(arg)
+	return a.listMembers(ctx, arg)
 }
 
-func (a *API) listMembers(arg listMembersArg) (res keybase1.TeamMembersDetails, err error) {
+func (a *API) listMembers(ctx context.Context, arg listMembersArg) (res keybase1.TeamMembersDetails, err error) {
 	bArg, err := json.Marshal(arg)
 	if err != nil {
 		return res, err
 	}
-	output, err := a.doFetch(string(bArg))
-	if err != nil {
-		return res, err
-	}
 	members := ListTeamMembers{}
-	err = json.Unmarshal(output, &members)
-	if err != nil {
-		return res, UnmarshalError{err}
-	}
-	if members.Error.Message != "" {
-		return res, members.Error
+	if err := a.call(ctx, ChatAPIName, bArg, &members.Result); err != nil {
+		return res, err
 	}
 	return members.Result.Members, nil
 }
@@ -670,37 +760,37 @@ func newGetMessagesArg(options getMessagesOptions) getMessagesArg {
 }
 
 func (a *API) GetMessages(channel chat1.ChatChannel, msgIDs []chat1.MessageID) ([]chat1.Message, error) {
+	return a.GetMessagesContext(context.Background(), channel, msgIDs)
+}
+
+func (a *API) GetMessagesContext(ctx context.Context, channel chat1.ChatChannel, msgIDs []chat1.MessageID) ([]chat1.Message, error) {
 	arg := newGetMessagesArg(getMessagesOptions{
 		Channel:    channel,
 		MessageIDs: msgIDs,
 	})
-	return a.getMessages(arg)
+	return a.getMessages(ctx, arg)
 }
 
 func (a *API) GetMessagesByConvID(conversationID chat1.ConvIDStr, msgIDs []chat1.MessageID) ([]chat1.Message, error) {
+	return a.GetMessagesByConvIDContext(context.Background(), conversationID, msgIDs)
+}
+
+func (a *API) GetMessagesByConvIDContext(ctx context.Context, conversationID chat1.ConvIDStr, msgIDs []chat1.MessageID) ([]chat1.Message, error) {
 	arg := newGetMessagesArg(getMessagesOptions{
 		ConversationID: conversationID,
 		MessageIDs:     msgIDs,
 	})
-	return a.getMessages(arg)
+	return a.getMessages(ctx, arg)
 }
 
-func (a *API) getMessages(arg getMessagesArg) ([]chat1.Message, error) {
+func (a *API) getMessages(ctx context.Context, arg getMessagesArg) ([]chat1.Message, error) {
 	bArg, err := json.Marshal(arg)
 	if err != nil {
 		return nil, err
 	}
-	output, err := a.doFetch(string(bArg))
-	if err != nil {
-		return nil, err
-	}
 	var res GetMessagesResult
-	err = json.Unmarshal(output, &res)
-	if err != nil {
-		return nil, UnmarshalError{err}
-	}
-	if res.Error != nil {
-		return nil, res.Error
+	if err := a.call(ctx, ChatAPIName, bArg, &res.Result); err != nil {
+		return nil, err
 	}
 	return res.Result.Messages, nil
 }
@@ -0,0 +1,174 @@
+package kbchat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+// deleteHistoryPageSize is the number of messages read at once while looking
+// for the messages DeleteHistory removes.
+const deleteHistoryPageSize = 100
+
+// deletableTypes are the content types DeleteHistory removes. Deleting a
+// message takes its edits and reactions along.
+var deletableTypes = []string{"text", "attachment", "flip", "reaction"}
+
+type deleteOptions struct {
+	Channel        chat1.ChatChannel `json:"channel"`
+	ConversationID chat1.ConvIDStr   `json:"conversation_id,omitempty"`
+	MsgID          chat1.MessageID   `json:"message_id"`
+}
+
+type deleteParams struct {
+	Options deleteOptions
+}
+
+type deleteArg struct {
+	Method string
+	Params deleteParams
+}
+
+func newDeleteArg(options deleteOptions) deleteArg {
+	return deleteArg{
+		Method: "delete",
+		Params: deleteParams{Options: options},
+	}
+}
+
+// DeleteResult is the outcome of deleting one of several messages. Err is
+// an Error or APIError if the service refused.
+type DeleteResult struct {
+	MessageID chat1.MessageID
+	Response  SendResponse
+	Err       error
+}
+
+func (a *API) DeleteByChannel(channel chat1.ChatChannel, msgID chat1.MessageID) (SendResponse, error) {
+	return a.DeleteByChannelContext(context.Background(), channel, msgID)
+}
+
+func (a *API) DeleteByChannelContext(ctx context.Context, channel chat1.ChatChannel, msgID chat1.MessageID) (SendResponse, error) {
+	return a.doSend(ctx, newDeleteArg(deleteOptions{
+		Channel: channel,
+		MsgID:   msgID,
+	}))
+}
+
+func (a *API) DeleteByConvID(convID chat1.ConvIDStr, msgID chat1.MessageID) (SendResponse, error) {
+	return a.DeleteByConvIDContext(context.Background(), convID, msgID)
+}
+
+func (a *API) DeleteByConvIDContext(ctx context.Context, convID chat1.ConvIDStr, msgID chat1.MessageID) (SendResponse, error) {
+	return a.doSend(ctx, newDeleteArg(deleteOptions{
+		ConversationID: convID,
+		MsgID:          msgID,
+	}))
+}
+
+// DeleteMessagesByChannel deletes each of msgIDs, returning a result for
+// every one of them. The error joins the errors of the messages that
+// couldn't be deleted.
+func (a *API) DeleteMessagesByChannel(channel chat1.ChatChannel, msgIDs []chat1.MessageID) ([]DeleteResult, error) {
+	return a.DeleteMessagesByChannelContext(context.Background(), channel, msgIDs)
+}
+
+func (a *API) DeleteMessagesByChannelContext(ctx context.Context, channel chat1.ChatChannel, msgIDs []chat1.MessageID) ([]DeleteResult, error) {
+	return a.deleteMessages(ctx, msgIDs, func(msgID chat1.MessageID) (SendResponse, error) {
+		return a.DeleteByChannelContext(ctx, channel, msgID)
+	})
+}
+
+// DeleteMessagesByConvID is like DeleteMessagesByChannel, for a conversation
+// picked by ID.
+func (a *API) DeleteMessagesByConvID(convID chat1.ConvIDStr, msgIDs []chat1.MessageID) ([]DeleteResult, error) {
+	return a.DeleteMessagesByConvIDContext(context.Background(), convID, msgIDs)
+}
+
+func (a *API) DeleteMessagesByConvIDContext(ctx context.Context, convID chat1.ConvIDStr, msgIDs []chat1.MessageID) ([]DeleteResult, error) {
+	return a.deleteMessages(ctx, msgIDs, func(msgID chat1.MessageID) (SendResponse, error) {
+		return a.DeleteByConvIDContext(ctx, convID, msgID)
+	})
+}
+
+// deleteMessages deletes the messages one at a time. Once ctx is done, the
+// messages left fail with ctx.Err().
+func (a *API) deleteMessages(ctx context.Context, msgIDs []chat1.MessageID,
+	del func(chat1.MessageID) (SendResponse, error)) ([]DeleteResult, error) {
+	results := make([]DeleteResult, 0, len(msgIDs))
+	var errs []error
+	for _, msgID := range msgIDs {
+		res := DeleteResult{MessageID: msgID}
+		if res.Err = ctx.Err(); res.Err == nil {
+			res.Response, res.Err = del(msgID)
+		}
+		if res.Err != nil {
+			errs = append(errs, fmt.Errorf("unable to delete message %d: %w", msgID, res.Err))
+		}
+		results = append(results, res)
+	}
+	return results, errors.Join(errs...)
+}
+
+// DeleteHistoryByChannel deletes the messages of a channel up to and
+// including upto, oldest first. Only texts, attachments, flips and reactions
+// are deleted, as the others go along with them or can't be deleted. It
+// returns a result for every message, and joins their errors like
+// DeleteMessagesByChannel.
+func (a *API) DeleteHistoryByChannel(channel chat1.ChatChannel, upto chat1.MessageID) ([]DeleteResult, error) {
+	return a.DeleteHistoryByChannelContext(context.Background(), channel, upto)
+}
+
+func (a *API) DeleteHistoryByChannelContext(ctx context.Context, channel chat1.ChatChannel, upto chat1.MessageID) ([]DeleteResult, error) {
+	msgIDs, err := a.historyUpto(ctx, upto, func(pagination *chat1.Pagination) (chat1.Thread, error) {
+		return a.peekChannel(ctx, channel, pagination)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a.DeleteMessagesByChannelContext(ctx, channel, msgIDs)
+}
+
+// DeleteHistoryByConvID is like DeleteHistoryByChannel, for a conversation
+// picked by ID.
+func (a *API) DeleteHistoryByConvID(convID chat1.ConvIDStr, upto chat1.MessageID) ([]DeleteResult, error) {
+	return a.DeleteHistoryByConvIDContext(context.Background(), convID, upto)
+}
+
+func (a *API) DeleteHistoryByConvIDContext(ctx context.Context, convID chat1.ConvIDStr, upto chat1.MessageID) ([]DeleteResult, error) {
+	msgIDs, err := a.historyUpto(ctx, upto, func(pagination *chat1.Pagination) (chat1.Thread, error) {
+		return a.peekThread(ctx, convID, pagination)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a.DeleteMessagesByConvIDContext(ctx, convID, msgIDs)
+}
+
+// historyUpto pages through a conversation, collecting the IDs of the
+// deletable messages up to upto, oldest first.
+func (a *API) historyUpto(ctx context.Context, upto chat1.MessageID,
+	peek func(*chat1.Pagination) (chat1.Thread, error)) (msgIDs []chat1.MessageID, err error) {
+	pagination := &chat1.Pagination{Num: deleteHistoryPageSize}
+	for {
+		thread, err := peek(pagination)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range thread.Messages {
+			if msg.Msg == nil || msg.Msg.Id > upto || !slices.Contains(deletableTypes, msg.Msg.Content.TypeName) {
+				continue
+			}
+			msgIDs = append(msgIDs, msg.Msg.Id)
+		}
+		if thread.Pagination == nil || thread.Pagination.Last || len(thread.Pagination.Next) == 0 {
+			break
+		}
+		pagination = &chat1.Pagination{Num: deleteHistoryPageSize, Next: thread.Pagination.Next}
+	}
+	slices.Sort(msgIDs)
+	return msgIDs, nil
+}
@@ -0,0 +1,88 @@
+package kbchat
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/keybase1"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeDeleteRequest struct {
+	Params struct {
+		Options struct {
+			ConversationID chat1.ConvIDStr `json:"conversation_id"`
+			MsgID          chat1.MessageID `json:"message_id"`
+		} `json:"options"`
+	} `json:"params"`
+}
+
+// fakeDeletes answers read like fakeChat and records the messages deleted,
+// refusing to delete the ones in notAllowed.
+func fakeDeletes(t *testing.T, threads map[string]chat1.Thread, notAllowed ...chat1.MessageID) (*fakeTransport, *[]chat1.MessageID) {
+	var deleted []chat1.MessageID
+	read := fakeChat(t, nil, threads)
+	transport := newFakeTransport(func(req fakeRequest) (any, error) {
+		if req.method != "delete" {
+			return read(req)
+		}
+		var del fakeDeleteRequest
+		require.NoError(t, json.Unmarshal(req.request, &del))
+		require.Equal(t, chat1.ConvIDStr("abc"), del.Params.Options.ConversationID)
+		for _, id := range notAllowed {
+			if del.Params.Options.MsgID == id {
+				return errorResponse(keybase1.StatusCode_SCChatNotInConv, "not allowed"), nil
+			}
+		}
+		deleted = append(deleted, del.Params.Options.MsgID)
+		return map[string]any{"result": chat1.SendRes{Message: "message deleted"}}, nil
+	})
+	return transport, &deleted
+}
+
+func TestDeleteMessages(t *testing.T) {
+	transport, deleted := fakeDeletes(t, nil, 2)
+	api, err := Start(RunOptions{}, WithTransport(transport))
+	require.NoError(t, err)
+
+	res, err := api.DeleteByConvID("abc", 1)
+	require.NoError(t, err)
+	require.Equal(t, "message deleted", res.Result.Message)
+
+	results, err := api.DeleteMessagesByConvID("abc", []chat1.MessageID{3, 2, 4})
+	require.ErrorIs(t, err, ErrNotAMember)
+	require.ErrorContains(t, err, "unable to delete message 2")
+	require.Len(t, results, 3)
+	require.NoError(t, results[0].Err)
+	require.Equal(t, chat1.MessageID(2), results[1].MessageID)
+	var apiErr Error
+	require.True(t, errors.As(results[1].Err, &apiErr))
+	require.Equal(t, "delete", apiErr.Method)
+	require.NoError(t, results[2].Err)
+	require.Equal(t, []chat1.MessageID{1, 3, 4}, *deleted)
+}
+
+func TestDeleteHistory(t *testing.T) {
+	msg := func(id int, typ string) chat1.MsgSummary {
+		return chat1.MsgSummary{Id: chat1.MessageID(id), ConvID: "abc", Content: chat1.MsgContent{TypeName: typ}}
+	}
+	first := threadOf(msg(7, "text"), msg(6, "text"), msg(5, "edit"), msg(4, "reaction"))
+	first.Pagination = &chat1.Pagination{Next: []byte("p2")}
+	second := threadOf(msg(3, "join"), msg(2, "attachment"), msg(1, "text"))
+	second.Pagination = &chat1.Pagination{Last: true}
+	transport, deleted := fakeDeletes(t, map[string]chat1.Thread{"abc": first, "abc/p2": second}, 1)
+	api, err := Start(RunOptions{}, WithTransport(transport))
+	require.NoError(t, err)
+
+	results, err := api.DeleteHistoryByConvID("abc", 6)
+	require.ErrorIs(t, err, ErrNotAMember)
+	var ids []chat1.MessageID
+	for _, res := range results {
+		ids = append(ids, res.MessageID)
+	}
+	require.Equal(t, []chat1.MessageID{1, 2, 4, 6}, ids)
+	require.Error(t, results[0].Err)
+	require.Equal(t, []chat1.MessageID{2, 4, 6}, *deleted)
+}
@@ -0,0 +1,180 @@
+package kbchat
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// bulkMethods are the chat API methods that can keep a pipe busy for a long
+// time. When RunOptions.NumBulkPipes is set they get pipes of their own, so
+// they don't hold up quick requests.
+var bulkMethods = map[string]bool{
+	"attach":   true,
+	"download": true,
+}
+
+// PipeStats describes a single `keybase chat api` process.
+type PipeStats struct {
+	// Bulk is set for pipes reserved for bulk operations.
+	Bulk    bool
+	Healthy bool
+	Busy    bool
+	// BusyTime is the total time the pipe has spent serving requests.
+	BusyTime time.Duration
+	Requests int64
+}
+
+// DispatcherStats is a snapshot of how API requests are spread over pipes.
+type DispatcherStats struct {
+	// QueueDepth is the number of requests waiting for a free pipe.
+	QueueDepth int
+	// BulkQueueDepth is the number of bulk requests waiting for a free bulk
+	// pipe. It is always zero unless RunOptions.NumBulkPipes is set.
+	BulkQueueDepth int
+	Pipes          []PipeStats
+}
+
+// pipeDispatcher hands out free pipes to requests. Requests that find every
+// pipe busy are queued and served in arrival order as pipes free up.
+type pipeDispatcher struct {
+	sync.Mutex
+	pipes   []*apiPipe
+	free    []*apiPipe
+	waiters []chan *apiPipe
+}
+
+func newPipeDispatcher() *pipeDispatcher {
+	return &pipeDispatcher{}
+}
+
+// replace swaps in a new set of pipes, handing them to queued requests first.
+// Without any pipes, queued requests fail.
+func (d *pipeDispatcher) replace(pipes []*apiPipe) {
+	d.Lock()
+	d.pipes = pipes
+	d.free = nil
+	if len(pipes) == 0 {
+		for _, waiter := range d.waiters {
+			waiter <- nil
+		}
+		d.waiters = nil
+	}
+	d.Unlock()
+	for _, pipe := range pipes {
+		d.release(pipe)
+	}
+}
+
+func (d *pipeDispatcher) snapshot() []*apiPipe {
+	d.Lock()
+	defer d.Unlock()
+	return slices.Clone(d.pipes)
+}
+
+// acquire waits for the next free healthy pipe.
+func (d *pipeDispatcher) acquire(ctx context.Context) (*apiPipe, error) {
+	d.Lock()
+	if len(d.pipes) == 0 {
+		d.Unlock()
+		return nil, errAPIDisconnected
+	}
+	for len(d.free) > 0 {
+		pipe := d.free[0]
+		d.free = d.free[1:]
+		pipe.inPool = false
+		// Pipes that died while idle come back through their supervisor.
+		if pipe.healthy.Load() {
+			d.Unlock()
+			return pipe, nil
+		}
+	}
+	waiter := make(chan *apiPipe, 1)
+	d.waiters = append(d.waiters, waiter)
+	d.Unlock()
+
+	select {
+	case pipe := <-waiter:
+		if pipe == nil {
+			return nil, errAPIDisconnected
+		}
+		return pipe, nil
+	case <-ctx.Done():
+		d.Lock()
+		d.waiters = slices.DeleteFunc(d.waiters, func(w chan *apiPipe) bool { return w == waiter })
+		d.Unlock()
+		// We may have been handed a pipe just as we gave up on waiting.
+		select {
+		case pipe := <-waiter:
+			if pipe != nil {
+				d.release(pipe)
+			}
+		default:
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// release returns a pipe to the dispatcher. Unhealthy pipes are dropped
+// until their supervisor has respawned them and releases them again.
+func (d *pipeDispatcher) release(pipe *apiPipe) {
+	d.Lock()
+	defer d.Unlock()
+	if pipe.inPool || !pipe.healthy.Load() || !slices.Contains(d.pipes, pipe) {
+		return
+	}
+	if len(d.waiters) > 0 {
+		waiter := d.waiters[0]
+		d.waiters = d.waiters[1:]
+		waiter <- pipe
+		return
+	}
+	pipe.inPool = true
+	d.free = append(d.free, pipe)
+}
+
+func (d *pipeDispatcher) queueDepth() int {
+	d.Lock()
+	defer d.Unlock()
+	return len(d.waiters)
+}
+
+// pipePool picks the dispatcher that should serve the given chat API method.
+func (t *ExecTransport) pipePool(method string) *pipeDispatcher {
+	if bulkMethods[method] && len(t.bulkPool.snapshot()) > 0 {
+		return t.bulkPool
+	}
+	return t.pool
+}
+
+func (t *ExecTransport) releasePipe(pipe *apiPipe) {
+	if pipe.bulk {
+		t.bulkPool.release(pipe)
+	} else {
+		t.pool.release(pipe)
+	}
+}
+
+// DispatcherStats reports queue depths and per pipe load, if the API uses the
+// default ExecTransport.
+func (a *API) DispatcherStats() DispatcherStats {
+	if t, ok := a.transport.(*ExecTransport); ok {
+		return t.DispatcherStats()
+	}
+	return DispatcherStats{}
+}
+
+// DispatcherStats reports queue depths and per pipe load.
+func (t *ExecTransport) DispatcherStats() DispatcherStats {
+	stats := DispatcherStats{
+		QueueDepth:     t.pool.queueDepth(),
+		BulkQueueDepth: t.bulkPool.queueDepth(),
+	}
+	for _, d := range []*pipeDispatcher{t.pool, t.bulkPool} {
+		for _, pipe := range d.snapshot() {
+			stats.Pipes = append(stats.Pipes, pipe.stats())
+		}
+	}
+	return stats
+}
@@ -0,0 +1,73 @@
+package kbchat
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func healthyTestPipes(n int) []*apiPipe {
+	var pipes []*apiPipe
+	for range n {
+		pipe := newAPIPipe(false)
+		pipe.healthy.Store(true)
+		pipes = append(pipes, pipe)
+	}
+	return pipes
+}
+
+func TestDispatcherHandsOutFreePipes(t *testing.T) {
+	d := newPipeDispatcher()
+	pipes := healthyTestPipes(2)
+	d.replace(pipes)
+
+	first, err := d.acquire(context.Background())
+	require.NoError(t, err)
+	second, err := d.acquire(context.Background())
+	require.NoError(t, err)
+	require.NotSame(t, first, second)
+
+	// With both pipes busy, requests queue up and are served in order.
+	gotCh := make(chan *apiPipe, 2)
+	for i := range 2 {
+		go func() {
+			pipe, err := d.acquire(context.Background())
+			require.NoError(t, err)
+			gotCh <- pipe
+		}()
+		require.Eventually(t, func() bool { return d.queueDepth() == i+1 }, time.Second, time.Millisecond)
+	}
+	require.Equal(t, 2, d.queueDepth())
+
+	d.release(second)
+	require.Same(t, second, <-gotCh)
+	d.release(first)
+	require.Same(t, first, <-gotCh)
+	require.Equal(t, 0, d.queueDepth())
+}
+
+func TestDispatcherSkipsUnhealthyPipes(t *testing.T) {
+	d := newPipeDispatcher()
+	pipes := healthyTestPipes(2)
+	d.replace(pipes)
+	pipes[0].healthy.Store(false)
+
+	pipe, err := d.acquire(context.Background())
+	require.NoError(t, err)
+	require.Same(t, pipes[1], pipe)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = d.acquire(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, 0, d.queueDepth())
+
+	// Once respawned, the supervisor hands the pipe back.
+	pipes[0].healthy.Store(true)
+	d.release(pipes[0])
+	pipe, err = d.acquire(context.Background())
+	require.NoError(t, err)
+	require.Same(t, pipes[0], pipe)
+}
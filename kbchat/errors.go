@@ -1,29 +1,88 @@
 package kbchat
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/keybase1"
 )
 
 type ErrorCode int
 
-var errAPIDisconnected = errors.New("chat API disconnected")
+var errAPIDisconnected = fmt.Errorf("chat API disconnected: %w", ErrServiceUnreachable)
 
 const (
 	RevisionErrorCode          ErrorCode = 2760
 	DeleteNonExistentErrorCode ErrorCode = 2762
 )
 
+// Error categories, for use with errors.Is.
+var (
+	ErrRateLimited          = errors.New("rate limited")
+	ErrNotAMember           = errors.New("not a member")
+	ErrConversationNotFound = errors.New("conversation not found")
+	ErrRevisionConflict     = errors.New("revision conflict")
+	ErrServiceUnreachable   = errors.New("keybase service unreachable")
+	ErrAuthExpired          = errors.New("authentication expired")
+)
+
+// ErrShutdown is returned by calls made after the API started shutting down.
+var ErrShutdown = errors.New("api shut down")
+
+// errorCategories maps the status codes returned by the keybase service to
+// error categories.
+var errorCategories = map[ErrorCode]error{
+	ErrorCode(keybase1.StatusCode_SCThrottleControl):          ErrRateLimited,
+	ErrorCode(keybase1.StatusCode_SCRateLimit):                ErrRateLimited,
+	ErrorCode(keybase1.StatusCode_SCChatRateLimit):            ErrRateLimited,
+	ErrorCode(keybase1.StatusCode_SCChatNotInConv):            ErrNotAMember,
+	ErrorCode(keybase1.StatusCode_SCChatNotInTeam):            ErrNotAMember,
+	ErrorCode(keybase1.StatusCode_SCTeamBadMembership):        ErrNotAMember,
+	ErrorCode(keybase1.StatusCode_SCChatBadConversationError): ErrConversationNotFound,
+	ErrorCode(keybase1.StatusCode_SCTeamStorageWrongRevision): ErrRevisionConflict,
+	ErrorCode(keybase1.StatusCode_SCStellarWrongRevision):     ErrRevisionConflict,
+	ErrorCode(keybase1.StatusCode_SCOffline):                  ErrServiceUnreachable,
+	ErrorCode(keybase1.StatusCode_SCAPINetworkError):          ErrServiceUnreachable,
+	ErrorCode(keybase1.StatusCode_SCLoginRequired):            ErrAuthExpired,
+	ErrorCode(keybase1.StatusCode_SCBadSession):               ErrAuthExpired,
+	ErrorCode(keybase1.StatusCode_SCReloginRequired):          ErrAuthExpired,
+	ErrorCode(keybase1.StatusCode_SCNoSession):                ErrAuthExpired,
+	ErrorCode(keybase1.StatusCode_SCNISTExpired):              ErrAuthExpired,
+}
+
 // Error is for unmarshaling CLI json responses
 type Error struct {
 	Code    ErrorCode `json:"code"`
 	Message string    `json:"message"`
+	// Method is the API method that failed, and Raw the full response the
+	// error arrived in, a string so that Error stays comparable.
+	Method string `json:"-"`
+	Raw    string `json:"-"`
+
+	// category classifies errors detected by the library itself rather than
+	// reported by the service.
+	category error
 }
 
 func (e Error) Error() string {
+	if e.Method != "" {
+		return fmt.Sprintf("received error response from keybase api (%s): %s", e.Method, e.Message)
+	}
 	return fmt.Sprintf("received error response from keybase api: %s", e.Message)
 }
 
+// Is reports whether the error belongs to one of the error categories.
+func (e Error) Is(target error) bool {
+	if e.category != nil {
+		return e.category == target
+	}
+	category, ok := errorCategories[e.Code]
+	return ok && category == target
+}
+
 type APIError struct {
 	err error
 }
@@ -36,6 +95,13 @@ func (e APIError) Unwrap() error {
 	return e.err
 }
 
+// Is reports failures to reach the service as ErrServiceUnreachable, unless
+// the call was abandoned because its context was done.
+func (e APIError) Is(target error) bool {
+	return target == ErrServiceUnreachable &&
+		!errors.Is(e.err, context.Canceled) && !errors.Is(e.err, context.DeadlineExceeded)
+}
+
 type UnmarshalError struct {
 	err error
 }
@@ -47,3 +113,60 @@ func (e UnmarshalError) Error() string {
 func (e UnmarshalError) Unwrap() error {
 	return e.err
 }
+
+// ErrFrameTooLarge reports a notification larger than
+// ListenOptions.MaxFrameSize.
+var ErrFrameTooLarge = errors.New("notification too large")
+
+// FrameError is a notification from the listener that could not be
+// delivered, either because it was too large or because it could not be
+// decoded.
+type FrameError struct {
+	// ConvID is the conversation the notification came from, if it could be
+	// found.
+	ConvID chat1.ConvIDStr
+	// Size is the size of the notification, and Frame its start.
+	Size  int
+	Frame []byte
+	Err   error
+}
+
+func (e FrameError) Error() string {
+	var conv string
+	if e.ConvID != "" {
+		conv = fmt.Sprintf(" from %s", e.ConvID)
+	}
+	if errors.Is(e.Err, ErrFrameTooLarge) {
+		return fmt.Sprintf("skipped notification%s: %d bytes: %v", conv, e.Size, e.Err)
+	}
+	return fmt.Sprintf("unable to decode notification%s: %v, data: %s", conv, e.Err, e.Frame)
+}
+
+func (e FrameError) Unwrap() error {
+	return e.Err
+}
+
+// decodeResponse unmarshals the result of a raw API response into result,
+// or returns the Error the response carries.
+func decodeResponse(method string, raw []byte, result any) error {
+	var resp struct {
+		Result json.RawMessage `json:"result"`
+		Error  *Error          `json:"error"`
+	}
+	if err := json.Unmarshal(raw, &resp); err != nil {
+		return UnmarshalError{err}
+	}
+	if resp.Error != nil && (resp.Error.Code != 0 || resp.Error.Message != "") {
+		apiErr := *resp.Error
+		apiErr.Method = method
+		apiErr.Raw = string(raw)
+		return apiErr
+	}
+	if result == nil || len(resp.Result) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(resp.Result, result); err != nil {
+		return UnmarshalError{err}
+	}
+	return nil
+}
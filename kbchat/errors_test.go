@@ -0,0 +1,85 @@
+package kbchat
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/keybase1"
+	"github.com/stretchr/testify/require"
+)
+
+func errorResponse(code keybase1.StatusCode, message string) map[string]any {
+	return map[string]any{"error": map[string]any{"code": int(code), "message": message}}
+}
+
+func TestErrorCategories(t *testing.T) {
+	var status keybase1.StatusCode
+	transport := newFakeTransport(func(req fakeRequest) (any, error) {
+		return errorResponse(status, "boom"), nil
+	})
+	api, err := Start(RunOptions{}, WithTransport(transport))
+	require.NoError(t, err)
+
+	cases := []struct {
+		status   keybase1.StatusCode
+		category error
+	}{
+		{keybase1.StatusCode_SCChatRateLimit, ErrRateLimited},
+		{keybase1.StatusCode_SCChatNotInConv, ErrNotAMember},
+		{keybase1.StatusCode_SCChatBadConversationError, ErrConversationNotFound},
+		{keybase1.StatusCode_SCTeamStorageWrongRevision, ErrRevisionConflict},
+		{keybase1.StatusCode_SCLoginRequired, ErrAuthExpired},
+	}
+	for _, c := range cases {
+		status = c.status
+		_, err := api.GetConversations(false)
+		require.ErrorIs(t, err, c.category)
+		var apiErr Error
+		require.True(t, errors.As(err, &apiErr))
+		require.Equal(t, ErrorCode(c.status), apiErr.Code)
+		require.Equal(t, "list", apiErr.Method)
+		require.Equal(t, "boom", apiErr.Message)
+		require.Contains(t, apiErr.Raw, "boom")
+		require.True(t, err == error(apiErr))
+	}
+
+	team := "team"
+	status = keybase1.StatusCode_SCTeamStorageWrongRevision
+	_, err = api.PutEntryWithRevision(&team, "ns", "key", "value", 2)
+	require.ErrorIs(t, err, ErrRevisionConflict)
+	require.NotErrorIs(t, err, ErrRateLimited)
+	var apiErr Error
+	require.True(t, errors.As(err, &apiErr))
+	require.Equal(t, RevisionErrorCode, apiErr.Code)
+	require.Equal(t, "put", apiErr.Method)
+}
+
+func TestErrorConversationNotFound(t *testing.T) {
+	transport := newFakeTransport(func(req fakeRequest) (any, error) {
+		return map[string]any{"result": map[string]any{"conversations": nil}}, nil
+	})
+	api, err := Start(RunOptions{}, WithTransport(transport))
+	require.NoError(t, err)
+
+	_, err = api.GetConversation("abc")
+	require.ErrorIs(t, err, ErrConversationNotFound)
+}
+
+func TestErrorServiceUnreachable(t *testing.T) {
+	sendErr := errors.New("connection refused")
+	transport := newFakeTransport(func(req fakeRequest) (any, error) {
+		return nil, sendErr
+	})
+	api, err := Start(RunOptions{}, WithTransport(transport))
+	require.NoError(t, err)
+
+	_, err = api.GetConversations(false)
+	require.ErrorIs(t, err, ErrServiceUnreachable)
+	require.ErrorIs(t, err, sendErr)
+
+	sendErr = context.DeadlineExceeded
+	_, err = api.GetConversations(false)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.NotErrorIs(t, err, ErrServiceUnreachable)
+}
@@ -0,0 +1,207 @@
+package kbchat
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+// Event is anything delivered by a Subscription: a MessageEvent, PinEvent,
+// UnpinEvent, ConversationEvent, WalletEvent, TypingEvent, ErrorEvent,
+// ReconnectedEvent or DisconnectedEvent.
+type Event interface {
+	isEvent()
+}
+
+// MessageEvent is a new chat message.
+type MessageEvent struct {
+	SubscriptionMessage
+}
+
+// PinEvent is a message pinning PinnedMsgID, delivered with
+// ListenOptions.Pins.
+type PinEvent struct {
+	SubscriptionMessage
+	PinnedMsgID chat1.MessageID
+}
+
+// UnpinEvent is the deletion of a pin message, which unpins PinnedMsgID,
+// delivered with ListenOptions.Pins. Only pins the listener has seen are
+// recognized, the deletion of older ones is a MessageEvent.
+type UnpinEvent struct {
+	SubscriptionMessage
+	PinnedMsgID chat1.MessageID
+}
+
+// ConversationEvent is a new conversation, delivered with ListenOptions.Convs.
+type ConversationEvent struct {
+	SubscriptionConversation
+}
+
+// WalletEvent is a payment, delivered with ListenOptions.Wallet.
+type WalletEvent struct {
+	SubscriptionWalletEvent
+}
+
+// TypingEvent lists who is typing in a conversation, delivered with
+// ListenOptions.Typing. An empty list means nobody is typing anymore.
+type TypingEvent struct {
+	ConvID chat1.ConvIDStr
+	Typers []chat1.TyperInfo
+}
+
+// ErrorEvent is a notification that could not be delivered, usually a
+// FrameError.
+type ErrorEvent struct {
+	// Type is the type of the notification, such as "chat", "chat_conv",
+	// "wallet" or "typing", or empty if it isn't known.
+	Type string
+	Err  error
+}
+
+// ReconnectedEvent is delivered whenever the listener (re)starts.
+type ReconnectedEvent struct{}
+
+// DisconnectedEvent is delivered for every failed attempt to start the
+// listener and whenever it goes away. Unless GaveUp is set, Listen tries again
+// after RetryIn. Otherwise the reconnect policy is exhausted and the
+// subscription shuts down.
+type DisconnectedEvent struct {
+	// Attempts is the number of consecutive failed attempts so far.
+	Attempts int
+	Err      error
+	RetryIn  time.Duration
+	GaveUp   bool
+}
+
+func (MessageEvent) isEvent()      {}
+func (PinEvent) isEvent()          {}
+func (UnpinEvent) isEvent()        {}
+func (ConversationEvent) isEvent() {}
+func (WalletEvent) isEvent()       {}
+func (TypingEvent) isEvent()       {}
+func (ErrorEvent) isEvent()        {}
+func (ReconnectedEvent) isEvent()  {}
+func (DisconnectedEvent) isEvent() {}
+
+// newErrorEvent reports a bad notification, with its type if that can be
+// found.
+func newErrorEvent(err FrameError) ErrorEvent {
+	event := ErrorEvent{Err: err}
+	if m := frameTypeRe.FindSubmatch(err.Frame); m != nil {
+		event.Type = string(m[1])
+	}
+	return event
+}
+
+// connectionEvent converts a connection state change into its Event.
+func connectionEvent(event SubscriptionConnectionEvent) Event {
+	if event.State == ConnectionConnected {
+		return ReconnectedEvent{}
+	}
+	return DisconnectedEvent{
+		Attempts: event.Attempts,
+		Err:      event.Err,
+		RetryIn:  event.RetryIn,
+		GaveUp:   event.State == ConnectionGaveUp,
+	}
+}
+
+// subscriptionConnectionEvent converts a ReconnectedEvent or
+// DisconnectedEvent back into the connection state change it reports.
+func subscriptionConnectionEvent(event Event) (SubscriptionConnectionEvent, bool) {
+	switch event := event.(type) {
+	case ReconnectedEvent:
+		return SubscriptionConnectionEvent{State: ConnectionConnected}, true
+	case DisconnectedEvent:
+		state := ConnectionDisconnected
+		if event.GaveUp {
+			state = ConnectionGaveUp
+		}
+		return SubscriptionConnectionEvent{
+			State:    state,
+			Attempts: event.Attempts,
+			Err:      event.Err,
+			RetryIn:  event.RetryIn,
+		}, true
+	default:
+		return SubscriptionConnectionEvent{}, false
+	}
+}
+
+func newMessageEvent(msg chat1.MsgSummary, source string) MessageEvent {
+	return MessageEvent{SubscriptionMessage{
+		Message: msg,
+		Conversation: chat1.ConvSummary{
+			Id:      msg.ConvID,
+			Channel: msg.Channel,
+		},
+		Source: source,
+	}}
+}
+
+// messageOf returns the chat message carried by a MessageEvent, PinEvent or
+// UnpinEvent.
+func messageOf(event Event) (SubscriptionMessage, bool) {
+	switch event := event.(type) {
+	case MessageEvent:
+		return event.SubscriptionMessage, true
+	case PinEvent:
+		return event.SubscriptionMessage, true
+	case UnpinEvent:
+		return event.SubscriptionMessage, true
+	default:
+		return SubscriptionMessage{}, false
+	}
+}
+
+// decodeEvent decodes a single api-listen notification. Notifications that
+// carry nothing to deliver decode to nil.
+func (a *API) decodeEvent(line []byte) Event {
+	var typeHolder TypeHolder
+	if err := json.Unmarshal(line, &typeHolder); err != nil {
+		return newErrorEvent(newFrameError(line, len(line), err))
+	}
+	switch typeHolder.Type {
+	case "chat":
+		var notification chat1.MsgNotification
+		if err := json.Unmarshal(line, &notification); err != nil {
+			return ErrorEvent{Type: typeHolder.Type, Err: newFrameError(line, len(line), err)}
+		}
+		if notification.Error != nil {
+			a.Debug("error message received: %s", *notification.Error)
+		} else if notification.Msg != nil {
+			event := newMessageEvent(*notification.Msg, notification.Source)
+			if notification.Msg.Content.TypeName == "pin" {
+				return PinEvent{SubscriptionMessage: event.SubscriptionMessage, PinnedMsgID: pinnedMsgID(line)}
+			}
+			return event
+		}
+	case "chat_conv":
+		var notification chat1.ConvNotification
+		if err := json.Unmarshal(line, &notification); err != nil {
+			return ErrorEvent{Type: typeHolder.Type, Err: newFrameError(line, len(line), err)}
+		}
+		if notification.Error != nil {
+			a.Debug("error message received: %s", *notification.Error)
+		} else if notification.Conv != nil {
+			return ConversationEvent{SubscriptionConversation{
+				Conversation: *notification.Conv,
+			}}
+		}
+	case "wallet":
+		var holder PaymentHolder
+		if err := json.Unmarshal(line, &holder); err != nil {
+			return ErrorEvent{Type: typeHolder.Type, Err: newFrameError(line, len(line), err)}
+		}
+		return WalletEvent{SubscriptionWalletEvent(holder)}
+	case "typing":
+		var notification TypingNotification
+		if err := json.Unmarshal(line, &notification); err != nil {
+			return ErrorEvent{Type: typeHolder.Type, Err: newFrameError(line, len(line), err)}
+		}
+		return TypingEvent{ConvID: notification.ConvID, Typers: notification.Typers}
+	}
+	return nil
+}
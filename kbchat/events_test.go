@@ -0,0 +1,107 @@
+package kbchat
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/stellar1"
+	"github.com/stretchr/testify/require"
+)
+
+func listenFake(t *testing.T, opts ListenOptions) (*Subscription, io.Writer) {
+	transport := newFakeTransport(func(req fakeRequest) (any, error) {
+		return nil, errors.New("unexpected request")
+	})
+	api := NewAPI(RunOptions{}, WithTransport(transport))
+	sub, err := api.Listen(opts)
+	require.NoError(t, err)
+	t.Cleanup(sub.Shutdown)
+	return sub, <-transport.streams
+}
+
+func writeTestEvents(t *testing.T, stream io.Writer) {
+	writeEvent(t, stream, chat1.MsgNotification{
+		Type: "chat",
+		Msg:  &chat1.MsgSummary{Id: 1, ConvID: "abc"},
+	})
+	writeEvent(t, stream, chat1.ConvNotification{
+		Type: "chat_conv",
+		Conv: &chat1.ConvSummary{Id: "def"},
+	})
+	writeEvent(t, stream, map[string]any{
+		"type":         "wallet",
+		"notification": stellar1.PaymentDetailsLocal{Summary: stellar1.PaymentLocal{AmountDescription: "1 XLM"}},
+	})
+	_, err := fmt.Fprintln(stream, "not json")
+	require.NoError(t, err)
+}
+
+func TestSubscriptionEvents(t *testing.T) {
+	sub, stream := listenFake(t, ListenOptions{Wallet: true, Convs: true})
+	writeTestEvents(t, stream)
+
+	require.Equal(t, ReconnectedEvent{}, <-sub.Events())
+	msg := (<-sub.Events()).(MessageEvent)
+	require.Equal(t, chat1.ConvIDStr("abc"), msg.Conversation.Id)
+	conv := (<-sub.Events()).(ConversationEvent)
+	require.Equal(t, chat1.ConvIDStr("def"), conv.Conversation.Id)
+	wallet := (<-sub.Events()).(WalletEvent)
+	require.Equal(t, "1 XLM", wallet.Payment.Summary.AmountDescription)
+	errEvent := (<-sub.Events()).(ErrorEvent)
+	require.ErrorContains(t, errEvent.Err, "not json")
+}
+
+func TestSubscriptionReadersFilterEvents(t *testing.T) {
+	sub, stream := listenFake(t, ListenOptions{Wallet: true, Convs: true})
+	writeTestEvents(t, stream)
+
+	// Each reader only takes its own kind of event, no matter which one
+	// pulled it off the stream.
+	wallets := make(chan SubscriptionWalletEvent, 1)
+	go func() {
+		wallet, err := sub.ReadWallet()
+		require.NoError(t, err)
+		wallets <- wallet
+	}()
+	conv, err := sub.ReadNewConvs()
+	require.NoError(t, err)
+	require.Equal(t, chat1.ConvIDStr("def"), conv.Conversation.Id)
+	msg, err := sub.Read()
+	require.NoError(t, err)
+	require.Equal(t, chat1.ConvIDStr("abc"), msg.Conversation.Id)
+	require.Equal(t, "1 XLM", (<-wallets).Payment.Summary.AmountDescription)
+	_, err = sub.Read()
+	require.ErrorContains(t, err, "not json")
+	conn, err := sub.ReadConnection()
+	require.NoError(t, err)
+	require.Equal(t, ConnectionConnected, conn.State)
+}
+
+func TestSubscriptionRoutesErrors(t *testing.T) {
+	sub, stream := listenFake(t, ListenOptions{Wallet: true, Convs: true})
+	for _, line := range []string{
+		`{"type":"wallet","notification":"bad"}`,
+		`{"type":"chat_conv","conv":"bad"}`,
+		`{"type":"chat","msg":"bad"}`,
+	} {
+		_, err := fmt.Fprintln(stream, line)
+		require.NoError(t, err)
+	}
+
+	// Errors go to the reader of the notification they came from.
+	_, err := sub.Read()
+	var frameErr FrameError
+	require.ErrorAs(t, err, &frameErr)
+	require.Contains(t, string(frameErr.Frame), `"type":"chat"`)
+	_, err = sub.ReadNewConvs()
+	require.ErrorAs(t, err, &frameErr)
+	require.Contains(t, string(frameErr.Frame), `"type":"chat_conv"`)
+	_, err = sub.ReadWallet()
+	require.ErrorAs(t, err, &frameErr)
+	require.Contains(t, string(frameErr.Frame), `"type":"wallet"`)
+
+	require.Equal(t, "wallet", newErrorEvent(newFrameError([]byte(`{"type":"wallet",`), 100, ErrFrameTooLarge)).Type)
+}
@@ -0,0 +1,154 @@
+package kbchat
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+// MessageSource picks messages by the device they were sent from.
+type MessageSource int
+
+const (
+	// SourceRemote delivers the messages sent from other devices.
+	SourceRemote MessageSource = iota
+	// SourceLocal delivers only the messages sent from this device.
+	SourceLocal
+	// SourceAll delivers messages from every device.
+	SourceAll
+)
+
+// sourceLocal and sourceRemote are the SubscriptionMessage.Source of
+// messages sent from this device and from the others.
+const (
+	sourceLocal  = "local"
+	sourceRemote = "remote"
+)
+
+// fetchedSource returns the Source of messages that were fetched rather than
+// listened to, which the service doesn't report. Messages of the bot sent
+// from the device it is logged in with are local. If that device isn't
+// known, all of the bot's own messages are.
+func (a *API) fetchedSource() func(msg chat1.MsgSummary) string {
+	a.Lock()
+	username, deviceName := a.username, a.deviceName
+	a.Unlock()
+	return func(msg chat1.MsgSummary) string {
+		if username != "" && strings.EqualFold(msg.Sender.Username, username) &&
+			(deviceName == "" || msg.Sender.DeviceName == deviceName) {
+			return sourceLocal
+		}
+		return sourceRemote
+	}
+}
+
+// MessageFilter picks the messages a subscription delivers. Empty fields
+// match every message.
+type MessageFilter struct {
+	// Senders are the usernames whose messages are delivered.
+	Senders []string
+	// Teams are the teams whose channels' messages are delivered.
+	Teams []string
+	// ContentTypes are the types of content delivered, such as "text",
+	// "attachment" or "reaction".
+	ContentTypes []string
+	// Match, if set, is called for every message that passes the other
+	// filters.
+	Match func(msg chat1.MsgSummary) bool
+}
+
+func (f *MessageFilter) matches(msg chat1.MsgSummary) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.Senders) > 0 && !containsFold(f.Senders, msg.Sender.Username) {
+		return false
+	}
+	if len(f.Teams) > 0 && (msg.Channel.MembersType != "team" || !containsFold(f.Teams, msg.Channel.Name)) {
+		return false
+	}
+	if len(f.ContentTypes) > 0 && !slices.Contains(f.ContentTypes, msg.Content.TypeName) {
+		return false
+	}
+	return f.Match == nil || f.Match(msg)
+}
+
+func containsFold(list []string, s string) bool {
+	return slices.ContainsFunc(list, func(item string) bool { return strings.EqualFold(item, s) })
+}
+
+// channelMatches reports whether ch is filter. Fields left empty in filter
+// match anything.
+func channelMatches(filter, ch chat1.ChatChannel) bool {
+	return strings.EqualFold(filter.Name, ch.Name) &&
+		(filter.TopicName == "" || strings.EqualFold(filter.TopicName, ch.TopicName)) &&
+		(filter.MembersType == "" || filter.MembersType == ch.MembersType) &&
+		(filter.TopicType == "" || filter.TopicType == ch.TopicType)
+}
+
+// listenArgs are the api-listen flags for the filters the listener applies
+// itself.
+func (o ListenOptions) listenArgs() ([]string, error) {
+	var args []string
+	if o.Wallet {
+		args = append(args, "--wallet")
+	}
+	if o.Convs {
+		args = append(args, "--convs")
+	}
+	if o.Dev {
+		args = append(args, "--dev")
+	}
+	if o.HideExploding {
+		args = append(args, "--hide-exploding")
+	}
+	if o.Source != SourceRemote {
+		args = append(args, "--local")
+	}
+	if len(o.Channels) > 0 {
+		b, err := json.Marshal(o.Channels)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "--filter-channels", string(b))
+	}
+	return args, nil
+}
+
+// matchConv reports whether messages from conv can pass the filters.
+func (o ListenOptions) matchConv(conv chat1.ConvSummary) bool {
+	if len(o.ConvIDs) > 0 && !slices.Contains(o.ConvIDs, conv.Id) {
+		return false
+	}
+	if len(o.Channels) > 0 && !slices.ContainsFunc(o.Channels, func(ch chat1.ChatChannel) bool {
+		return channelMatches(ch, conv.Channel)
+	}) {
+		return false
+	}
+	return o.Dev || conv.Channel.TopicType != "dev"
+}
+
+// matchMessage applies every message filter of the options. The ones the
+// listener applies are checked again, for messages that were fetched rather
+// than listened to.
+func (o ListenOptions) matchMessage(msg SubscriptionMessage) bool {
+	if !o.matchConv(chat1.ConvSummary{Id: msg.Message.ConvID, Channel: msg.Message.Channel}) {
+		return false
+	}
+	if o.HideExploding && msg.Message.IsEphemeral {
+		return false
+	}
+	switch o.Source {
+	case SourceRemote:
+		if msg.Source == sourceLocal {
+			return false
+		}
+	case SourceLocal:
+		if msg.Source != sourceLocal {
+			return false
+		}
+	}
+	return o.Filter.matches(msg.Message)
+}
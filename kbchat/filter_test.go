@@ -0,0 +1,72 @@
+package kbchat
+
+import (
+	"testing"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenArgs(t *testing.T) {
+	args, err := ListenOptions{}.listenArgs()
+	require.NoError(t, err)
+	require.Empty(t, args)
+
+	args, err = ListenOptions{
+		Wallet:        true,
+		Convs:         true,
+		Dev:           true,
+		HideExploding: true,
+		Source:        SourceAll,
+		Channels:      []chat1.ChatChannel{{Name: "team", MembersType: "team", TopicName: "bots"}},
+	}.listenArgs()
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"--wallet", "--convs", "--dev", "--hide-exploding", "--local",
+		"--filter-channels", `[{"name":"team","members_type":"team","topic_name":"bots"}]`,
+	}, args)
+}
+
+func TestListenFiltersMessages(t *testing.T) {
+	sub, stream := listenFake(t, ListenOptions{
+		ConvIDs:       []chat1.ConvIDStr{"abc"},
+		HideExploding: true,
+		Filter: &MessageFilter{
+			Senders:      []string{"Alice"},
+			ContentTypes: []string{"text"},
+		},
+	})
+	msg := func(id int, conv chat1.ConvIDStr, sender, typ string) chat1.MsgSummary {
+		return chat1.MsgSummary{
+			Id:      chat1.MessageID(id),
+			ConvID:  conv,
+			Sender:  chat1.MsgSender{Username: sender},
+			Content: chat1.MsgContent{TypeName: typ},
+		}
+	}
+	writeEvent(t, stream, msgNotification(msg(1, "def", "alice", "text")))
+	writeEvent(t, stream, msgNotification(msg(2, "abc", "bob", "text")))
+	writeEvent(t, stream, msgNotification(msg(3, "abc", "alice", "reaction")))
+	exploding := msg(4, "abc", "alice", "text")
+	exploding.IsEphemeral = true
+	writeEvent(t, stream, msgNotification(exploding))
+	local := msgNotification(msg(5, "abc", "alice", "text"))
+	local.Source = "local"
+	writeEvent(t, stream, local)
+	writeEvent(t, stream, msgNotification(msg(6, "abc", "alice", "text")))
+
+	read, err := sub.Read()
+	require.NoError(t, err)
+	require.Equal(t, chat1.MessageID(6), read.Message.Id)
+	require.Zero(t, sub.Stats().Buffered)
+}
+
+func TestMessageFilterTeams(t *testing.T) {
+	filter := &MessageFilter{Teams: []string{"acme"}}
+	require.True(t, filter.matches(chat1.MsgSummary{Channel: chat1.ChatChannel{Name: "ACME", MembersType: "team"}}))
+	require.False(t, filter.matches(chat1.MsgSummary{Channel: chat1.ChatChannel{Name: "acme", MembersType: "impteamnative"}}))
+	require.False(t, filter.matches(chat1.MsgSummary{Channel: chat1.ChatChannel{Name: "other", MembersType: "team"}}))
+
+	var none *MessageFilter
+	require.True(t, none.matches(chat1.MsgSummary{}))
+}
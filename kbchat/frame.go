@@ -0,0 +1,86 @@
+package kbchat
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"regexp"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+const (
+	defaultMaxFrameSize = 8 * 1024 * 1024
+	// frameErrorPrefix is how much of a bad notification a FrameError keeps.
+	frameErrorPrefix = 256
+)
+
+var (
+	frameConvIDRe = regexp.MustCompile(`"conversation_id"\s*:\s*"([0-9a-fA-F]+)"`)
+	frameTypeRe   = regexp.MustCompile(`^\s*\{\s*"type"\s*:\s*"([a-z_]+)"`)
+)
+
+// frameReader splits the listener's stream into newline delimited
+// notifications.
+type frameReader struct {
+	r   *bufio.Reader
+	max int
+	buf []byte
+}
+
+func newFrameReader(r io.Reader, maxSize int) *frameReader {
+	if maxSize <= 0 {
+		maxSize = defaultMaxFrameSize
+	}
+	return &frameReader{r: bufio.NewReader(r), max: maxSize}
+}
+
+// next returns the next notification, which is only valid until the next
+// call. A notification larger than the maximum is skipped and reported as a
+// FrameError. io.EOF is returned once the stream has ended.
+func (f *frameReader) next() ([]byte, error) {
+	f.buf = f.buf[:0]
+	size := 0
+	tooLarge := false
+	for {
+		chunk, err := f.r.ReadSlice('\n')
+		size += len(chunk)
+		// Past the maximum, only the start is kept, to find the
+		// conversation it came from.
+		if !tooLarge {
+			f.buf = append(f.buf, chunk...)
+			tooLarge = len(bytes.TrimRight(f.buf, "\r\n")) > f.max
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if errors.Is(err, io.EOF) && size > 0 {
+			// The last notification isn't newline terminated.
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+	frame := bytes.TrimRight(f.buf, "\r\n")
+	if tooLarge {
+		return nil, newFrameError(frame, size, ErrFrameTooLarge)
+	}
+	return frame, nil
+}
+
+// newFrameError reports a bad notification, keeping its start and the
+// conversation it came from, if that can be found.
+func newFrameError(frame []byte, size int, err error) FrameError {
+	frameErr := FrameError{
+		Size:  size,
+		Frame: bytes.Clone(frame[:min(len(frame), frameErrorPrefix)]),
+		Err:   err,
+	}
+	if m := frameConvIDRe.FindSubmatch(frame); m != nil {
+		frameErr.ConvID = chat1.ConvIDStr(m[1])
+	}
+	return frameErr
+}
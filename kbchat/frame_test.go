@@ -0,0 +1,66 @@
+package kbchat
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrameReader(t *testing.T) {
+	big := `{"msg":{"conversation_id":"abc123","content":"` + strings.Repeat("x", 10000) + `"}}`
+	frames := newFrameReader(strings.NewReader("{\"a\":1}\n"+big+"\n\r\n{\"b\":2}"), 64)
+
+	frame, err := frames.next()
+	require.NoError(t, err)
+	require.Equal(t, `{"a":1}`, string(frame))
+
+	_, err = frames.next()
+	require.ErrorIs(t, err, ErrFrameTooLarge)
+	var frameErr FrameError
+	require.True(t, errors.As(err, &frameErr))
+	require.Equal(t, chat1.ConvIDStr("abc123"), frameErr.ConvID)
+	require.Equal(t, len(big)+1, frameErr.Size)
+
+	frame, err = frames.next()
+	require.NoError(t, err)
+	require.Empty(t, frame)
+
+	// The last notification doesn't need a newline.
+	frame, err = frames.next()
+	require.NoError(t, err)
+	require.Equal(t, `{"b":2}`, string(frame))
+	_, err = frames.next()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestListenReportsBadFrames(t *testing.T) {
+	sub, stream := listenFake(t, ListenOptions{MaxFrameSize: 200})
+	writeEvent(t, stream, msgNotification(chat1.MsgSummary{
+		Id:      1,
+		ConvID:  "abc",
+		Content: chat1.MsgContent{TypeName: "text", Text: &chat1.MsgTextContent{Body: strings.Repeat("x", 500)}},
+	}))
+	_, err := io.WriteString(stream, `{"type":"chat","msg":{"conversation_id":"def","id":"two"}}`+"\n")
+	require.NoError(t, err)
+	writeEvent(t, stream, msgNotification(chat1.MsgSummary{Id: 3, ConvID: "abc"}))
+
+	_, err = sub.Read()
+	var frameErr FrameError
+	require.True(t, errors.As(err, &frameErr))
+	require.ErrorIs(t, err, ErrFrameTooLarge)
+	require.Equal(t, chat1.ConvIDStr("abc"), frameErr.ConvID)
+
+	_, err = sub.Read()
+	require.True(t, errors.As(err, &frameErr))
+	require.Equal(t, chat1.ConvIDStr("def"), frameErr.ConvID)
+	require.Contains(t, string(frameErr.Frame), `"id":"two"`)
+
+	// The stream keeps going after bad notifications.
+	msg, err := sub.Read()
+	require.NoError(t, err)
+	require.Equal(t, chat1.MessageID(3), msg.Message.Id)
+}
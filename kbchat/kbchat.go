@@ -1,17 +1,18 @@
 package kbchat
 
 import (
-	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"math"
 	"os"
 	"os/exec"
 	"regexp"
 	"runtime"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
@@ -21,10 +22,23 @@ import (
 
 var validUsernameRe = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
 
+const (
+	defaultShutdownGracePeriod = 5 * time.Second
+	// defaultShutdownTimeout bounds Shutdown, which has no context.
+	defaultShutdownTimeout = 30 * time.Second
+	// shutdownCommandTimeout bounds the logout and service stop commands run
+	// on shutdown, which still run once the shutdown's context is done.
+	shutdownCommandTimeout = 10 * time.Second
+)
+
 // SubscriptionMessage contains a message and conversation object
 type SubscriptionMessage struct {
 	Message      chat1.MsgSummary
 	Conversation chat1.ConvSummary
+	// Source is "local" for messages sent from this device and "remote" for
+	// the others. For messages fetched by ListenOptions.Resume, it is
+	// worked out from the sender's username and device.
+	Source string
 }
 
 type SubscriptionConversation struct {
@@ -40,71 +54,233 @@ type Subscription struct {
 	*DebugOutput
 	sync.Mutex
 
-	newMsgsCh   chan SubscriptionMessage
-	newConvsCh  chan SubscriptionConversation
-	newWalletCh chan SubscriptionWalletEvent
-	errorCh     chan error
-	running     bool
-	shutdownCh  chan struct{}
+	eventsCh chan Event
+	overflow OverflowPolicy
+	spill    *spillQueue
+	dropped  atomic.Int64
+	// queued counts the notifications the listener has queued for the
+	// subscription that haven't reached eventsCh yet.
+	queued     atomic.Int64
+	running    bool
+	shutdownCh chan struct{}
+	// stoppedCh is closed once the background loop feeding the
+	// subscription has exited.
+	stoppedCh chan struct{}
+
+	// filterMu guards pending, the events that Read and friends took off
+	// the stream for one of the other readers. pendingCh is closed and
+	// replaced whenever an event is added to it.
+	filterMu  sync.Mutex
+	pending   []Event
+	pendingCh chan struct{}
+
+	// markRead, if set, marks the messages handled by a Router or a
+	// WorkerPool as read.
+	markRead func(SubscriptionMessage)
 }
 
 func NewSubscription() *Subscription {
-	newMsgsCh := make(chan SubscriptionMessage, 250)
-	newConvsCh := make(chan SubscriptionConversation, 250)
-	newWalletCh := make(chan SubscriptionWalletEvent, 250)
-	errorCh := make(chan error, 250)
-	shutdownCh := make(chan struct{})
-	return &Subscription{
+	return newSubscription(ListenOptions{})
+}
+
+func newSubscription(opts ListenOptions) *Subscription {
+	size := opts.BufferSize
+	if size <= 0 {
+		size = defaultSubscriptionBufferSize
+	}
+	sub := &Subscription{
 		DebugOutput: NewDebugOutput("Subscription"),
-		newMsgsCh:   newMsgsCh,
-		newConvsCh:  newConvsCh,
-		newWalletCh: newWalletCh,
-		shutdownCh:  shutdownCh,
-		errorCh:     errorCh,
+		eventsCh:    make(chan Event, size),
+		overflow:    opts.Overflow,
+		shutdownCh:  make(chan struct{}),
+		stoppedCh:   make(chan struct{}),
+		pendingCh:   make(chan struct{}),
 		running:     true,
 	}
+	if opts.Overflow == OverflowSpill {
+		sub.spill = newSpillQueue(opts.SpillDir, sub.eventsCh)
+	}
+	return sub
+}
+
+// Events returns the stream of everything the subscription receives. The
+// stream is closed once the subscription has shut down. It can't be mixed
+// with Read, ReadNewConvs, ReadWallet, ReadTyping and ReadConnection, which
+// are filters over the same stream.
+func (m *Subscription) Events() <-chan Event {
+	return m.eventsCh
+}
+
+// send delivers an event, reporting false if the subscription was shut down
+// first.
+func (m *Subscription) send(event Event) bool {
+	if len(m.eventsCh)*2 > cap(m.eventsCh) {
+		m.Debug("large eventsCh queue: len: %d cap: %d ", len(m.eventsCh), cap(m.eventsCh))
+	}
+	return m.enqueue(event)
+}
+
+// next returns the first event that match accepts. Events it skips are kept
+// for the other readers, up to the capacity of the stream, after which the
+// oldest are dropped and counted in Stats().Dropped. So events no reader is
+// used for, such as PinEvents when only Read is called, are eventually
+// dropped.
+func (m *Subscription) next(match func(Event) bool) (Event, error) {
+	for {
+		m.filterMu.Lock()
+		for i, event := range m.pending {
+			if match(event) {
+				m.pending = slices.Delete(m.pending, i, i+1)
+				m.filterMu.Unlock()
+				return event, nil
+			}
+		}
+		pendingCh := m.pendingCh
+		m.filterMu.Unlock()
+
+		select {
+		case event, ok := <-m.eventsCh:
+			if !ok {
+				return nil, errors.New("Subscription shutdown")
+			}
+			if match(event) {
+				return event, nil
+			}
+			m.filterMu.Lock()
+			if len(m.pending) >= cap(m.eventsCh) {
+				m.drop(m.pending[0], "no reader")
+				m.pending = m.pending[1:]
+			}
+			m.pending = append(m.pending, event)
+			close(m.pendingCh)
+			m.pendingCh = make(chan struct{})
+			m.filterMu.Unlock()
+		case <-pendingCh:
+		case <-m.shutdownCh:
+			return nil, errors.New("Subscription shutdown")
+		}
+	}
 }
 
-// Read blocks until a new message arrives
+// Read blocks until a new message arrives. It returns the errors of chat
+// notifications, and of notifications whose type isn't known.
 func (m *Subscription) Read() (msg SubscriptionMessage, err error) {
 	defer m.Trace(&err, "Read")()
-	select {
-	case msg = <-m.newMsgsCh:
-		return msg, nil
-	case err = <-m.errorCh:
-		return SubscriptionMessage{}, err
-	case <-m.shutdownCh:
-		return SubscriptionMessage{}, errors.New("Subscription shutdown")
+	event, err := m.next(func(event Event) bool {
+		_, ok := event.(MessageEvent)
+		return ok || isErrorFor(event, "chat", "")
+	})
+	switch event := event.(type) {
+	case MessageEvent:
+		return event.SubscriptionMessage, nil
+	case ErrorEvent:
+		return SubscriptionMessage{}, event.Err
 	}
+	return SubscriptionMessage{}, err
 }
 
+// ReadNewConvs blocks until a new conversation arrives, or a conversation
+// notification can't be delivered.
 func (m *Subscription) ReadNewConvs() (conv SubscriptionConversation, err error) {
 	defer m.Trace(&err, "ReadNewConvs")()
-	select {
-	case conv = <-m.newConvsCh:
-		return conv, nil
-	case err = <-m.errorCh:
-		return SubscriptionConversation{}, err
-	case <-m.shutdownCh:
-		return SubscriptionConversation{}, errors.New("Subscription shutdown")
+	event, err := m.next(func(event Event) bool {
+		_, ok := event.(ConversationEvent)
+		return ok || isErrorFor(event, "chat_conv")
+	})
+	switch event := event.(type) {
+	case ConversationEvent:
+		return event.SubscriptionConversation, nil
+	case ErrorEvent:
+		return SubscriptionConversation{}, event.Err
 	}
+	return SubscriptionConversation{}, err
 }
 
-// Read blocks until a new message arrives
+// ReadWallet blocks until a new payment arrives, or a wallet notification
+// can't be delivered.
 func (m *Subscription) ReadWallet() (msg SubscriptionWalletEvent, err error) {
 	defer m.Trace(&err, "ReadWallet")()
-	select {
-	case msg = <-m.newWalletCh:
-		return msg, nil
-	case err = <-m.errorCh:
-		return SubscriptionWalletEvent{}, err
-	case <-m.shutdownCh:
-		return SubscriptionWalletEvent{}, errors.New("Subscription shutdown")
+	event, err := m.next(func(event Event) bool {
+		_, ok := event.(WalletEvent)
+		return ok || isErrorFor(event, "wallet")
+	})
+	switch event := event.(type) {
+	case WalletEvent:
+		return event.SubscriptionWalletEvent, nil
+	case ErrorEvent:
+		return SubscriptionWalletEvent{}, event.Err
+	}
+	return SubscriptionWalletEvent{}, err
+}
+
+// ReadTyping blocks until somebody starts or stops typing, or a typing
+// notification can't be delivered.
+func (m *Subscription) ReadTyping() (event TypingEvent, err error) {
+	defer m.Trace(&err, "ReadTyping")()
+	next, err := m.next(func(event Event) bool {
+		_, ok := event.(TypingEvent)
+		return ok || isErrorFor(event, "typing")
+	})
+	switch next := next.(type) {
+	case TypingEvent:
+		return next, nil
+	case ErrorEvent:
+		return TypingEvent{}, next.Err
+	}
+	return TypingEvent{}, err
+}
+
+// isErrorFor reports whether event is an ErrorEvent for a notification of
+// one of types.
+func isErrorFor(event Event, types ...string) bool {
+	e, ok := event.(ErrorEvent)
+	return ok && slices.Contains(types, e.Type)
+}
+
+// ReadConnection blocks until the connection to the service changes
+func (m *Subscription) ReadConnection() (event SubscriptionConnectionEvent, err error) {
+	defer m.Trace(&err, "ReadConnection")()
+	next, err := m.next(func(event Event) bool {
+		_, ok := subscriptionConnectionEvent(event)
+		return ok
+	})
+	if err != nil {
+		return SubscriptionConnectionEvent{}, err
+	}
+	event, _ = subscriptionConnectionEvent(next)
+	return event, nil
+}
+
+// notifyConnection delivers a connection state change.
+func (m *Subscription) notifyConnection(event SubscriptionConnectionEvent) {
+	m.send(connectionEvent(event))
+}
+
+// handled is called once a handler is done with msg.
+func (m *Subscription) handled(msg SubscriptionMessage) {
+	if m.markRead != nil {
+		m.markRead(msg)
 	}
 }
 
 // Shutdown terminates the background process
 func (m *Subscription) Shutdown() {
+	m.stop()
+}
+
+// ShutdownContext terminates the background process and waits for it to exit,
+// or for ctx to be done.
+func (m *Subscription) ShutdownContext(ctx context.Context) error {
+	m.stop()
+	select {
+	case <-m.stoppedCh:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *Subscription) stop() {
 	defer m.Trace(nil, "Shutdown")()
 	m.Lock()
 	defer m.Unlock()
@@ -114,9 +290,72 @@ func (m *Subscription) Shutdown() {
 	}
 }
 
+// ListenOptions configures a Subscription. Subscriptions whose Wallet,
+// Convs, Dev, Channels, HideExploding, Source, MaxFrameSize, ReconnectPolicy
+// and Record path match share a single listener, and the other options apply
+// to each of them on its own.
 type ListenOptions struct {
 	Wallet bool
 	Convs  bool
+	// Typing delivers TypingEvents. The bot only receives them with
+	// RunOptions.EnableTyping.
+	Typing bool
+	// Pins delivers pin messages as PinEvents, and the deletions that unpin
+	// them as UnpinEvents, rather than as MessageEvents.
+	Pins bool
+	// Dev also delivers messages from dev channels, which bots use to talk
+	// to each other.
+	Dev bool
+	// Channels and ConvIDs limit the subscription to messages from those
+	// conversations. Channels are filtered by the listener itself, ConvIDs
+	// as soon as a notification is read. A channel without a topic name
+	// matches all of a team's channels.
+	Channels []chat1.ChatChannel
+	ConvIDs  []chat1.ConvIDStr
+	// HideExploding leaves out exploding messages.
+	HideExploding bool
+	// Source picks messages by the device they were sent from, by default
+	// only the ones sent from other devices.
+	Source MessageSource
+	// Filter, if set, picks the messages delivered. It runs as soon as a
+	// notification is read, before it is queued.
+	Filter *MessageFilter
+	// ReconnectPolicy controls retries, DefaultReconnectPolicy if nil.
+	ReconnectPolicy *ReconnectPolicy
+	// OnGiveUp, if set, is called with the last error once the reconnect
+	// policy is exhausted, right before the subscription shuts down.
+	OnGiveUp func(err error)
+	// BufferSize is the number of events the subscription buffers, 250 by
+	// default.
+	BufferSize int
+	// Overflow decides what happens to events once the buffer is full. By
+	// default the subscription waits until there is room.
+	Overflow OverflowPolicy
+	// SpillDir is where OverflowSpill keeps events, os.TempDir() by default.
+	SpillDir string
+	// MaxFrameSize is the size of the largest notification accepted, 8MB by
+	// default. Larger ones are skipped and delivered as an ErrorEvent with a
+	// FrameError.
+	MaxFrameSize int
+	// Record, if set, appends every notification the listener reads to a
+	// rotating file, which ReplaySubscription can feed back later.
+	// Notifications larger than MaxFrameSize aren't recorded. Listeners
+	// recording to the same path share the file, and the options of the
+	// first one.
+	Record *RecordOptions
+	// MarkRead marks every message a Router or a WorkerPool has handled
+	// without an error as read.
+	MarkRead bool
+	// Resume, if set, backfills the messages missed while the listener was
+	// down before delivering new ones, and never delivers a message twice.
+	Resume *ResumeOptions
+}
+
+func (o ListenOptions) reconnectPolicy() ReconnectPolicy {
+	if o.ReconnectPolicy == nil {
+		return DefaultReconnectPolicy
+	}
+	return *o.ReconnectPolicy
 }
 
 type PaymentHolder struct {
@@ -143,10 +382,23 @@ type RunOptions struct {
 	DisableBotLiteMode bool
 	// Number of processes to spin up to connect to the keybase service
 	NumPipes int
+	// Number of extra processes reserved for bulk operations such as
+	// attachment uploads. With none, bulk operations share the regular pipes.
+	NumBulkPipes int
+	// How long API processes get to exit after their stdin is closed on
+	// shutdown before they are killed. Defaults to five seconds.
+	ShutdownGracePeriod time.Duration
 	// Optional, used for debugging to identify the bot.
 	DebugTag string
 }
 
+func (r RunOptions) shutdownGracePeriod() time.Duration {
+	if r.ShutdownGracePeriod <= 0 {
+		return defaultShutdownGracePeriod
+	}
+	return r.ShutdownGracePeriod
+}
+
 func (r RunOptions) Location() string {
 	if r.KeybaseLocation == "" {
 		return "keybase"
@@ -163,34 +415,55 @@ func (r RunOptions) Command(args ...string) *exec.Cmd {
 	return exec.Command(r.Location(), cmd...) //nolint:gosec,noctx // G204: command location controlled by RunOptions, no context available at API level
 }
 
+// CommandContext is like Command but the process is killed if ctx is done
+// before it exits on its own.
+func (r RunOptions) CommandContext(ctx context.Context, args ...string) *exec.Cmd {
+	var cmd []string
+	if r.HomeDir != "" {
+		cmd = append(cmd, "--home", r.HomeDir)
+	}
+	cmd = append(cmd, args...)
+	return exec.CommandContext(ctx, r.Location(), cmd...) //nolint:gosec // G204: command location controlled by RunOptions
+}
+
 // Start fires up the Keybase JSON API in stdin/stdout mode
 func Start(runOpts RunOptions, opts ...func(*API)) (*API, error) {
+	return StartContext(context.Background(), runOpts, opts...)
+}
+
+// StartContext is like Start, but gives up on authenticating and spinning up
+// the API processes once ctx is done.
+func StartContext(ctx context.Context, runOpts RunOptions, opts ...func(*API)) (*API, error) {
 	api := NewAPI(runOpts, opts...)
-	if err := api.startPipes(); err != nil {
+	if err := api.connect(ctx); err != nil {
 		return nil, err
 	}
 	return api, nil
 }
 
-type apiPipe struct {
-	sync.Mutex
-	input  io.Writer
-	output *bufio.Reader
-	cmd    *exec.Cmd
-}
-
 // API is the main object used for communicating with the Keybase JSON API
 type API struct {
 	sync.Mutex
 	*DebugOutput
-	// Round robin hand out API pipes to allow concurrent API requests.
-	pipeIdx       int
-	pipes         []*apiPipe
-	username      string
+	transport Transport
+	username  string
+	// deviceName is the device the API is logged in with, if known.
+	deviceName    string
 	runOpts       RunOptions
 	subscriptions []*Subscription
-	Timeout       time.Duration
-	LogSendBytes  int
+	// listeners are the running api-listen streams, by the options they
+	// were started with.
+	listeners map[string]*listener
+	// recorders are the open recordings, by absolute path, shared by the
+	// listeners recording there.
+	recorders  map[string]*recorder
+	rateLimits *rateLimiter
+	// closing is set once Shutdown has started, after which no new calls
+	// are accepted. inflight tracks the calls still running.
+	closing      bool
+	inflight     sync.WaitGroup
+	Timeout      time.Duration
+	LogSendBytes int
 }
 
 func CustomTimeout(timeout time.Duration) func(*API) {
@@ -205,10 +478,14 @@ func NewAPI(runOpts RunOptions, opts ...func(*API)) *API {
 		runOpts:      runOpts,
 		Timeout:      5 * time.Second,
 		LogSendBytes: 1024 * 1024 * 5, // request 5MB so we don't get killed
+		rateLimits:   newRateLimiter(DefaultRateLimitThreshold),
 	}
 	for _, opt := range opts {
 		opt(api)
 	}
+	if api.transport == nil {
+		api.transport = NewExecTransport(runOpts)
+	}
 	return api
 }
 
@@ -216,17 +493,23 @@ func (a *API) Command(args ...string) *exec.Cmd {
 	return a.runOpts.Command(args...)
 }
 
-func (a *API) getUsername(runOpts RunOptions) (username string, err error) {
-	p := runOpts.Command("whoami", "-json")
+func (a *API) CommandContext(ctx context.Context, args ...string) *exec.Cmd {
+	return a.runOpts.CommandContext(ctx, args...)
+}
+
+func (a *API) getUsername(ctx context.Context, runOpts RunOptions) (username, deviceName string, err error) {
+	ctx, cancel := context.WithTimeout(ctx, a.Timeout)
+	defer cancel()
+	p := runOpts.CommandContext(ctx, "whoami", "-json")
 	output, err := p.StdoutPipe()
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 	if runtime.GOOS != "windows" {
 		p.ExtraFiles = []*os.File{output.(*os.File)}
 	}
 	if err = p.Start(); err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	doneCh := make(chan error)
@@ -244,6 +527,7 @@ func (a *API) getUsername(runOpts RunOptions) (username string, err error) {
 		}
 		if status.LoggedIn && status.User != nil {
 			username = status.User.Username
+			deviceName = status.DeviceName
 			doneCh <- nil
 		} else {
 			doneCh <- fmt.Errorf("unable to authenticate to keybase service: logged in: %v user: %+v", status.LoggedIn, status.User)
@@ -257,18 +541,24 @@ func (a *API) getUsername(runOpts RunOptions) (username string, err error) {
 	select {
 	case err = <-doneCh:
 		if err != nil {
-			return "", err
+			return "", "", err
 		}
-	case <-time.After(a.Timeout):
-		return "", errors.New("unable to run Keybase command")
+	case <-ctx.Done():
+		return "", "", fmt.Errorf("unable to run Keybase command: %v", ctx.Err())
 	}
 
-	return username, nil
+	return username, deviceName, nil
 }
 
-func (a *API) auth() (username string, err error) {
+// auth makes sure the API is logged in, returning who as. The device name is
+// only known if the API was already logged in.
+func (a *API) auth(ctx context.Context) (username, deviceName string, err error) {
 	defer a.Trace(&err, "auth(un:%s)", username)()
-	username, err = a.getUsername(a.runOpts)
+	if authenticator, ok := a.transport.(Authenticator); ok {
+		username, err = authenticator.Auth(ctx)
+		return username, "", err
+	}
+	username, deviceName, err = a.getUsername(ctx, a.runOpts)
 	if err == nil {
 		// Successfully authenticated - check if we need to switch users
 		if a.runOpts.Oneshot != nil && username != a.runOpts.Oneshot.Username {
@@ -278,51 +568,43 @@ func (a *API) auth() (username string, err error) {
 		} else {
 			// Already logged in as correct user (or no Oneshot configured)
 			a.Debug("auth: already logged in %s", username)
-			return username, nil
+			return username, deviceName, nil
 		}
 	} else {
 		// Authentication failed
 		if a.runOpts.Oneshot == nil {
 			a.Debug("auth: oneshot not configured, aborting")
-			return "", err
+			return "", "", err
 		}
 		// Continue to logout + oneshot below
 	}
 
 	// If we get here, we need to do oneshot login (logout first)
 	if !validUsernameRe.MatchString(a.runOpts.Oneshot.Username) {
-		return "", fmt.Errorf("invalid oneshot username %q: must match [a-zA-Z0-9_]+", a.runOpts.Oneshot.Username)
+		return "", "", fmt.Errorf("invalid oneshot username %q: must match [a-zA-Z0-9_]+", a.runOpts.Oneshot.Username)
 	}
-	if err := a.runOpts.Command("logout", "-f").Run(); err != nil {
-		return "", err
+	if err := a.runOpts.CommandContext(ctx, "logout", "-f").Run(); err != nil {
+		return "", "", err
 	}
 	// Pass the paper key via env var rather than argv to avoid local disclosure via ps/proc.
 	// keybase oneshot reads KEYBASE_PAPERKEY before prompting stdin (cmd_oneshot.go:getOption).
 	// Strip any inherited KEYBASE_PAPERKEY first: getenv returns the first match, so an
 	// existing entry in the parent environment would shadow ours silently.
-	oneshotCmd := a.runOpts.Command("oneshot", "--username", a.runOpts.Oneshot.Username)
+	oneshotCmd := a.runOpts.CommandContext(ctx, "oneshot", "--username", a.runOpts.Oneshot.Username)
 	// Prepend so our value is found first; getenv returns the first match, so any
 	// pre-existing KEYBASE_PAPERKEY in the parent environment is silently shadowed.
 	oneshotCmd.Env = append([]string{"KEYBASE_PAPERKEY=" + a.runOpts.Oneshot.PaperKey}, os.Environ()...)
 	if err := oneshotCmd.Run(); err != nil {
-		return "", err
+		return "", "", err
 	}
 	username = a.runOpts.Oneshot.Username
-	return username, nil
+	return username, "", nil
 }
 
-func (a *API) startPipes() (err error) {
+// connect authenticates and (re)starts the transport's connections.
+func (a *API) connect(ctx context.Context) (err error) {
 	a.Lock()
 	defer a.Unlock()
-	for _, pipe := range a.pipes {
-		if pipe.cmd != nil {
-			if err := pipe.cmd.Process.Kill(); err != nil {
-				return fmt.Errorf("unable to kill previous API command %v", err)
-			}
-		}
-		pipe.cmd = nil
-	}
-	a.pipes = nil
 
 	if a.runOpts.StartService {
 		args := []string{fmt.Sprintf("-enable-bot-lite-mode=%v", a.runOpts.DisableBotLiteMode), "service"}
@@ -331,102 +613,77 @@ func (a *API) startPipes() (err error) {
 		}
 	}
 
-	if a.username, err = a.auth(); err != nil {
+	if a.username, a.deviceName, err = a.auth(ctx); err != nil {
 		return fmt.Errorf("unable to auth: %v", err)
 	}
 
-	cmd := a.runOpts.Command("chat", "notification-settings", fmt.Sprintf("-disable-typing=%v", !a.runOpts.EnableTyping))
-	if err = cmd.Run(); err != nil {
-		// This is a performance optimization but isn't a fatal error.
-		a.Debug("unable to set notification settings %v", err)
-	}
-
-	// Startup NumPipes processes to the keybase chat api
-	for i := 0; i < int(math.Max(float64(a.runOpts.NumPipes), 1)); i++ {
-		pipe := apiPipe{}
-		pipe.cmd = a.runOpts.Command("chat", "api")
-		if pipe.input, err = pipe.cmd.StdinPipe(); err != nil {
-			return fmt.Errorf("unable to get api stdin: %v", err)
-		}
-		output, err := pipe.cmd.StdoutPipe()
-		if err != nil {
-			return fmt.Errorf("unable to get api stdout: %v", err)
-		}
-		if runtime.GOOS != "windows" {
-			pipe.cmd.ExtraFiles = []*os.File{output.(*os.File)}
+	if _, ok := a.transport.(Authenticator); !ok {
+		cmd := a.runOpts.CommandContext(ctx, "chat", "notification-settings", fmt.Sprintf("-disable-typing=%v", !a.runOpts.EnableTyping))
+		if err = cmd.Run(); err != nil {
+			// This is a performance optimization but isn't a fatal error.
+			a.Debug("unable to set notification settings %v", err)
 		}
-		if err := pipe.cmd.Start(); err != nil {
-			return fmt.Errorf("unable to run chat api cmd: %v", err)
-		}
-		pipe.output = bufio.NewReader(output)
-		a.pipes = append(a.pipes, &pipe)
 	}
-	return nil
-}
 
-func (a *API) getAPIPipes() (*apiPipe, error) {
-	a.Lock()
-	defer a.Unlock()
-	if len(a.pipes) == 0 {
-		return nil, errAPIDisconnected
-	}
-	idx := a.pipeIdx % len(a.pipes)
-	a.pipeIdx++
-	pipe := a.pipes[idx]
-	if pipe.cmd == nil {
-		return nil, errAPIDisconnected
+	if starter, ok := a.transport.(TransportStarter); ok {
+		return starter.Start(ctx)
 	}
-	return pipe, nil
+	return nil
 }
 
 func (a *API) GetUsername() string {
 	return a.username
 }
 
-func (a *API) doSend(arg any) (resp SendResponse, err error) {
+func (a *API) doSend(ctx context.Context, arg any) (resp SendResponse, err error) {
 	bArg, err := json.Marshal(arg)
 	if err != nil {
 		return SendResponse{}, fmt.Errorf("unable to send arg: %+v: %v", arg, err)
 	}
-	pipe, err := a.getAPIPipes()
-	if err != nil {
-		return SendResponse{}, err
+	err = a.call(ctx, ChatAPIName, bArg, &resp.Result)
+	var apiErr Error
+	if errors.As(err, &apiErr) {
+		resp.Error = &apiErr
 	}
-	pipe.Lock()
-	defer pipe.Unlock()
+	return resp, err
+}
 
-	if _, err := io.Writer.Write(pipe.input, bArg); err != nil {
-		return SendResponse{}, err
-	}
-	responseRaw, err := pipe.output.ReadBytes('\n')
-	if err != nil {
-		return SendResponse{}, err
-	}
-	if err := json.Unmarshal(responseRaw, &resp); err != nil {
-		return resp, fmt.Errorf("failed to decode API response: %v %v", responseRaw, err)
-	} else if resp.Error != nil {
-		return resp, errors.New(resp.Error.Message)
-	}
-	return resp, nil
+// doFetch sends a raw chat API request and decodes the result of the
+// response into result.
+func (a *API) doFetch(ctx context.Context, apiInput string, result any) error {
+	return a.call(ctx, ChatAPIName, []byte(apiInput), result)
 }
 
-func (a *API) doFetch(apiInput string) ([]byte, error) {
-	pipe, err := a.getAPIPipes()
-	if err != nil {
-		return nil, err
+// call sends a request to the named API and decodes the result of the
+// response into result. Failures to reach the service are returned as an
+// APIError, and errors reported by the service as an Error. Chat calls are
+// delayed while a rate limit tank is running low.
+func (a *API) call(ctx context.Context, api APIName, request []byte, result any) error {
+	if err := a.beginCall(); err != nil {
+		return err
 	}
-	pipe.Lock()
-	defer pipe.Unlock()
-
-	if _, err := io.WriteString(pipe.input, apiInput); err != nil {
-		return nil, err
+	defer a.inflight.Done()
+	if api == ChatAPIName {
+		if err := a.rateLimits.wait(ctx); err != nil {
+			return err
+		}
 	}
-	byteOutput, err := pipe.output.ReadBytes('\n')
+	output, err := a.transport.Send(ctx, api, request)
 	if err != nil {
-		return nil, err
+		return APIError{err}
 	}
+	a.rateLimits.observe(output)
+	return decodeResponse(apiMethod(request), output, result)
+}
 
-	return byteOutput, nil
+func (a *API) beginCall() error {
+	a.Lock()
+	defer a.Unlock()
+	if a.closing {
+		return ErrShutdown
+	}
+	a.inflight.Add(1)
+	return nil
 }
 
 // ListenForNewTextMessages proxies to Listen without wallet events
@@ -435,192 +692,75 @@ func (a *API) ListenForNewTextMessages() (*Subscription, error) {
 	return a.Listen(opts)
 }
 
-func (a *API) registerSubscription(sub *Subscription) {
-	a.Lock()
-	defer a.Unlock()
-	a.subscriptions = append(a.subscriptions, sub)
-}
-
 // Listen fires of a background loop and puts chat messages and wallet
 // events into channels
 func (a *API) Listen(opts ListenOptions) (sub *Subscription, err error) {
+	return a.ListenContext(context.Background(), opts)
+}
+
+// ListenContext is like Listen, but the returned Subscription is shut down
+// once ctx is done.
+func (a *API) ListenContext(ctx context.Context, opts ListenOptions) (sub *Subscription, err error) {
 	defer a.Trace(&err, "Listen(%s)", a.runOpts.DebugTag)()
-	done := make(chan struct{}, 1)
-	sub = NewSubscription()
-	a.registerSubscription(sub)
-	pause := 2 * time.Second
-	readScanner := func(boutput *bufio.Scanner) {
-		defer func() {
-			// Recover from "send on closed channel" panics that can occur when the
-			// subscription shuts down while readScanner is mid-send.
-			if r := recover(); r != nil {
-				a.Debug("readScanner: recovered from panic: %v", r)
-			}
-			done <- struct{}{}
+	sub = newSubscription(opts)
+	if opts.MarkRead {
+		sub.markRead = a.markReader()
+	}
+	s := newSubscriber(a, sub, opts)
+	go s.run()
+	l, err := a.joinListener(s)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	pumpDone := make(chan struct{})
+	if sub.spill != nil {
+		go func() {
+			defer close(pumpDone)
+			sub.spill.pump(sub.shutdownCh)
 		}()
-		for {
-			select {
-			case <-sub.shutdownCh:
-				a.Debug("readScanner: received shutdown")
-				return
-			default:
-			}
-			boutput.Scan()
-			t := boutput.Text()
-			submitErr := func(err error) {
-				if len(sub.errorCh)*2 > cap(sub.errorCh) {
-					a.Debug("large errorCh queue: len: %d cap: %d ", len(sub.errorCh), cap(sub.errorCh))
-				}
-				sub.errorCh <- err
-			}
-			var typeHolder TypeHolder
-			if err := json.Unmarshal([]byte(t), &typeHolder); err != nil {
-				submitErr(fmt.Errorf("err: %v, data: %v", err, t))
-				continue
-			}
-			switch typeHolder.Type {
-			case "chat":
-				var notification chat1.MsgNotification
-				if err := json.Unmarshal([]byte(t), &notification); err != nil {
-					submitErr(fmt.Errorf("err: %v, data: %v", err, t))
-					break
-				}
-				if notification.Error != nil {
-					a.Debug("error message received: %s", *notification.Error)
-				} else if notification.Msg != nil {
-					subscriptionMessage := SubscriptionMessage{
-						Message: *notification.Msg,
-						Conversation: chat1.ConvSummary{
-							Id:      notification.Msg.ConvID,
-							Channel: notification.Msg.Channel,
-						},
-					}
-					if len(sub.newMsgsCh)*2 > cap(sub.newMsgsCh) {
-						a.Debug("large newMsgsCh queue: len: %d cap: %d ", len(sub.newMsgsCh), cap(sub.newMsgsCh))
-					}
-					sub.newMsgsCh <- subscriptionMessage
-				}
-			case "chat_conv":
-				var notification chat1.ConvNotification
-				if err := json.Unmarshal([]byte(t), &notification); err != nil {
-					submitErr(fmt.Errorf("err: %v, data: %v", err, t))
-					break
-				}
-				if notification.Error != nil {
-					a.Debug("error message received: %s", *notification.Error)
-				} else if notification.Conv != nil {
-					subscriptionConv := SubscriptionConversation{
-						Conversation: *notification.Conv,
-					}
-					if len(sub.newConvsCh)*2 > cap(sub.newConvsCh) {
-						a.Debug("large newConvsCh queue: len: %d cap: %d ", len(sub.newConvsCh), cap(sub.newConvsCh))
-					}
-					sub.newConvsCh <- subscriptionConv
-				}
-			case "wallet":
-				var holder PaymentHolder
-				if err := json.Unmarshal([]byte(t), &holder); err != nil {
-					submitErr(fmt.Errorf("err: %v, data: %v", err, t))
-					break
-				}
-				subscriptionPayment := SubscriptionWalletEvent(holder)
-				if len(sub.newWalletCh)*2 > cap(sub.newWalletCh) {
-					a.Debug("large newWalletCh queue: len: %d cap: %d ", len(sub.newWalletCh), cap(sub.newWalletCh))
-				}
-				sub.newWalletCh <- subscriptionPayment
-			default:
-				continue
-			}
-		}
 	}
-
-	attempts := 0
-	maxAttempts := 30
-	go func() {
-		defer func() {
-			close(sub.newMsgsCh)
-			close(sub.newConvsCh)
-			close(sub.newWalletCh)
-			close(sub.errorCh)
+	saveDone := make(chan struct{})
+	if s.resume != nil && s.resume.opts.Store != nil {
+		go func() {
+			defer close(saveDone)
+			s.resume.autosave(sub.shutdownCh)
 		}()
-		for {
-			select {
-			case <-sub.shutdownCh:
-				a.Debug("Listen: received shutdown")
-				return
-			default:
-			}
-
-			if attempts >= maxAttempts {
-				// Run LogSend in a goroutine: keybase may be unresponsive (the cause of the
-				// auth failures), and blocking here would delay the panic indefinitely.
-				go func() {
-					if err := a.LogSend("Listen: failed to auth, giving up"); err != nil {
-						a.Debug("Listen: logsend failed to send: %v", err)
-					}
-				}()
-				panic("Listen: failed to auth, giving up")
-			}
-			attempts++
-			if _, err := a.auth(); err != nil {
-				a.Debug("Listen: failed to auth: %s", err)
-				time.Sleep(pause)
-				continue
-			}
-			cmdElements := []string{"chat", "api-listen"}
-			if opts.Wallet {
-				cmdElements = append(cmdElements, "--wallet")
-			}
-			if opts.Convs {
-				cmdElements = append(cmdElements, "--convs")
-			}
-			p := a.runOpts.Command(cmdElements...)
-			output, err := p.StdoutPipe()
-			if err != nil {
-				a.Debug("Listen: failed to listen: %s", err)
-				time.Sleep(pause)
-				continue
-			}
-			stderr, err := p.StderrPipe()
-			if err != nil {
-				a.Debug("Listen: failed to listen to stderr: %s", err)
-				time.Sleep(pause)
-				continue
-			}
-			if runtime.GOOS != "windows" {
-				p.ExtraFiles = []*os.File{stderr.(*os.File), output.(*os.File)}
-			}
-			boutput := bufio.NewScanner(output)
-			if err := p.Start(); err != nil {
-				a.Debug("Listen: failed to make listen scanner: %s", err)
-				time.Sleep(pause)
-				continue
-			}
-			attempts = 0
-			go readScanner(boutput)
-			select {
-			case <-sub.shutdownCh:
-				a.Debug("Listen: received shutdown")
-				return
-			case <-done:
-			}
-			if err := p.Wait(); err != nil {
-				stderrBytes, rerr := io.ReadAll(stderr)
-				if rerr != nil {
-					stderrBytes = fmt.Appendf(nil, "failed to get stderr: %v", rerr)
-				}
-				a.Debug("Listen: failed to Wait for command, restarting pipes: %s (```%s```)", err, stderrBytes)
-				if err := a.startPipes(); err != nil {
-					a.Debug("Listen: failed to restart pipes: %v", err)
-				}
+	} else {
+		close(saveDone)
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			sub.Shutdown()
+		case <-sub.shutdownCh:
+		}
+		a.leaveListener(l, s)
+		s.close()
+		// The checkpoint is saved before the subscription counts as stopped.
+		<-saveDone
+		if s.resume != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), a.Timeout)
+			if err := s.resume.save(ctx); err != nil {
+				a.Debug("Listen: unable to save checkpoint: %v", err)
 			}
-			time.Sleep(pause)
+			cancel()
 		}
+		if sub.spill != nil {
+			<-pumpDone
+			sub.spill.close()
+		}
+		close(sub.eventsCh)
+		close(sub.stoppedCh)
 	}()
 	return sub, nil
 }
 
 func (a *API) LogSend(feedback string) error {
+	return a.LogSendContext(context.Background(), feedback)
+}
+
+func (a *API) LogSendContext(ctx context.Context, feedback string) error {
 	var username string
 	if len(a.GetUsername()) != 0 {
 		username = a.GetUsername() + " (logged in)"
@@ -635,40 +775,83 @@ func (a *API) LogSend(feedback string) error {
 		"--feedback", feedback,
 		"-n", fmt.Sprintf("%d", a.LogSendBytes),
 	}
-	return a.runOpts.Command(args...).Run()
+	return a.runOpts.CommandContext(ctx, args...).Run()
 }
 
+// Shutdown is like ShutdownContext, bounded by a default deadline.
 func (a *API) Shutdown() (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultShutdownTimeout)
+	defer cancel()
+	return a.ShutdownContext(ctx)
+}
+
+// ShutdownContext stops the API in order: it shuts down subscriptions, waits
+// for in-flight calls to finish, closes the transport, then logs out if the
+// API logged in with RunOptions.Oneshot and stops the service if it was
+// started with RunOptions.StartService. Once ctx is done, calls still running
+// fail as the transport is closed forcefully, but logging out and stopping
+// the service are still attempted. Every step is attempted, and the
+// errors of all the steps that failed are returned together.
+func (a *API) ShutdownContext(ctx context.Context) (err error) {
 	defer a.Trace(&err, "Shutdown")()
 	a.Lock()
-	defer a.Unlock()
-	for _, sub := range a.subscriptions {
-		sub.Shutdown()
-	}
-	for _, pipe := range a.pipes {
-		if pipe.cmd != nil {
-			a.Debug("waiting for API command")
-			if err := pipe.cmd.Wait(); err != nil {
-				return err
-			}
+	a.closing = true
+	subs := a.subscriptions
+	a.subscriptions = nil
+	a.Unlock()
+
+	var errs []error
+	for _, sub := range subs {
+		if err := sub.ShutdownContext(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("unable to stop subscription: %w", err))
 		}
 	}
 
+	drained := make(chan struct{})
+	go func() {
+		a.inflight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		a.Debug("failing in-flight calls")
+	}
+
+	switch t := a.transport.(type) {
+	case contextCloser:
+		if err := t.CloseContext(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("unable to close transport: %w", err))
+		}
+	case io.Closer:
+		if err := t.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("unable to close transport: %w", err))
+		}
+	}
+
+	// Leaving the oneshot session logged in or the service running is worse
+	// than overrunning ctx, so these steps get their own deadline.
 	if a.runOpts.Oneshot != nil {
 		a.Debug("logging out")
-		err := a.runOpts.Command("logout", "--force").Run()
-		if err != nil {
-			return err
+		if err := a.runShutdownCommand(ctx, "logout", "--force"); err != nil {
+			errs = append(errs, fmt.Errorf("unable to log out: %w", err))
 		}
 	}
 
 	if a.runOpts.StartService {
 		a.Debug("stopping service")
-		err := a.runOpts.Command("ctl", "stop", "--shutdown").Run()
-		if err != nil {
-			return err
+		if err := a.runShutdownCommand(ctx, "ctl", "stop", "--shutdown"); err != nil {
+			errs = append(errs, fmt.Errorf("unable to stop service: %w", err))
 		}
 	}
 
-	return nil
+	return errors.Join(errs...)
+}
+
+// runShutdownCommand runs a keybase command for ShutdownContext, bounded by
+// shutdownCommandTimeout rather than by ctx.
+func (a *API) runShutdownCommand(ctx context.Context, args ...string) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownCommandTimeout)
+	defer cancel()
+	return a.runOpts.CommandContext(ctx, args...).Run()
 }
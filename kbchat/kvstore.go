@@ -1,8 +1,8 @@
 package kbchat
 
 import (
+	"context"
 	"encoding/json"
-	"strings"
 
 	"github.com/keybase/go-keybase-chat-bot/kbchat/types/keybase1"
 )
@@ -62,10 +62,18 @@ type KVStoreAPI interface {
 }
 
 func (a *API) PutEntry(teamName *string, namespace string, entryKey string, entryValue string) (result keybase1.KVPutResult, err error) {
-	return a.PutEntryWithRevision(teamName, namespace, entryKey, entryValue, 0)
+	return a.PutEntryContext(context.Background(), teamName, namespace, entryKey, entryValue)
+}
+
+func (a *API) PutEntryContext(ctx context.Context, teamName *string, namespace string, entryKey string, entryValue string) (result keybase1.KVPutResult, err error) {
+	return a.PutEntryWithRevisionContext(ctx, teamName, namespace, entryKey, entryValue, 0)
 }
 
 func (a *API) PutEntryWithRevision(teamName *string, namespace string, entryKey string, entryValue string, revision int) (result keybase1.KVPutResult, err error) {
+	return a.PutEntryWithRevisionContext(context.Background(), teamName, namespace, entryKey, entryValue, revision)
+}
+
+func (a *API) PutEntryWithRevisionContext(ctx context.Context, teamName *string, namespace string, entryKey string, entryValue string, revision int) (result keybase1.KVPutResult, err error) {
 	opts := kvstoreOptions{
 		Team:       teamName,
 		Namespace:  &namespace,
@@ -81,29 +89,23 @@ func (a *API) PutEntryWithRevision(teamName *string, namespace string, entryKey
 		return result, err
 	}
 
-	cmd := a.runOpts.Command("kvstore", "api")
-	cmd.Stdin = strings.NewReader(string(apiInput))
-	bytes, err := cmd.Output()
-	if err != nil {
-		return result, APIError{err}
-	}
-
-	entry := PutEntryRes{}
-	err = json.Unmarshal(bytes, &entry)
-	if err != nil {
-		return result, UnmarshalError{err}
-	}
-	if entry.Error.Message != "" {
-		return result, entry.Error
-	}
-	return entry.Result, nil
+	err = a.call(ctx, KVStoreAPIName, apiInput, &result)
+	return result, err
 }
 
 func (a *API) DeleteEntry(teamName *string, namespace string, entryKey string) (result keybase1.KVDeleteEntryResult, err error) {
-	return a.DeleteEntryWithRevision(teamName, namespace, entryKey, 0)
+	return a.DeleteEntryContext(context.Background(), teamName, namespace, entryKey)
+}
+
+func (a *API) DeleteEntryContext(ctx context.Context, teamName *string, namespace string, entryKey string) (result keybase1.KVDeleteEntryResult, err error) {
+	return a.DeleteEntryWithRevisionContext(ctx, teamName, namespace, entryKey, 0)
 }
 
 func (a *API) DeleteEntryWithRevision(teamName *string, namespace string, entryKey string, revision int) (result keybase1.KVDeleteEntryResult, err error) {
+	return a.DeleteEntryWithRevisionContext(context.Background(), teamName, namespace, entryKey, revision)
+}
+
+func (a *API) DeleteEntryWithRevisionContext(ctx context.Context, teamName *string, namespace string, entryKey string, revision int) (result keybase1.KVDeleteEntryResult, err error) {
 	opts := kvstoreOptions{
 		Team:      teamName,
 		Namespace: &namespace,
@@ -118,25 +120,15 @@ func (a *API) DeleteEntryWithRevision(teamName *string, namespace string, entryK
 		return result, err
 	}
 
-	cmd := a.runOpts.Command("kvstore", "api")
-	cmd.Stdin = strings.NewReader(string(apiInput))
-	bytes, err := cmd.Output()
-	if err != nil {
-		return result, APIError{err}
-	}
-
-	entry := DeleteEntryRes{}
-	err = json.Unmarshal(bytes, &entry)
-	if err != nil {
-		return result, UnmarshalError{err}
-	}
-	if entry.Error.Message != "" {
-		return result, entry.Error
-	}
-	return entry.Result, nil
+	err = a.call(ctx, KVStoreAPIName, apiInput, &result)
+	return result, err
 }
 
 func (a *API) GetEntry(teamName *string, namespace string, entryKey string) (result keybase1.KVGetResult, err error) {
+	return a.GetEntryContext(context.Background(), teamName, namespace, entryKey)
+}
+
+func (a *API) GetEntryContext(ctx context.Context, teamName *string, namespace string, entryKey string) (result keybase1.KVGetResult, err error) {
 	opts := kvstoreOptions{
 		Team:      teamName,
 		Namespace: &namespace,
@@ -147,25 +139,15 @@ func (a *API) GetEntry(teamName *string, namespace string, entryKey string) (res
 	if err != nil {
 		return result, err
 	}
-	cmd := a.runOpts.Command("kvstore", "api")
-	cmd.Stdin = strings.NewReader(string(apiInput))
-	bytes, err := cmd.Output()
-	if err != nil {
-		return result, APIError{err}
-	}
-
-	entry := GetEntryRes{}
-	err = json.Unmarshal(bytes, &entry)
-	if err != nil {
-		return result, UnmarshalError{err}
-	}
-	if entry.Error.Message != "" {
-		return result, entry.Error
-	}
-	return entry.Result, nil
+	err = a.call(ctx, KVStoreAPIName, apiInput, &result)
+	return result, err
 }
 
 func (a *API) ListNamespaces(teamName *string) (result keybase1.KVListNamespaceResult, err error) {
+	return a.ListNamespacesContext(context.Background(), teamName)
+}
+
+func (a *API) ListNamespacesContext(ctx context.Context, teamName *string) (result keybase1.KVListNamespaceResult, err error) {
 	opts := kvstoreOptions{
 		Team: teamName,
 	}
@@ -175,25 +157,15 @@ func (a *API) ListNamespaces(teamName *string) (result keybase1.KVListNamespaceR
 		return result, err
 	}
 
-	cmd := a.runOpts.Command("kvstore", "api")
-	cmd.Stdin = strings.NewReader(string(apiInput))
-	bytes, err := cmd.Output()
-	if err != nil {
-		return result, APIError{err}
-	}
-
-	var namespaces ListNamespacesRes
-	err = json.Unmarshal(bytes, &namespaces)
-	if err != nil {
-		return result, UnmarshalError{err}
-	}
-	if namespaces.Error.Message != "" {
-		return result, namespaces.Error
-	}
-	return namespaces.Result, nil
+	err = a.call(ctx, KVStoreAPIName, apiInput, &result)
+	return result, err
 }
 
 func (a *API) ListEntryKeys(teamName *string, namespace string) (result keybase1.KVListEntryResult, err error) {
+	return a.ListEntryKeysContext(context.Background(), teamName, namespace)
+}
+
+func (a *API) ListEntryKeysContext(ctx context.Context, teamName *string, namespace string) (result keybase1.KVListEntryResult, err error) {
 	opts := kvstoreOptions{
 		Team:      teamName,
 		Namespace: &namespace,
@@ -204,20 +176,6 @@ func (a *API) ListEntryKeys(teamName *string, namespace string) (result keybase1
 		return result, err
 	}
 
-	cmd := a.runOpts.Command("kvstore", "api")
-	cmd.Stdin = strings.NewReader(string(apiInput))
-	bytes, err := cmd.Output()
-	if err != nil {
-		return result, APIError{err}
-	}
-
-	entryKeys := ListEntryKeysRes{}
-	err = json.Unmarshal(bytes, &entryKeys)
-	if err != nil {
-		return result, UnmarshalError{err}
-	}
-	if entryKeys.Error.Message != "" {
-		return result, entryKeys.Error
-	}
-	return entryKeys.Result, nil
+	err = a.call(ctx, KVStoreAPIName, apiInput, &result)
+	return result, err
 }
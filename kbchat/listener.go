@@ -0,0 +1,653 @@
+package kbchat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// listener runs a single api-listen stream and fans its notifications out to
+// every subscription listening with the same options. It stops once the
+// last of them has shut down.
+type listener struct {
+	sync.Mutex
+	api *API
+	key string
+	// opts are the options of the subscription that started the listener.
+	// Only the ones handed to api-listen are the same for all of them.
+	opts   ListenOptions
+	policy ReconnectPolicy
+	// rec, if set, records every notification read.
+	rec  *recorder
+	pins pinTracker
+	subs []*subscriber
+	// connected is set while the stream is open, and stopping once the last
+	// subscription has left or the listener gave up, after which no more
+	// subscriptions can join.
+	connected bool
+	stopping  bool
+
+	// ctx is cancelled once the last subscription has left, and doneCh is
+	// closed once run has returned.
+	ctx    context.Context
+	cancel context.CancelFunc
+	doneCh chan struct{}
+}
+
+// listenerKey identifies the options that have to match for subscriptions to
+// share a listener.
+func listenerKey(opts ListenOptions) (string, error) {
+	args, err := opts.listenArgs()
+	if err != nil {
+		return "", err
+	}
+	key := fmt.Sprintf("%s %d %+v", strings.Join(args, " "), opts.MaxFrameSize, opts.reconnectPolicy())
+	if opts.Record != nil {
+		key += " " + opts.Record.Path
+	}
+	return key, nil
+}
+
+// newListener prepares a listener for run. a.Lock must be held.
+func newListener(a *API, key string, opts ListenOptions) (*listener, error) {
+	var rec *recorder
+	if opts.Record != nil {
+		var err error
+		if rec, err = a.openRecorderLocked(*opts.Record); err != nil {
+			return nil, err
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &listener{
+		api:    a,
+		key:    key,
+		opts:   opts,
+		policy: opts.reconnectPolicy(),
+		rec:    rec,
+		ctx:    ctx,
+		cancel: cancel,
+		doneCh: make(chan struct{}),
+	}, nil
+}
+
+// add attaches s to the listener. If the stream is already open, s is told
+// so and starts catching up right away. add reports false if the listener
+// is stopping, in which case s has to join another one.
+func (l *listener) add(s *subscriber) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.stopping {
+		return false
+	}
+	l.subs = append(l.subs, s)
+	if l.connected {
+		s.deliver(ReconnectedEvent{})
+		s.backfill()
+	}
+	return true
+}
+
+// remove detaches s from the listener, reporting whether it was the last
+// subscription. Use API.leaveListener.
+func (l *listener) remove(s *subscriber) (last bool) {
+	l.Lock()
+	defer l.Unlock()
+	l.subs = slices.DeleteFunc(l.subs, func(sub *subscriber) bool { return sub == s })
+	if len(l.subs) == 0 && !l.stopping {
+		l.stopping = true
+		return true
+	}
+	return false
+}
+
+func (l *listener) subscribers() []*subscriber {
+	l.Lock()
+	defer l.Unlock()
+	return slices.Clone(l.subs)
+}
+
+// stop keeps subscriptions from joining, and returns the ones that did.
+func (l *listener) stop() []*subscriber {
+	l.Lock()
+	defer l.Unlock()
+	l.stopping = true
+	return slices.Clone(l.subs)
+}
+
+// broadcast queues an event for every subscription. It never waits for
+// them to read it.
+func (l *listener) broadcast(event Event) {
+	for _, s := range l.subscribers() {
+		s.deliver(event)
+	}
+}
+
+// publish queues a notification for every subscription, applying their
+// overflow policies. Once it has been handed to the others, it waits for
+// room with the subscriptions that have to wait for it.
+func (l *listener) publish(event Event) {
+	var full []*subscriber
+	for _, s := range l.subscribers() {
+		if !s.offer(event) {
+			full = append(full, s)
+		}
+	}
+	for _, s := range full {
+		s.wait(l.ctx, event)
+	}
+}
+
+func (l *listener) setConnected(connected bool) {
+	l.Lock()
+	defer l.Unlock()
+	l.connected = connected
+	if !connected {
+		return
+	}
+	for _, s := range l.subs {
+		s.deliver(ReconnectedEvent{})
+		s.backfill()
+	}
+}
+
+func (l *listener) sleep(d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-l.ctx.Done():
+	}
+}
+
+// giveUp tells every subscription that the reconnect policy is exhausted and
+// shuts them down.
+func (l *listener) giveUp(attempts int, err error) {
+	a := l.api
+	// Subscriptions that come along from now on start a new listener.
+	a.removeListener(l)
+	a.Debug("Listen: failed to connect after %d attempts, giving up: %v", attempts, err)
+	// Run LogSend in a goroutine: keybase may be unresponsive (the cause
+	// of the failures), and blocking here would delay shutdown indefinitely.
+	go func() {
+		if err := a.LogSend("Listen: failed to auth, giving up"); err != nil {
+			a.Debug("Listen: logsend failed to send: %v", err)
+		}
+	}()
+	for _, s := range l.stop() {
+		s.deliver(connectionEvent(SubscriptionConnectionEvent{
+			State:    ConnectionGaveUp,
+			Attempts: attempts,
+			Err:      err,
+		}))
+		s.do(func() bool {
+			if s.opts.OnGiveUp != nil {
+				s.opts.OnGiveUp(err)
+			}
+			s.sub.Shutdown()
+			return false
+		})
+	}
+}
+
+// read decodes every notification on the stream once and hands it to all
+// subscriptions. It returns as soon as the stream ends.
+func (l *listener) read(stream io.Reader) {
+	frames := newFrameReader(stream, l.opts.MaxFrameSize)
+	for {
+		frame, err := frames.next()
+		var frameErr FrameError
+		switch {
+		case errors.As(err, &frameErr):
+			l.api.Debug("readScanner: %v", err)
+			l.broadcast(newErrorEvent(frameErr))
+			continue
+		case errors.Is(err, io.EOF):
+			return
+		case err != nil:
+			// The listener went away, let run reconnect.
+			l.api.Debug("readScanner: %v", err)
+			return
+		case len(frame) == 0:
+			continue
+		}
+		if l.rec != nil {
+			if err := l.rec.record(time.Now(), frame); err != nil {
+				l.api.Debug("readScanner: unable to record: %v", err)
+			}
+		}
+		event := l.api.decodeEvent(frame)
+		if event == nil {
+			continue
+		}
+		l.publish(l.pins.track(event))
+	}
+}
+
+// run keeps the stream open until the last subscription has left or the
+// reconnect policy is exhausted.
+func (l *listener) run() {
+	a := l.api
+	defer close(l.doneCh)
+	defer a.removeListener(l)
+	if l.rec != nil {
+		defer func() {
+			if err := a.closeRecorder(l.rec); err != nil {
+				a.Debug("Listen: unable to close recording: %v", err)
+			}
+		}()
+	}
+	attempts := 0
+	// retry waits before the next attempt, or reports false once the
+	// reconnect policy is exhausted.
+	retry := func(err error) bool {
+		attempts++
+		if l.policy.MaxAttempts > 0 && attempts >= l.policy.MaxAttempts {
+			l.giveUp(attempts, err)
+			return false
+		}
+		backoff := l.policy.backoff(attempts)
+		l.broadcast(connectionEvent(SubscriptionConnectionEvent{
+			State:    ConnectionDisconnected,
+			Attempts: attempts,
+			Err:      err,
+			RetryIn:  backoff,
+		}))
+		l.sleep(backoff)
+		return true
+	}
+	for {
+		if l.ctx.Err() != nil {
+			a.Debug("Listen: received shutdown")
+			return
+		}
+
+		if _, _, err := a.auth(l.ctx); err != nil {
+			a.Debug("Listen: failed to auth: %s", err)
+			if !retry(fmt.Errorf("failed to auth: %w", err)) {
+				return
+			}
+			continue
+		}
+		stream, err := a.transport.Listen(l.ctx, l.opts)
+		if err != nil {
+			a.Debug("Listen: %s", err)
+			if !retry(err) {
+				return
+			}
+			continue
+		}
+		attempts = 0
+		done := make(chan struct{})
+		// The stream is already open, so nothing falls between the
+		// backfills started here and the live messages.
+		l.setConnected(true)
+		go func() {
+			defer close(done)
+			l.read(stream)
+		}()
+		select {
+		case <-l.ctx.Done():
+			a.Debug("Listen: received shutdown")
+			if err := stream.Close(); err != nil {
+				a.Debug("Listen: failed to stop listener: %v", err)
+			}
+			<-done
+			return
+		case <-done:
+		}
+		l.setConnected(false)
+		err = stream.Close()
+		if err != nil {
+			a.Debug("Listen: failed to Wait for command, restarting pipes: %s", err)
+			if err := a.connect(l.ctx); err != nil {
+				a.Debug("Listen: failed to restart pipes: %v", err)
+			}
+		} else {
+			err = errors.New("listener stopped")
+		}
+		if !retry(err) {
+			return
+		}
+	}
+}
+
+// subscriber is a Subscription's end of a listener. It applies the
+// subscription's own filters and catches up on missed messages. The listener
+// only queues work for it, which its own goroutine does in order, so a
+// subscription that is slow to read holds up nothing but itself until its
+// queue is full.
+type subscriber struct {
+	api    *API
+	sub    *Subscription
+	opts   ListenOptions
+	resume *resumer
+
+	// mu guards the queue. ready is signalled whenever an item is queued,
+	// and room is closed and replaced whenever a notification leaves it.
+	// catchingUp is set while a catch up is queued and hasn't started yet.
+	mu         sync.Mutex
+	queue      []subscriberItem
+	ready      chan struct{}
+	room       chan struct{}
+	catchingUp bool
+	closed     bool
+	// limit is the number of notifications queued before the overflow
+	// policy applies, and queued the number that are.
+	limit  int
+	queued int
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	// done is closed once run has returned.
+	done chan struct{}
+}
+
+// subscriberItem is a queued event, or work such as catching up if event is
+// nil. notification is set for the events counted against the limit. do
+// reports false once the subscription has shut down.
+type subscriberItem struct {
+	event        Event
+	notification bool
+	do           func() bool
+}
+
+func newSubscriber(a *API, sub *Subscription, opts ListenOptions) *subscriber {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &subscriber{
+		api:    a,
+		sub:    sub,
+		opts:   opts,
+		ready:  make(chan struct{}, 1),
+		room:   make(chan struct{}),
+		limit:  cap(sub.eventsCh),
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	if opts.Resume != nil {
+		s.resume = newResumer(a, opts)
+	}
+	return s
+}
+
+// pushLocked queues an item for run. s.mu must be held.
+func (s *subscriber) pushLocked(item subscriberItem) {
+	if s.closed {
+		return
+	}
+	s.queue = append(s.queue, item)
+	if item.notification {
+		s.queued++
+		s.sub.queued.Add(1)
+	}
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// run works through the queue until the subscriber is closed or the
+// subscription has shut down.
+func (s *subscriber) run() {
+	defer close(s.done)
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			select {
+			case <-s.ready:
+				continue
+			case <-s.ctx.Done():
+				return
+			}
+		}
+		item := s.queue[0]
+		s.queue[0] = subscriberItem{}
+		s.queue = s.queue[1:]
+		if item.notification {
+			s.dequeuedLocked()
+		}
+		s.mu.Unlock()
+		ok := s.ctx.Err() == nil
+		if ok && item.do != nil {
+			ok = item.do()
+		} else if ok {
+			ok = s.process(item.event)
+		}
+		if !ok {
+			s.mu.Lock()
+			s.closed = true
+			s.clearLocked()
+			s.mu.Unlock()
+			return
+		}
+	}
+}
+
+// dequeuedLocked counts a notification that left the queue, and wakes up
+// whoever waits for room. s.mu must be held.
+func (s *subscriber) dequeuedLocked() {
+	s.queued--
+	s.sub.queued.Add(-1)
+	close(s.room)
+	s.room = make(chan struct{})
+}
+
+// clearLocked empties the queue. s.mu must be held.
+func (s *subscriber) clearLocked() {
+	s.sub.queued.Add(int64(-s.queued))
+	s.queued = 0
+	s.queue = nil
+	close(s.room)
+	s.room = make(chan struct{})
+}
+
+// deliver queues an event for the subscription, regardless of the limit.
+func (s *subscriber) deliver(event Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pushLocked(subscriberItem{event: event})
+}
+
+// do queues work for run.
+func (s *subscriber) do(fn func() bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pushLocked(subscriberItem{do: fn})
+}
+
+// offer queues a notification for the subscription. Once the queue holds
+// limit of them, the overflow policy decides: the drop policies make room or
+// drop the notification, and the others report false, so the notification
+// has to wait for room.
+func (s *subscriber) offer(event Event) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item := subscriberItem{event: event, notification: true}
+	if s.closed || s.queued < s.limit {
+		s.pushLocked(item)
+		return true
+	}
+	switch s.opts.Overflow {
+	case OverflowDropNewest:
+		s.sub.drop(event, "queue full")
+		return true
+	case OverflowDropOldest:
+		i := slices.IndexFunc(s.queue, func(item subscriberItem) bool { return item.notification })
+		s.sub.drop(s.queue[i].event, "queue full")
+		s.queue = slices.Delete(s.queue, i, i+1)
+		s.dequeuedLocked()
+		s.pushLocked(item)
+		return true
+	}
+	return false
+}
+
+// wait queues a notification once there is room, unless the subscriber is
+// closed or ctx is done first.
+func (s *subscriber) wait(ctx context.Context, event Event) {
+	for {
+		s.mu.Lock()
+		if s.closed || s.queued < s.limit {
+			s.pushLocked(subscriberItem{event: event, notification: true})
+			s.mu.Unlock()
+			return
+		}
+		room := s.room
+		s.mu.Unlock()
+		select {
+		case <-room:
+		case <-s.ctx.Done():
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// process filters and delivers an event, reporting false if the
+// subscription was shut down first. Only one goroutine may call it at a
+// time.
+func (s *subscriber) process(event Event) bool {
+	if _, ok := event.(TypingEvent); ok && !s.opts.Typing {
+		return true
+	}
+	msg, ok := messageOf(event)
+	if !ok {
+		return s.sub.send(event)
+	}
+	if !s.opts.Pins {
+		event = MessageEvent{msg}
+	}
+	if s.resume != nil && s.resume.seen(msg.Message) {
+		return true
+	}
+	if s.opts.matchMessage(msg) && !s.sub.send(event) {
+		return false
+	}
+	if s.resume != nil {
+		s.resume.delivered(msg.Message)
+	}
+	return true
+}
+
+// backfill queues a catch up on the messages missed since the checkpoint,
+// if the subscription resumes. Live events queued after it are held back
+// until the missed messages have been delivered.
+func (s *subscriber) backfill() {
+	if s.resume == nil {
+		return
+	}
+	s.mu.Lock()
+	queued := s.catchingUp
+	s.catchingUp = true
+	s.mu.Unlock()
+	if !queued {
+		s.do(s.catchUp)
+	}
+}
+
+// catchUp fetches and delivers the missed messages. Failing to fetch them is
+// reported as an ErrorEvent.
+func (s *subscriber) catchUp() bool {
+	s.mu.Lock()
+	s.catchingUp = false
+	s.mu.Unlock()
+	msgs, err := s.resume.missed(s.ctx)
+	if s.ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		s.api.Debug("unable to backfill: %v", err)
+		return s.process(ErrorEvent{Type: "chat", Err: fmt.Errorf("unable to fetch missed messages: %w", err)})
+	}
+	source := s.api.fetchedSource()
+	for _, msg := range msgs {
+		if !s.process(newMessageEvent(msg, source(msg))) {
+			return false
+		}
+	}
+	if len(msgs) > 0 {
+		s.api.Debug("backfilled %d messages", len(msgs))
+	}
+	return true
+}
+
+// close stops delivery to the subscription and waits for run to return.
+func (s *subscriber) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.clearLocked()
+	s.mu.Unlock()
+	s.cancel()
+	<-s.done
+}
+
+// joinListener attaches s to the listener for its options, starting one if
+// there is none. The API's lock is never held while taking a listener's.
+func (a *API) joinListener(s *subscriber) (*listener, error) {
+	key, err := listenerKey(s.opts)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		a.Lock()
+		if a.closing {
+			a.Unlock()
+			return nil, ErrShutdown
+		}
+		l, ok := a.listeners[key]
+		if !ok {
+			if l, err = newListener(a, key, s.opts); err != nil {
+				a.Unlock()
+				return nil, err
+			}
+			if a.listeners == nil {
+				a.listeners = make(map[string]*listener)
+			}
+			a.listeners[key] = l
+			go l.run()
+		}
+		a.Unlock()
+		if !l.add(s) {
+			// l is on its way out, start another one.
+			a.removeListener(l)
+			continue
+		}
+		a.Lock()
+		if a.closing {
+			a.Unlock()
+			a.leaveListener(l, s)
+			return nil, ErrShutdown
+		}
+		a.subscriptions = append(a.subscriptions, s.sub)
+		a.Unlock()
+		return l, nil
+	}
+}
+
+// leaveListener detaches s from l, and stops l if s was the last
+// subscription.
+func (a *API) leaveListener(l *listener, s *subscriber) {
+	a.Lock()
+	a.subscriptions = slices.DeleteFunc(a.subscriptions, func(sub *Subscription) bool { return sub == s.sub })
+	a.Unlock()
+	if l.remove(s) {
+		a.removeListener(l)
+		l.cancel()
+		<-l.doneCh
+	}
+}
+
+// removeListener forgets l, so the next subscription with its options
+// starts a new one.
+func (a *API) removeListener(l *listener) {
+	a.Lock()
+	defer a.Unlock()
+	if a.listeners[l.key] == l {
+		delete(a.listeners, l.key)
+	}
+}
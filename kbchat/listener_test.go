@@ -0,0 +1,156 @@
+package kbchat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenSharesListener(t *testing.T) {
+	transport := newFakeTransport(func(req fakeRequest) (any, error) {
+		return nil, errors.New("unexpected request")
+	})
+	api := NewAPI(RunOptions{}, WithTransport(transport))
+	all, err := api.Listen(ListenOptions{})
+	require.NoError(t, err)
+	texts, err := api.Listen(ListenOptions{
+		Filter: &MessageFilter{ContentTypes: []string{"text"}},
+	})
+	require.NoError(t, err)
+	stream := <-transport.streams
+
+	msg := func(id int, typ string) chat1.MsgNotification {
+		return msgNotification(chat1.MsgSummary{Id: chat1.MessageID(id), ConvID: "abc", Content: chat1.MsgContent{TypeName: typ}})
+	}
+	writeEvent(t, stream, msg(1, "text"))
+	writeEvent(t, stream, msg(2, "reaction"))
+	writeEvent(t, stream, msg(3, "text"))
+	require.Equal(t, []string{"abc/1", "abc/2", "abc/3"}, readMsgs(t, all, 3))
+	// The second subscription has its own filter.
+	require.Equal(t, []string{"abc/1", "abc/3"}, readMsgs(t, texts, 2))
+
+	// The listener keeps running until the last subscription has left.
+	require.NoError(t, all.ShutdownContext(context.Background()))
+	writeEvent(t, stream, msg(4, "text"))
+	require.Equal(t, []string{"abc/4"}, readMsgs(t, texts, 1))
+	require.NoError(t, texts.ShutdownContext(context.Background()))
+	_, err = fmt.Fprintln(stream, "{}")
+	require.ErrorIs(t, err, io.ErrClosedPipe)
+	require.Empty(t, transport.streams)
+
+	// A new subscription starts a new listener.
+	sub, err := api.Listen(ListenOptions{})
+	require.NoError(t, err)
+	defer sub.Shutdown()
+	writeEvent(t, <-transport.streams, msg(5, "text"))
+	require.Equal(t, []string{"abc/5"}, readMsgs(t, sub, 1))
+}
+
+func TestListenSeparatesOptionSets(t *testing.T) {
+	transport := newFakeTransport(func(req fakeRequest) (any, error) {
+		return nil, errors.New("unexpected request")
+	})
+	api := NewAPI(RunOptions{}, WithTransport(transport))
+	chat, err := api.Listen(ListenOptions{})
+	require.NoError(t, err)
+	defer chat.Shutdown()
+	wallet, err := api.Listen(ListenOptions{Wallet: true})
+	require.NoError(t, err)
+	defer wallet.Shutdown()
+
+	<-transport.streams
+	<-transport.streams
+	require.Empty(t, transport.streams)
+}
+
+func TestListenSlowSubscriptionHoldsUpNoOne(t *testing.T) {
+	transport := newFakeTransport(func(req fakeRequest) (any, error) {
+		return map[string]any{"result": chat1.SendRes{Message: "message sent"}}, nil
+	})
+	api, err := Start(RunOptions{}, WithTransport(transport))
+	require.NoError(t, err)
+	policy := &ReconnectPolicy{InitialBackoff: time.Millisecond}
+	// Nobody reads slow, whose buffer and queue fill up right away.
+	slow, err := api.Listen(ListenOptions{ReconnectPolicy: policy, BufferSize: 1})
+	require.NoError(t, err)
+	defer slow.Shutdown()
+	fast, err := api.Listen(ListenOptions{ReconnectPolicy: policy})
+	require.NoError(t, err)
+	defer fast.Shutdown()
+	stream := <-transport.streams
+
+	for id := 1; id <= 2; id++ {
+		writeEvent(t, stream, msgNotification(chatMsg("abc", id, 0)))
+	}
+	require.Equal(t, []string{"abc/1", "abc/2"}, readMsgs(t, fast, 2))
+
+	// Neither a reconnect nor new subscriptions and calls wait for slow.
+	require.NoError(t, stream.Close())
+	done := make(chan error, 1)
+	go func() {
+		sub, err := api.Listen(ListenOptions{ReconnectPolicy: policy})
+		if err == nil {
+			defer sub.Shutdown()
+			_, err = api.SendMessageByConvID("abc", "hi")
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("held up by a slow subscription")
+	}
+	writeEvent(t, <-transport.streams, msgNotification(chatMsg("abc", 6, 0)))
+	require.Equal(t, []string{"abc/6"}, readMsgs(t, fast, 1))
+}
+
+func TestListenBoundsStalledSubscription(t *testing.T) {
+	transport := newFakeTransport(func(req fakeRequest) (any, error) {
+		return nil, errors.New("unexpected request")
+	})
+	api := NewAPI(RunOptions{}, WithTransport(transport))
+	// stalled stops reading, and its buffer and queue hold two events each.
+	stalled, err := api.Listen(ListenOptions{BufferSize: 2})
+	require.NoError(t, err)
+	defer stalled.Shutdown()
+	other, err := api.Listen(ListenOptions{})
+	require.NoError(t, err)
+	defer other.Shutdown()
+	stream := <-transport.streams
+	go func() {
+		for id := 1; id <= 10; id++ {
+			b, _ := json.Marshal(msgNotification(chatMsg("abc", id, 0)))
+			if _, err := fmt.Fprintf(stream, "%s\n", b); err != nil {
+				return
+			}
+		}
+	}()
+
+	// The other subscription gets the event the listener waits with.
+	require.Equal(t, []string{"abc/1", "abc/2", "abc/3", "abc/4", "abc/5"}, readMsgs(t, other, 5))
+	require.Eventually(t, func() bool { return stalled.Stats().Buffered == 4 }, 5*time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	require.Equal(t, 4, stalled.Stats().Buffered)
+	select {
+	case event := <-other.Events():
+		t.Fatalf("the listener went on with %v", event)
+	default:
+	}
+
+	// Nothing is lost once the stalled subscription reads again.
+	var want []string
+	for id := 1; id <= 10; id++ {
+		want = append(want, fmt.Sprintf("abc/%d", id))
+	}
+	require.Equal(t, want, readMsgs(t, stalled, 10))
+	require.Equal(t, want[5:], readMsgs(t, other, 5))
+	require.Equal(t, SubscriptionStats{}, stalled.Stats())
+}
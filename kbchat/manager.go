@@ -0,0 +1,300 @@
+package kbchat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultHealthCheckInterval = time.Minute
+
+// ErrUnknownBot is returned for usernames the Manager isn't running.
+var ErrUnknownBot = errors.New("unknown bot")
+
+// BotConfig describes one of the bots run by a Manager.
+type BotConfig struct {
+	RunOptions RunOptions
+	// Options are passed on to StartContext.
+	Options []func(*API)
+	// Listen, if set, subscribes to the bot's notifications and merges them
+	// into the Manager's event stream.
+	Listen *ListenOptions
+}
+
+// BotEvent is an event received by one of the bots run by a Manager.
+type BotEvent struct {
+	// Bot is the username of the bot that received the event.
+	Bot string
+	Event
+}
+
+// ManagerOptions configures a Manager.
+type ManagerOptions struct {
+	// HealthCheckInterval is how often every bot is checked. It defaults to
+	// a minute.
+	HealthCheckInterval time.Duration
+	// HealthCheck reports whether a bot is still working. By default a bot
+	// is healthy if it can list its unread conversations, which doesn't
+	// touch its session.
+	HealthCheck func(ctx context.Context, api *API) error
+}
+
+// Manager runs several bots, each with its own RunOptions, in one process.
+// Bots that fail their health check are restarted, outgoing calls are routed
+// by bot username, and the notifications of all bots are merged into a
+// single stream.
+type Manager struct {
+	sync.Mutex
+	*DebugOutput
+	opts   ManagerOptions
+	bots   map[string]*managedBot
+	events chan BotEvent
+	// closed is set once Shutdown has started, after which no bots are
+	// added. forwarding tracks the goroutines feeding events.
+	closed     bool
+	forwarding sync.WaitGroup
+	closeOnce  sync.Once
+}
+
+type managedBot struct {
+	sync.Mutex
+	cfg      BotConfig
+	username string
+	api      *API
+	// down is set once api has been shut down, until a restart replaces it.
+	down    bool
+	stopCh  chan struct{}
+	stopped chan struct{}
+}
+
+func NewManager(opts ManagerOptions) *Manager {
+	if opts.HealthCheckInterval <= 0 {
+		opts.HealthCheckInterval = defaultHealthCheckInterval
+	}
+	if opts.HealthCheck == nil {
+		opts.HealthCheck = func(ctx context.Context, api *API) error {
+			_, err := api.GetConversationsContext(ctx, true)
+			return err
+		}
+	}
+	return &Manager{
+		DebugOutput: NewDebugOutput("Manager"),
+		opts:        opts,
+		bots:        make(map[string]*managedBot),
+		events:      make(chan BotEvent, 250),
+	}
+}
+
+// Events returns the merged notifications of every bot. The stream is
+// closed once Shutdown has stopped every bot.
+func (m *Manager) Events() <-chan BotEvent {
+	return m.events
+}
+
+// Add starts a bot and keeps it running until it is removed. It returns the
+// username the bot is known by.
+func (m *Manager) Add(cfg BotConfig) (username string, err error) {
+	return m.AddContext(context.Background(), cfg)
+}
+
+func (m *Manager) AddContext(ctx context.Context, cfg BotConfig) (username string, err error) {
+	defer m.Trace(&err, "Add(%s)", cfg.RunOptions.DebugTag)()
+	bot := &managedBot{
+		cfg:     cfg,
+		stopCh:  make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if err := m.startBot(ctx, bot); err != nil {
+		return "", err
+	}
+	m.Lock()
+	if m.closed {
+		m.Unlock()
+		if err := bot.shutdown(ctx); err != nil {
+			m.Debug("Add: unable to shut down bot: %v", err)
+		}
+		return "", ErrShutdown
+	}
+	if _, ok := m.bots[bot.username]; ok {
+		m.Unlock()
+		if err := bot.shutdown(ctx); err != nil {
+			m.Debug("Add: unable to shut down duplicate bot: %v", err)
+		}
+		return "", fmt.Errorf("bot %s is already running", bot.username)
+	}
+	m.bots[bot.username] = bot
+	m.Unlock()
+	go m.supervise(bot)
+	return bot.username, nil
+}
+
+// API returns the running API of a bot. Bots are replaced when they are
+// restarted, so the API should be looked up again for every call.
+func (m *Manager) API(username string) (*API, error) {
+	m.Lock()
+	bot, ok := m.bots[username]
+	m.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", username, ErrUnknownBot)
+	}
+	bot.Lock()
+	defer bot.Unlock()
+	return bot.api, nil
+}
+
+// Bots returns the usernames of the running bots.
+func (m *Manager) Bots() []string {
+	m.Lock()
+	defer m.Unlock()
+	usernames := make([]string, 0, len(m.bots))
+	for username := range m.bots {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	return usernames
+}
+
+// Remove stops a bot and shuts down its API.
+func (m *Manager) Remove(ctx context.Context, username string) error {
+	m.Lock()
+	bot, ok := m.bots[username]
+	delete(m.bots, username)
+	m.Unlock()
+	if !ok {
+		return fmt.Errorf("%s: %w", username, ErrUnknownBot)
+	}
+	close(bot.stopCh)
+	<-bot.stopped
+	return bot.shutdown(ctx)
+}
+
+// Shutdown stops every bot and shuts down their APIs, returning all errors
+// that occurred. Bots can't be added anymore, and the event stream is closed
+// once the last event has been forwarded.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.Lock()
+	m.closed = true
+	m.Unlock()
+	var errs []error
+	for _, username := range m.Bots() {
+		if err := m.Remove(ctx, username); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", username, err))
+		}
+	}
+	m.forwarding.Wait()
+	m.closeOnce.Do(func() { close(m.events) })
+	return errors.Join(errs...)
+}
+
+// startBot starts the bot's API and, if configured, its subscription.
+func (m *Manager) startBot(ctx context.Context, bot *managedBot) error {
+	api, err := StartContext(ctx, bot.cfg.RunOptions, bot.cfg.Options...)
+	if err != nil {
+		return err
+	}
+	var sub *Subscription
+	if bot.cfg.Listen != nil {
+		// The subscription outlives ctx, which only bounds starting up.
+		if sub, err = api.ListenContext(context.WithoutCancel(ctx), *bot.cfg.Listen); err != nil {
+			if serr := api.ShutdownContext(ctx); serr != nil {
+				m.Debug("startBot: unable to shut down API: %v", serr)
+			}
+			return err
+		}
+	}
+	bot.Lock()
+	if bot.username == "" {
+		bot.username = api.GetUsername()
+	}
+	bot.api = api
+	bot.down = false
+	bot.Unlock()
+	if sub != nil {
+		// Once Shutdown has started, the bot is about to be shut down and
+		// its events have nowhere to go.
+		m.Lock()
+		if !m.closed {
+			m.forwarding.Add(1)
+			go m.forward(bot.username, sub)
+		}
+		m.Unlock()
+	}
+	return nil
+}
+
+// shutdown shuts down the bot's API, unless that already happened.
+func (bot *managedBot) shutdown(ctx context.Context) error {
+	bot.Lock()
+	api, down := bot.api, bot.down
+	bot.down = true
+	bot.Unlock()
+	if down {
+		return nil
+	}
+	return api.ShutdownContext(ctx)
+}
+
+func (bot *managedBot) isDown() bool {
+	bot.Lock()
+	defer bot.Unlock()
+	return bot.down
+}
+
+// supervise health checks a bot and restarts it whenever the check fails,
+// until the bot is removed.
+func (m *Manager) supervise(bot *managedBot) {
+	defer close(bot.stopped)
+	ticker := time.NewTicker(m.opts.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-bot.stopCh:
+			return
+		}
+		// While the bot is down because restarting it failed, the next
+		// tick retries without a health check.
+		if !bot.isDown() {
+			bot.Lock()
+			api := bot.api
+			bot.Unlock()
+			ctx, cancel := context.WithTimeout(context.Background(), m.opts.HealthCheckInterval)
+			err := m.opts.HealthCheck(ctx, api)
+			cancel()
+			if err == nil {
+				continue
+			}
+			m.Debug("supervise: %s failed health check, restarting: %v", bot.username, err)
+		}
+		m.restart(bot)
+	}
+}
+
+// restart replaces the bot's API with a fresh one. If that fails the bot is
+// left down.
+func (m *Manager) restart(bot *managedBot) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.opts.HealthCheckInterval)
+	defer cancel()
+	if err := bot.shutdown(ctx); err != nil {
+		m.Debug("restart: unable to shut down %s: %v", bot.username, err)
+	}
+	if err := m.startBot(ctx, bot); err != nil {
+		m.Debug("restart: unable to start %s: %v", bot.username, err)
+	}
+}
+
+// forward copies a bot's events into the merged event stream until its
+// subscription is shut down.
+func (m *Manager) forward(username string, sub *Subscription) {
+	defer m.forwarding.Done()
+	for event := range sub.Events() {
+		select {
+		case m.events <- BotEvent{Bot: username, Event: event}:
+		case <-sub.shutdownCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package kbchat
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/stretchr/testify/require"
+)
+
+func newFakeBot(username string) *fakeTransport {
+	transport := newFakeTransport(func(req fakeRequest) (any, error) {
+		return map[string]any{"result": chat1.SendRes{Message: "message sent"}}, nil
+	})
+	transport.username = username
+	return transport
+}
+
+// nextMessage skips connection events until the next message arrives.
+func nextMessage(t *testing.T, m *Manager) (string, MessageEvent) {
+	for event := range m.Events() {
+		switch e := event.Event.(type) {
+		case ReconnectedEvent, DisconnectedEvent:
+		case MessageEvent:
+			return event.Bot, e
+		default:
+			t.Fatalf("unexpected event %T", e)
+		}
+	}
+	t.Fatal("event stream closed")
+	return "", MessageEvent{}
+}
+
+func TestManagerRoutesAndMergesEvents(t *testing.T) {
+	m := NewManager(ManagerOptions{})
+	alice, bob := newFakeBot("alice"), newFakeBot("bob")
+	for _, transport := range []*fakeTransport{alice, bob} {
+		_, err := m.Add(BotConfig{
+			Options: []func(*API){WithTransport(transport)},
+			Listen:  &ListenOptions{},
+		})
+		require.NoError(t, err)
+	}
+	defer func() { require.NoError(t, m.Shutdown(context.Background())) }()
+	require.Equal(t, []string{"alice", "bob"}, m.Bots())
+
+	_, err := m.Add(BotConfig{Options: []func(*API){WithTransport(newFakeBot("bob"))}})
+	require.ErrorContains(t, err, "already running")
+
+	api, err := m.API("bob")
+	require.NoError(t, err)
+	_, err = api.SendMessageByConvID("abc", "hi")
+	require.NoError(t, err)
+	require.Empty(t, alice.sent())
+	require.Len(t, bob.sent(), 1)
+	_, err = m.API("carol")
+	require.ErrorIs(t, err, ErrUnknownBot)
+
+	for _, transport := range []*fakeTransport{alice, bob} {
+		writeEvent(t, <-transport.streams, chat1.MsgNotification{
+			Type: "chat",
+			Msg:  &chat1.MsgSummary{Id: 1, ConvID: chat1.ConvIDStr(transport.username)},
+		})
+	}
+	received := map[string]chat1.ConvIDStr{}
+	for range 2 {
+		bot, event := nextMessage(t, m)
+		received[bot] = event.Message.ConvID
+	}
+	require.Equal(t, map[string]chat1.ConvIDStr{"alice": "alice", "bob": "bob"}, received)
+}
+
+func TestManagerRestartsUnhealthyBots(t *testing.T) {
+	var failures atomic.Int32
+	failures.Store(1)
+	m := NewManager(ManagerOptions{
+		HealthCheckInterval: 10 * time.Millisecond,
+		HealthCheck: func(ctx context.Context, api *API) error {
+			if failures.Add(-1) >= 0 {
+				return errors.New("unhealthy")
+			}
+			return nil
+		},
+	})
+	transport := newFakeBot("alice")
+	_, err := m.Add(BotConfig{
+		Options: []func(*API){WithTransport(transport)},
+		Listen:  &ListenOptions{},
+	})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, m.Shutdown(context.Background())) }()
+	first, err := m.API("alice")
+	require.NoError(t, err)
+	<-transport.streams
+
+	// The restarted bot listens again, and its events still reach the
+	// merged stream.
+	stream := <-transport.streams
+	require.Eventually(t, func() bool {
+		api, err := m.API("alice")
+		return err == nil && api != first
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err = first.GetConversations(false)
+	require.ErrorIs(t, err, ErrShutdown)
+
+	writeEvent(t, stream, chat1.MsgNotification{
+		Type: "chat",
+		Msg:  &chat1.MsgSummary{Id: 1, ConvID: "abc"},
+	})
+	bot, event := nextMessage(t, m)
+	require.Equal(t, "alice", bot)
+	require.Equal(t, chat1.ConvIDStr("abc"), event.Message.ConvID)
+}
+
+func TestManagerDefaultHealthCheck(t *testing.T) {
+	transport := newFakeTransport(func(req fakeRequest) (any, error) {
+		return map[string]any{"result": map[string]any{"conversations": []chat1.ConvSummary{}}}, nil
+	})
+	m := NewManager(ManagerOptions{HealthCheckInterval: 10 * time.Millisecond})
+	_, err := m.Add(BotConfig{
+		Options: []func(*API){WithTransport(transport)},
+		Listen:  &ListenOptions{},
+	})
+	require.NoError(t, err)
+	first, err := m.API("alice")
+	require.NoError(t, err)
+
+	// Health checks only list conversations, so the bot isn't logged in
+	// again or restarted.
+	auths := func() int {
+		transport.Lock()
+		defer transport.Unlock()
+		return transport.auths
+	}
+	require.Eventually(t, func() bool { return len(transport.sent()) >= 1 }, 5*time.Second, time.Millisecond)
+	before := auths()
+	require.Eventually(t, func() bool { return len(transport.sent()) >= 4 }, 5*time.Second, time.Millisecond)
+	require.Equal(t, before, auths())
+	for _, req := range transport.sent() {
+		require.Equal(t, "list", req.method)
+	}
+	api, err := m.API("alice")
+	require.NoError(t, err)
+	require.Same(t, first, api)
+
+	// The event stream is closed once the manager has shut down.
+	require.NoError(t, m.Shutdown(context.Background()))
+	for range m.Events() {
+	}
+	require.NoError(t, m.Shutdown(context.Background()))
+	_, err = m.Add(BotConfig{Options: []func(*API){WithTransport(newFakeBot("bob"))}})
+	require.ErrorIs(t, err, ErrShutdown)
+}
+
+func TestManagerShutsDownBotsOnce(t *testing.T) {
+	ran := filepath.Join(t.TempDir(), "ran")
+	api := NewAPI(RunOptions{
+		KeybaseLocation: fakeKeybase(t, `echo "$@" >>`+ran),
+		Oneshot:         &OneshotOptions{Username: "alice"},
+	})
+	bot := &managedBot{api: api}
+
+	// A bot left down by a failed restart isn't logged out again when it
+	// is removed.
+	require.NoError(t, bot.shutdown(context.Background()))
+	require.True(t, bot.isDown())
+	require.NoError(t, bot.shutdown(context.Background()))
+	b, err := os.ReadFile(ran)
+	require.NoError(t, err)
+	require.Equal(t, "logout --force\n", string(b))
+}
@@ -0,0 +1,66 @@
+package kbchat
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+type markOptions struct {
+	Channel        chat1.ChatChannel `json:"channel"`
+	ConversationID chat1.ConvIDStr   `json:"conversation_id,omitempty"`
+	MsgID          chat1.MessageID   `json:"message_id,omitempty"`
+}
+
+type markParams struct {
+	Options markOptions
+}
+
+type markArg struct {
+	Method string
+	Params markParams
+}
+
+func (a *API) mark(ctx context.Context, options markOptions) (res chat1.MarkAsReadLocalRes, err error) {
+	bArg, err := json.Marshal(markArg{
+		Method: "mark",
+		Params: markParams{Options: options},
+	})
+	if err != nil {
+		return res, err
+	}
+	err = a.call(ctx, ChatAPIName, bArg, &res)
+	return res, err
+}
+
+// MarkAsRead marks a conversation as read up to and including upToMsgID, so
+// it no longer shows up as unread. With upToMsgID 0, the whole conversation
+// is marked as read.
+func (a *API) MarkAsRead(convID chat1.ConvIDStr, upToMsgID chat1.MessageID) (chat1.MarkAsReadLocalRes, error) {
+	return a.MarkAsReadContext(context.Background(), convID, upToMsgID)
+}
+
+func (a *API) MarkAsReadContext(ctx context.Context, convID chat1.ConvIDStr, upToMsgID chat1.MessageID) (chat1.MarkAsReadLocalRes, error) {
+	return a.mark(ctx, markOptions{ConversationID: convID, MsgID: upToMsgID})
+}
+
+func (a *API) MarkAsReadByChannel(channel chat1.ChatChannel, upToMsgID chat1.MessageID) (chat1.MarkAsReadLocalRes, error) {
+	return a.MarkAsReadByChannelContext(context.Background(), channel, upToMsgID)
+}
+
+func (a *API) MarkAsReadByChannelContext(ctx context.Context, channel chat1.ChatChannel, upToMsgID chat1.MessageID) (chat1.MarkAsReadLocalRes, error) {
+	return a.mark(ctx, markOptions{Channel: channel, MsgID: upToMsgID})
+}
+
+// markReader returns the function a subscription listening with
+// ListenOptions.MarkRead uses to mark handled messages as read.
+func (a *API) markReader() func(SubscriptionMessage) {
+	return func(msg SubscriptionMessage) {
+		ctx, cancel := context.WithTimeout(context.Background(), a.Timeout)
+		defer cancel()
+		if _, err := a.MarkAsReadContext(ctx, msg.Message.ConvID, msg.Message.Id); err != nil {
+			a.Debug("unable to mark %s as read: %v", msg.Message.ConvID, err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package kbchat
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeMarkRequest struct {
+	Params struct {
+		Options struct {
+			ConversationID chat1.ConvIDStr `json:"conversation_id"`
+			MsgID          chat1.MessageID `json:"message_id"`
+		} `json:"options"`
+	} `json:"params"`
+}
+
+// fakeMarks answers mark requests, handing them to the test.
+func fakeMarks(t *testing.T) (*fakeTransport, chan fakeMarkRequest) {
+	marks := make(chan fakeMarkRequest, 10)
+	transport := newFakeTransport(func(req fakeRequest) (any, error) {
+		if req.method != "mark" {
+			return nil, errors.New("unexpected request")
+		}
+		var mark fakeMarkRequest
+		require.NoError(t, json.Unmarshal(req.request, &mark))
+		marks <- mark
+		return map[string]any{"result": chat1.MarkAsReadLocalRes{}}, nil
+	})
+	return transport, marks
+}
+
+func TestMarkAsRead(t *testing.T) {
+	transport, marks := fakeMarks(t)
+	api, err := Start(RunOptions{}, WithTransport(transport))
+	require.NoError(t, err)
+
+	_, err = api.MarkAsRead("abc", 5)
+	require.NoError(t, err)
+	mark := <-marks
+	require.Equal(t, chat1.ConvIDStr("abc"), mark.Params.Options.ConversationID)
+	require.Equal(t, chat1.MessageID(5), mark.Params.Options.MsgID)
+}
+
+func TestRouterMarksHandledMessagesRead(t *testing.T) {
+	transport, marks := fakeMarks(t)
+	api := NewAPI(RunOptions{}, WithTransport(transport))
+	sub, err := api.Listen(ListenOptions{MarkRead: true})
+	require.NoError(t, err)
+	defer sub.Shutdown()
+	stream := <-transport.streams
+
+	errs := make(chan error, 1)
+	r := NewRouter()
+	r.OnText(func(msg SubscriptionMessage, text chat1.MsgTextContent) error {
+		if text.Body == "bad" {
+			return errors.New("bad body")
+		}
+		return nil
+	})
+	r.OnError(func(err error) { errs <- err })
+	go func() { _ = r.Run(sub) }()
+
+	for i, body := range []string{"bad", "good"} {
+		writeEvent(t, stream, msgNotification(chat1.MsgSummary{
+			Id:      chat1.MessageID(i + 1),
+			ConvID:  "abc",
+			Content: chat1.MsgContent{TypeName: "text", Text: &chat1.MsgTextContent{Body: body}},
+		}))
+	}
+	require.ErrorContains(t, <-errs, "bad body")
+	// Only the message handled without an error is marked as read.
+	mark := <-marks
+	require.Equal(t, chat1.MessageID(2), mark.Params.Options.MsgID)
+	require.Empty(t, marks)
+}
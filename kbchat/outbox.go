@@ -0,0 +1,465 @@
+package kbchat
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+const (
+	defaultOutboxMinBackoff = time.Second
+	defaultOutboxMaxBackoff = 5 * time.Minute
+)
+
+// OutboxMessage is a send waiting in an Outbox.
+type OutboxMessage struct {
+	ID string `json:"id"`
+	// Conv identifies the conversation the message goes to. Messages to the
+	// same conversation are delivered in the order they were queued.
+	Conv string `json:"conv"`
+	// Request is the chat API request that sends the message.
+	Request  json.RawMessage `json:"request"`
+	Queued   time.Time       `json:"queued"`
+	Attempts int             `json:"attempts"`
+}
+
+// OutboxResult reports how a queued message was finally dealt with. Err is
+// set if the message was given up on.
+type OutboxResult struct {
+	ID       string
+	Conv     string
+	Response SendResponse
+	Attempts int
+	Err      error
+}
+
+// OutboxStore persists the messages waiting in an Outbox, so they survive
+// restarts of the bot and of the service.
+type OutboxStore interface {
+	Load(ctx context.Context) ([]OutboxMessage, error)
+	// Save replaces the stored messages with pending.
+	Save(ctx context.Context, pending []OutboxMessage) error
+}
+
+// FileOutboxStore keeps pending messages in a JSON file.
+type FileOutboxStore struct {
+	Path string
+}
+
+func (s FileOutboxStore) Load(ctx context.Context) (pending []OutboxMessage, err error) {
+	b, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &pending); err != nil {
+		return nil, UnmarshalError{err}
+	}
+	return pending, nil
+}
+
+func (s FileOutboxStore) Save(ctx context.Context, pending []OutboxMessage) error {
+	b, err := json.Marshal(pending)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.Path, b)
+}
+
+// writeFileAtomic writes b to a temporary file and moves it into place, so a
+// crash never leaves a half written file behind.
+func writeFileAtomic(path string, b []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// KVStoreOutboxStore keeps pending messages in a single entry of the bot's
+// kvstore.
+type KVStoreOutboxStore struct {
+	API *API
+	// Team is the team whose kvstore is used, or the bot's own if nil.
+	Team      *string
+	Namespace string
+	EntryKey  string
+}
+
+func (s KVStoreOutboxStore) Load(ctx context.Context) (pending []OutboxMessage, err error) {
+	res, err := s.API.GetEntryContext(ctx, s.Team, s.Namespace, s.EntryKey)
+	if err != nil {
+		return nil, err
+	}
+	if res.EntryValue == nil || *res.EntryValue == "" {
+		return nil, nil
+	}
+	if err := json.Unmarshal([]byte(*res.EntryValue), &pending); err != nil {
+		return nil, UnmarshalError{err}
+	}
+	return pending, nil
+}
+
+func (s KVStoreOutboxStore) Save(ctx context.Context, pending []OutboxMessage) error {
+	b, err := json.Marshal(pending)
+	if err != nil {
+		return err
+	}
+	_, err = s.API.PutEntryContext(ctx, s.Team, s.Namespace, s.EntryKey, string(b))
+	return err
+}
+
+// OutboxOptions configures an Outbox.
+type OutboxOptions struct {
+	// OnResult is called once for every message, after it has been sent or
+	// given up on.
+	OnResult func(OutboxResult)
+	// MinBackoff and MaxBackoff bound the exponential backoff between
+	// attempts. They default to a second and five minutes.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// MaxAttempts gives up on a message after that many failed attempts.
+	// Zero retries forever.
+	MaxAttempts int
+}
+
+// Outbox delivers messages in the background, retrying with exponential
+// backoff while the service can't be reached or rate limits the bot. Pending
+// messages are persisted in an OutboxStore and picked up again when the
+// outbox is restarted. Once the API shuts down, delivery stops and the
+// remaining messages are left in the store. A message whose response got
+// lost may be delivered twice.
+type Outbox struct {
+	sync.Mutex
+	*DebugOutput
+	api   *API
+	store OutboxStore
+	opts  OutboxOptions
+
+	// pending are all undelivered messages, in the order they were queued,
+	// and queues holds the ones left for each conversation. running is set
+	// for the conversations that have a worker.
+	pending []OutboxMessage
+	queues  map[string][]OutboxMessage
+	running map[string]bool
+	saveMu  sync.Mutex
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// StartOutbox loads the messages left in store and starts delivering them.
+func (a *API) StartOutbox(store OutboxStore, opts OutboxOptions) (*Outbox, error) {
+	return a.StartOutboxContext(context.Background(), store, opts)
+}
+
+func (a *API) StartOutboxContext(ctx context.Context, store OutboxStore, opts OutboxOptions) (*Outbox, error) {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = defaultOutboxMinBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = defaultOutboxMaxBackoff
+	}
+	pending, err := store.Load(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load outbox: %w", err)
+	}
+	o := &Outbox{
+		DebugOutput: NewDebugOutput("Outbox"),
+		api:         a,
+		store:       store,
+		opts:        opts,
+		pending:     pending,
+		queues:      make(map[string][]OutboxMessage),
+		running:     make(map[string]bool),
+	}
+	o.ctx, o.cancel = context.WithCancel(context.Background())
+	o.Lock()
+	defer o.Unlock()
+	for _, msg := range pending {
+		o.queueLocked(msg)
+	}
+	return o, nil
+}
+
+// Pending returns the messages that have not been delivered yet.
+func (o *Outbox) Pending() []OutboxMessage {
+	o.Lock()
+	defer o.Unlock()
+	return slices.Clone(o.pending)
+}
+
+// Close stops delivering messages. Undelivered ones stay in the store.
+func (o *Outbox) Close() error {
+	o.cancel()
+	o.wg.Wait()
+	return nil
+}
+
+func (o *Outbox) SendMessage(channel chat1.ChatChannel, body string, args ...any) (id string, err error) {
+	return o.SendMessageContext(context.Background(), channel, body, args...)
+}
+
+func (o *Outbox) SendMessageContext(ctx context.Context, channel chat1.ChatChannel, body string, args ...any) (id string, err error) {
+	return o.enqueue(ctx, newSendArg(sendMessageOptions{
+		Channel: channel,
+		Message: sendMessageBody{Body: fmtBody(body, args...)},
+	}))
+}
+
+func (o *Outbox) SendMessageByConvID(convID chat1.ConvIDStr, body string, args ...any) (id string, err error) {
+	return o.SendMessageByConvIDContext(context.Background(), convID, body, args...)
+}
+
+func (o *Outbox) SendMessageByConvIDContext(ctx context.Context, convID chat1.ConvIDStr, body string, args ...any) (id string, err error) {
+	return o.enqueue(ctx, newSendArg(sendMessageOptions{
+		ConversationID: convID,
+		Message:        sendMessageBody{Body: fmtBody(body, args...)},
+	}))
+}
+
+func (o *Outbox) SendReply(channel chat1.ChatChannel, replyTo *chat1.MessageID, body string, args ...any) (id string, err error) {
+	return o.SendReplyContext(context.Background(), channel, replyTo, body, args...)
+}
+
+func (o *Outbox) SendReplyContext(ctx context.Context, channel chat1.ChatChannel, replyTo *chat1.MessageID, body string, args ...any) (id string, err error) {
+	return o.enqueue(ctx, newSendArg(sendMessageOptions{
+		Channel: channel,
+		Message: sendMessageBody{Body: fmtBody(body, args...)},
+		ReplyTo: replyTo,
+	}))
+}
+
+func (o *Outbox) SendReplyByConvID(convID chat1.ConvIDStr, replyTo *chat1.MessageID, body string, args ...any) (id string, err error) {
+	return o.SendReplyByConvIDContext(context.Background(), convID, replyTo, body, args...)
+}
+
+func (o *Outbox) SendReplyByConvIDContext(ctx context.Context, convID chat1.ConvIDStr, replyTo *chat1.MessageID, body string, args ...any) (id string, err error) {
+	return o.enqueue(ctx, newSendArg(sendMessageOptions{
+		ConversationID: convID,
+		Message:        sendMessageBody{Body: fmtBody(body, args...)},
+		ReplyTo:        replyTo,
+	}))
+}
+
+// SendAttachment queues an attachment upload. The file has to stay in place
+// until the upload has been reported.
+func (o *Outbox) SendAttachment(channel chat1.ChatChannel, filename string, title string) (id string, err error) {
+	return o.SendAttachmentContext(context.Background(), channel, filename, title)
+}
+
+func (o *Outbox) SendAttachmentContext(ctx context.Context, channel chat1.ChatChannel, filename string, title string) (id string, err error) {
+	return o.enqueue(ctx, sendMessageArg{
+		Method: "attach",
+		Params: sendMessageParams{Options: sendMessageOptions{
+			Channel:  channel,
+			Filename: filename,
+			Title:    title,
+		}},
+	})
+}
+
+// SendAttachmentByConvID queues an attachment upload. The file has to stay in
+// place until the upload has been reported.
+func (o *Outbox) SendAttachmentByConvID(convID chat1.ConvIDStr, filename string, title string) (id string, err error) {
+	return o.SendAttachmentByConvIDContext(context.Background(), convID, filename, title)
+}
+
+func (o *Outbox) SendAttachmentByConvIDContext(ctx context.Context, convID chat1.ConvIDStr, filename string, title string) (id string, err error) {
+	return o.enqueue(ctx, sendMessageArg{
+		Method: "attach",
+		Params: sendMessageParams{Options: sendMessageOptions{
+			ConversationID: convID,
+			Filename:       filename,
+			Title:          title,
+		}},
+	})
+}
+
+// outboxConv identifies the conversation a send goes to.
+func outboxConv(options sendMessageOptions) string {
+	if options.ConversationID != "" {
+		return string(options.ConversationID)
+	}
+	b, _ := json.Marshal(options.Channel)
+	return string(b)
+}
+
+func newOutboxID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// enqueue persists a send and hands it to its conversation's worker. The
+// message is only queued once it has been stored.
+func (o *Outbox) enqueue(ctx context.Context, arg sendMessageArg) (id string, err error) {
+	request, err := json.Marshal(arg)
+	if err != nil {
+		return "", fmt.Errorf("unable to send arg: %+v: %v", arg, err)
+	}
+	if id, err = newOutboxID(); err != nil {
+		return "", err
+	}
+	msg := OutboxMessage{
+		ID:      id,
+		Conv:    outboxConv(arg.Params.Options),
+		Request: request,
+		Queued:  time.Now(),
+	}
+	o.Lock()
+	o.pending = append(o.pending, msg)
+	o.Unlock()
+	if err := o.persist(ctx); err != nil {
+		o.remove(msg.ID)
+		return "", fmt.Errorf("unable to store message: %w", err)
+	}
+	o.Lock()
+	defer o.Unlock()
+	o.queueLocked(msg)
+	return id, nil
+}
+
+// queueLocked adds a message to its conversation's queue, starting a worker
+// for the conversation if it has none.
+func (o *Outbox) queueLocked(msg OutboxMessage) {
+	o.queues[msg.Conv] = append(o.queues[msg.Conv], msg)
+	if !o.running[msg.Conv] {
+		o.running[msg.Conv] = true
+		o.wg.Add(1)
+		go o.deliver(msg.Conv)
+	}
+}
+
+// persist saves the current set of pending messages.
+func (o *Outbox) persist(ctx context.Context) error {
+	o.saveMu.Lock()
+	defer o.saveMu.Unlock()
+	return o.store.Save(ctx, o.Pending())
+}
+
+func (o *Outbox) remove(id string) {
+	o.Lock()
+	defer o.Unlock()
+	o.pending = slices.DeleteFunc(o.pending, func(msg OutboxMessage) bool { return msg.ID == id })
+}
+
+// deliver sends the messages queued for a conversation one after another,
+// until the queue is empty or the outbox is closed.
+func (o *Outbox) deliver(conv string) {
+	defer o.wg.Done()
+	defer func() {
+		o.Lock()
+		defer o.Unlock()
+		delete(o.running, conv)
+		if len(o.queues[conv]) == 0 {
+			delete(o.queues, conv)
+		}
+	}()
+	for {
+		o.Lock()
+		queue := o.queues[conv]
+		if len(queue) == 0 || o.ctx.Err() != nil {
+			o.Unlock()
+			return
+		}
+		msg := queue[0]
+		o.Unlock()
+
+		res, done := o.send(msg)
+		if !done {
+			// The outbox or the API is shutting down. The queue is left as
+			// it is, and the messages stay stored for the next start, or
+			// for the next message queued for the conversation.
+			return
+		}
+		o.Lock()
+		o.queues[conv] = o.queues[conv][1:]
+		o.Unlock()
+		o.remove(msg.ID)
+		if err := o.persist(o.ctx); err != nil {
+			o.Debug("deliver: unable to store outbox: %v", err)
+		}
+		if o.opts.OnResult != nil {
+			o.opts.OnResult(res)
+		}
+	}
+}
+
+// send tries to deliver a message until it goes through or fails for good.
+// If the outbox is closed or the API shuts down first, done is false.
+func (o *Outbox) send(msg OutboxMessage) (res OutboxResult, done bool) {
+	backoff := o.opts.MinBackoff
+	for {
+		msg.Attempts++
+		var resp SendResponse
+		err := o.api.call(o.ctx, ChatAPIName, msg.Request, &resp.Result)
+		res = OutboxResult{ID: msg.ID, Conv: msg.Conv, Response: resp, Attempts: msg.Attempts, Err: err}
+		if o.ctx.Err() != nil || errors.Is(err, ErrShutdown) {
+			return res, false
+		}
+		if err == nil || !(isTransient(err) || isCallCancelled(err)) ||
+			(o.opts.MaxAttempts > 0 && msg.Attempts >= o.opts.MaxAttempts) {
+			return res, true
+		}
+		o.recordAttempts(msg)
+		o.Debug("send: attempt %d failed, retrying in %v: %v", msg.Attempts, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-o.ctx.Done():
+			return res, false
+		}
+		backoff = min(2*backoff, o.opts.MaxBackoff)
+	}
+}
+
+// recordAttempts stores the number of attempts made at a message, so that
+// MaxAttempts still holds after a restart.
+func (o *Outbox) recordAttempts(msg OutboxMessage) {
+	o.Lock()
+	for i := range o.pending {
+		if o.pending[i].ID == msg.ID {
+			o.pending[i].Attempts = msg.Attempts
+		}
+	}
+	if queue := o.queues[msg.Conv]; len(queue) > 0 && queue[0].ID == msg.ID {
+		queue[0].Attempts = msg.Attempts
+	}
+	o.Unlock()
+	if err := o.persist(o.ctx); err != nil {
+		o.Debug("recordAttempts: unable to store outbox: %v", err)
+	}
+}
+
+// isCallCancelled reports whether a call timed out or was cancelled, rather
+// than failed because of the message.
+func isCallCancelled(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// isTransient reports whether an error may go away by itself.
+func isTransient(err error) bool {
+	return errors.Is(err, ErrServiceUnreachable) || errors.Is(err, ErrRateLimited)
+}
@@ -0,0 +1,231 @@
+package kbchat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/keybase1"
+	"github.com/stretchr/testify/require"
+)
+
+func sentBody(t *testing.T, req fakeRequest) string {
+	var arg sendMessageArg
+	require.NoError(t, json.Unmarshal(req.request, &arg))
+	return arg.Params.Options.Message.Body
+}
+
+func TestOutboxRetriesInOrder(t *testing.T) {
+	var mu sync.Mutex
+	failures := 2
+	var delivered []string
+	transport := newFakeTransport(func(req fakeRequest) (any, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			return nil, errors.New("service restarting")
+		}
+		delivered = append(delivered, sentBody(t, req))
+		return map[string]any{"result": chat1.SendRes{Message: "message sent"}}, nil
+	})
+	api, err := Start(RunOptions{}, WithTransport(transport))
+	require.NoError(t, err)
+
+	results := make(chan OutboxResult, 10)
+	store := FileOutboxStore{Path: filepath.Join(t.TempDir(), "outbox.json")}
+	outbox, err := api.StartOutbox(store, OutboxOptions{
+		OnResult:   func(res OutboxResult) { results <- res },
+		MinBackoff: time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer func() { _ = outbox.Close() }()
+
+	var ids []string
+	for _, body := range []string{"one", "two", "three"} {
+		id, err := outbox.SendMessageByConvID("abc", "%s", body)
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+	for i, id := range ids {
+		res := <-results
+		require.NoError(t, res.Err)
+		require.Equal(t, id, res.ID)
+		require.Equal(t, "abc", res.Conv)
+		require.Equal(t, "message sent", res.Response.Result.Message)
+		if i == 0 {
+			require.Equal(t, 3, res.Attempts)
+		}
+	}
+	mu.Lock()
+	require.Equal(t, []string{"one", "two", "three"}, delivered)
+	mu.Unlock()
+
+	require.Empty(t, outbox.Pending())
+	pending, err := store.Load(t.Context())
+	require.NoError(t, err)
+	require.Empty(t, pending)
+}
+
+func TestOutboxGivesUpOnPermanentErrors(t *testing.T) {
+	transport := newFakeTransport(func(req fakeRequest) (any, error) {
+		return errorResponse(keybase1.StatusCode_SCChatNotInConv, "not in conv"), nil
+	})
+	api, err := Start(RunOptions{}, WithTransport(transport))
+	require.NoError(t, err)
+
+	results := make(chan OutboxResult, 1)
+	store := FileOutboxStore{Path: filepath.Join(t.TempDir(), "outbox.json")}
+	outbox, err := api.StartOutbox(store, OutboxOptions{OnResult: func(res OutboxResult) { results <- res }})
+	require.NoError(t, err)
+	defer func() { _ = outbox.Close() }()
+
+	_, err = outbox.SendMessage(chat1.ChatChannel{Name: "alice,bob"}, "hi")
+	require.NoError(t, err)
+	res := <-results
+	require.ErrorIs(t, res.Err, ErrNotAMember)
+	require.Equal(t, 1, res.Attempts)
+	require.Len(t, transport.sent(), 1)
+}
+
+func TestOutboxSurvivesRestart(t *testing.T) {
+	var mu sync.Mutex
+	up := false
+	transport := newFakeTransport(func(req fakeRequest) (any, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !up {
+			return nil, errors.New("service down")
+		}
+		return map[string]any{"result": chat1.SendRes{Message: "message sent"}}, nil
+	})
+	api, err := Start(RunOptions{}, WithTransport(transport))
+	require.NoError(t, err)
+
+	store := FileOutboxStore{Path: filepath.Join(t.TempDir(), "outbox.json")}
+	outbox, err := api.StartOutbox(store, OutboxOptions{MinBackoff: time.Millisecond})
+	require.NoError(t, err)
+	id, err := outbox.SendReplyByConvID("abc", nil, "hi")
+	require.NoError(t, err)
+	require.NoError(t, outbox.Close())
+
+	pending, err := store.Load(t.Context())
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	require.Equal(t, id, pending[0].ID)
+
+	mu.Lock()
+	up = true
+	mu.Unlock()
+	results := make(chan OutboxResult, 1)
+	outbox, err = api.StartOutbox(store, OutboxOptions{OnResult: func(res OutboxResult) { results <- res }})
+	require.NoError(t, err)
+	defer func() { _ = outbox.Close() }()
+	res := <-results
+	require.NoError(t, res.Err)
+	require.Equal(t, id, res.ID)
+}
+
+func TestOutboxKeepsAttemptsAcrossRestarts(t *testing.T) {
+	transport := newFakeTransport(func(req fakeRequest) (any, error) {
+		return nil, errors.New("service down")
+	})
+	api, err := Start(RunOptions{}, WithTransport(transport))
+	require.NoError(t, err)
+
+	store := FileOutboxStore{Path: filepath.Join(t.TempDir(), "outbox.json")}
+	outbox, err := api.StartOutbox(store, OutboxOptions{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	require.NoError(t, err)
+	_, err = outbox.SendMessageByConvID("abc", "hi")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		pending, err := store.Load(t.Context())
+		return err == nil && len(pending) == 1 && pending[0].Attempts >= 3
+	}, 5*time.Second, time.Millisecond)
+	require.NoError(t, outbox.Close())
+
+	// The attempts made before the restart count toward MaxAttempts.
+	results := make(chan OutboxResult, 1)
+	outbox, err = api.StartOutbox(store, OutboxOptions{
+		OnResult:    func(res OutboxResult) { results <- res },
+		MinBackoff:  time.Millisecond,
+		MaxAttempts: 3,
+	})
+	require.NoError(t, err)
+	defer func() { _ = outbox.Close() }()
+	res := <-results
+	require.ErrorIs(t, res.Err, ErrServiceUnreachable)
+	require.Greater(t, res.Attempts, 3)
+}
+
+func TestOutboxKeepsMessagesOnShutdown(t *testing.T) {
+	transport := newFakeTransport(func(req fakeRequest) (any, error) {
+		return nil, errors.New("service down")
+	})
+	api, err := Start(RunOptions{}, WithTransport(transport))
+	require.NoError(t, err)
+
+	results := make(chan OutboxResult, 1)
+	store := FileOutboxStore{Path: filepath.Join(t.TempDir(), "outbox.json")}
+	outbox, err := api.StartOutbox(store, OutboxOptions{
+		OnResult:   func(res OutboxResult) { results <- res },
+		MinBackoff: time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer func() { _ = outbox.Close() }()
+	id, err := outbox.SendMessageByConvID("abc", "hi")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return len(transport.sent()) >= 2 }, 5*time.Second, time.Millisecond)
+
+	// Calls failing with ErrShutdown don't count as a result.
+	require.NoError(t, api.Shutdown())
+	time.Sleep(20 * time.Millisecond)
+	require.Empty(t, results)
+	pending, err := store.Load(t.Context())
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	require.Equal(t, id, pending[0].ID)
+}
+
+func TestOutboxRetriesCallTimeouts(t *testing.T) {
+	var mu sync.Mutex
+	timedOut := false
+	transport := newFakeTransport(func(req fakeRequest) (any, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !timedOut {
+			timedOut = true
+			return nil, context.DeadlineExceeded
+		}
+		return map[string]any{"result": chat1.SendRes{Message: "message sent"}}, nil
+	})
+	api, err := Start(RunOptions{}, WithTransport(transport))
+	require.NoError(t, err)
+
+	results := make(chan OutboxResult, 2)
+	store := FileOutboxStore{Path: filepath.Join(t.TempDir(), "outbox.json")}
+	outbox, err := api.StartOutbox(store, OutboxOptions{
+		OnResult:   func(res OutboxResult) { results <- res },
+		MinBackoff: time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer func() { _ = outbox.Close() }()
+
+	// A call that timed out is retried, and the conversation keeps going.
+	first, err := outbox.SendMessageByConvID("abc", "one")
+	require.NoError(t, err)
+	res := <-results
+	require.NoError(t, res.Err)
+	require.Equal(t, first, res.ID)
+	require.Equal(t, 2, res.Attempts)
+	second, err := outbox.SendMessageByConvID("abc", "two")
+	require.NoError(t, err)
+	res = <-results
+	require.NoError(t, res.Err)
+	require.Equal(t, second, res.ID)
+}
@@ -0,0 +1,435 @@
+package kbchat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+const defaultSubscriptionBufferSize = 250
+
+// OverflowPolicy decides what a subscription does with new events once its
+// buffer is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits until there is room, holding up every kind of
+	// event.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest makes room by dropping the oldest buffered event.
+	OverflowDropOldest
+	// OverflowDropNewest drops the new event.
+	OverflowDropNewest
+	// OverflowSpill queues events in a file until there is room again.
+	// Spilled events are lost if the subscription shuts down before they
+	// have been read.
+	OverflowSpill
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowBlock:
+		return "block"
+	case OverflowDropOldest:
+		return "drop oldest"
+	case OverflowDropNewest:
+		return "drop newest"
+	case OverflowSpill:
+		return "spill"
+	default:
+		return "unknown"
+	}
+}
+
+// SubscriptionStats describes how a subscription's buffer is coping.
+type SubscriptionStats struct {
+	// Buffered is the number of events waiting to be read, and Spilled the
+	// number of those that are kept on disk.
+	Buffered int
+	Spilled  int
+	// Dropped counts the events that were thrown away because the buffer was
+	// full or nobody was reading them.
+	Dropped int64
+}
+
+// Stats reports how the subscription's buffer is coping.
+func (m *Subscription) Stats() SubscriptionStats {
+	stats := SubscriptionStats{
+		Buffered: len(m.eventsCh) + int(m.queued.Load()),
+		Dropped:  m.dropped.Load(),
+	}
+	if m.spill != nil {
+		stats.Spilled = m.spill.len()
+		stats.Buffered += stats.Spilled
+	}
+	return stats
+}
+
+func (m *Subscription) drop(event Event, reason string) {
+	if m.dropped.Add(1) == 1 {
+		m.Debug("dropping events, first one %T: %s", event, reason)
+	}
+}
+
+// enqueue delivers an event according to the overflow policy, reporting
+// false if the subscription was shut down first.
+func (m *Subscription) enqueue(event Event) bool {
+	switch m.overflow {
+	case OverflowDropOldest:
+		for {
+			select {
+			case m.eventsCh <- event:
+				return true
+			default:
+			}
+			select {
+			case oldest := <-m.eventsCh:
+				m.drop(oldest, "buffer full")
+			default:
+			}
+		}
+	case OverflowDropNewest:
+		select {
+		case m.eventsCh <- event:
+		default:
+			m.drop(event, "buffer full")
+		}
+		return true
+	case OverflowSpill:
+		if ok, err := m.spill.push(event); err != nil {
+			m.Debug("unable to spill event, blocking: %v", err)
+		} else if ok {
+			return true
+		}
+	}
+	select {
+	case m.eventsCh <- event:
+		return true
+	case <-m.shutdownCh:
+		return false
+	}
+}
+
+// spillQueue is the overflow of a subscription's buffer, kept in a file. Once
+// events have been spilled, all new events go through the file until it has
+// been drained, so they stay in order.
+type spillQueue struct {
+	sync.Mutex
+	dir      string
+	eventsCh chan Event
+	// notify wakes up the pump when events are spilled.
+	notify chan struct{}
+
+	file *os.File
+	// sizes are the sizes of the spilled events not yet read back, which
+	// start at readOff in the file, and end at writeOff.
+	sizes    []int
+	readOff  int64
+	writeOff int64
+	// queued counts the events spilled and not yet handed to the buffer,
+	// including the one the pump is working on.
+	queued int
+	// n mirrors queued for Stats.
+	n atomic.Int64
+}
+
+func newSpillQueue(dir string, eventsCh chan Event) *spillQueue {
+	return &spillQueue{
+		dir:      dir,
+		eventsCh: eventsCh,
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+func (q *spillQueue) len() int {
+	return int(q.n.Load())
+}
+
+// push hands the event straight to the buffer if nothing has been spilled and
+// there is room, otherwise it appends it to the file. ok is false if the
+// event has to go to the buffer but there is no room.
+func (q *spillQueue) push(event Event) (ok bool, err error) {
+	q.Lock()
+	defer q.Unlock()
+	if q.queued == 0 {
+		select {
+		case q.eventsCh <- event:
+			return true, nil
+		default:
+		}
+	}
+	if q.file == nil {
+		if q.file, err = os.CreateTemp(q.dir, "kbchat-spill-"); err != nil {
+			return false, err
+		}
+	}
+	b, err := encodeSpilledEvent(event)
+	if err != nil {
+		return false, err
+	}
+	if _, err := q.file.WriteAt(b, q.writeOff); err != nil {
+		return false, err
+	}
+	q.writeOff += int64(len(b))
+	q.sizes = append(q.sizes, len(b))
+	q.queued++
+	q.n.Add(1)
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return true, nil
+}
+
+// pop reads the next spilled event.
+func (q *spillQueue) pop() (Event, bool) {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.sizes) == 0 {
+		return nil, false
+	}
+	b := make([]byte, q.sizes[0])
+	_, err := q.file.ReadAt(b, q.readOff)
+	q.readOff += int64(q.sizes[0])
+	q.sizes = q.sizes[1:]
+	if err != nil {
+		return ErrorEvent{Err: fmt.Errorf("unable to read spilled event: %w", err)}, true
+	}
+	event, err := decodeSpilledEvent(b)
+	if err != nil {
+		return ErrorEvent{Err: fmt.Errorf("unable to decode spilled event: %w", err)}, true
+	}
+	return event, true
+}
+
+// delivered marks the event last popped as handed to the buffer, and empties
+// the file once everything in it has been.
+func (q *spillQueue) delivered() {
+	q.Lock()
+	defer q.Unlock()
+	q.queued--
+	q.n.Add(-1)
+	if q.queued == 0 {
+		if err := q.file.Truncate(0); err != nil {
+			return
+		}
+		q.readOff, q.writeOff = 0, 0
+	}
+}
+
+// pump moves spilled events into the buffer in order, until shutdownCh is
+// closed.
+func (q *spillQueue) pump(shutdownCh chan struct{}) {
+	for {
+		event, ok := q.pop()
+		if !ok {
+			select {
+			case <-q.notify:
+				continue
+			case <-shutdownCh:
+				return
+			}
+		}
+		select {
+		case q.eventsCh <- event:
+			q.delivered()
+		case <-shutdownCh:
+			return
+		}
+	}
+}
+
+// close removes the spill file.
+func (q *spillQueue) close() {
+	q.Lock()
+	defer q.Unlock()
+	if q.file == nil {
+		return
+	}
+	_ = q.file.Close()
+	_ = os.Remove(q.file.Name())
+	q.file = nil
+}
+
+// spilledEvent is the on-disk form of an Event.
+type spilledEvent struct {
+	Message      *SubscriptionMessage      `json:"message,omitempty"`
+	Pin          *PinEvent                 `json:"pin,omitempty"`
+	Unpin        *UnpinEvent               `json:"unpin,omitempty"`
+	Conversation *SubscriptionConversation `json:"conversation,omitempty"`
+	Wallet       *SubscriptionWalletEvent  `json:"wallet,omitempty"`
+	Typing       *TypingEvent              `json:"typing,omitempty"`
+	Reconnected  bool                      `json:"reconnected,omitempty"`
+	Disconnected *DisconnectedEvent        `json:"disconnected,omitempty"`
+	Err          *spilledError             `json:"err,omitempty"`
+	ErrType      string                    `json:"err_type,omitempty"`
+}
+
+// spilledError is the on-disk form of an error. Only its message, its error
+// category and the FrameError it carries survive.
+type spilledError struct {
+	Message  string        `json:"message"`
+	Category string        `json:"category,omitempty"`
+	Frame    *spilledFrame `json:"frame,omitempty"`
+}
+
+type spilledFrame struct {
+	ConvID chat1.ConvIDStr `json:"conv_id,omitempty"`
+	Size   int             `json:"size"`
+	Frame  []byte          `json:"frame"`
+	Err    *spilledError   `json:"err,omitempty"`
+}
+
+// spilledCategories are the sentinel errors kept when an error is spilled.
+var spilledCategories = []struct {
+	name string
+	err  error
+}{
+	{"rate_limited", ErrRateLimited},
+	{"not_a_member", ErrNotAMember},
+	{"conversation_not_found", ErrConversationNotFound},
+	{"revision_conflict", ErrRevisionConflict},
+	{"service_unreachable", ErrServiceUnreachable},
+	{"auth_expired", ErrAuthExpired},
+	{"shutdown", ErrShutdown},
+	{"frame_too_large", ErrFrameTooLarge},
+}
+
+func newSpilledError(err error) *spilledError {
+	if err == nil {
+		return nil
+	}
+	spilled := &spilledError{Message: err.Error()}
+	for _, category := range spilledCategories {
+		if errors.Is(err, category.err) {
+			spilled.Category = category.name
+			break
+		}
+	}
+	var frameErr FrameError
+	if errors.As(err, &frameErr) {
+		spilled.Frame = &spilledFrame{
+			ConvID: frameErr.ConvID,
+			Size:   frameErr.Size,
+			Frame:  frameErr.Frame,
+			Err:    newSpilledError(frameErr.Err),
+		}
+	}
+	return spilled
+}
+
+// restoredError is an error read back from the spill file. It still matches
+// its category with errors.Is, and its FrameError with errors.As.
+type restoredError struct {
+	msg      string
+	category error
+	frame    *FrameError
+}
+
+func (e restoredError) Error() string {
+	return e.msg
+}
+
+func (e restoredError) Unwrap() []error {
+	var errs []error
+	if e.category != nil {
+		errs = append(errs, e.category)
+	}
+	if e.frame != nil {
+		errs = append(errs, *e.frame)
+	}
+	return errs
+}
+
+func (s *spilledError) decode() error {
+	if s == nil {
+		return nil
+	}
+	var frame *FrameError
+	if s.Frame != nil {
+		frame = &FrameError{
+			ConvID: s.Frame.ConvID,
+			Size:   s.Frame.Size,
+			Frame:  s.Frame.Frame,
+			Err:    s.Frame.Err.decode(),
+		}
+		if frame.Error() == s.Message {
+			return *frame
+		}
+	}
+	var category error
+	for _, c := range spilledCategories {
+		if c.name == s.Category {
+			category = c.err
+		}
+	}
+	if category == nil && frame == nil {
+		return errors.New(s.Message)
+	}
+	return restoredError{msg: s.Message, category: category, frame: frame}
+}
+
+func encodeSpilledEvent(event Event) ([]byte, error) {
+	var spilled spilledEvent
+	switch event := event.(type) {
+	case MessageEvent:
+		spilled.Message = &event.SubscriptionMessage
+	case PinEvent:
+		spilled.Pin = &event
+	case UnpinEvent:
+		spilled.Unpin = &event
+	case ConversationEvent:
+		spilled.Conversation = &event.SubscriptionConversation
+	case WalletEvent:
+		spilled.Wallet = &event.SubscriptionWalletEvent
+	case TypingEvent:
+		spilled.Typing = &event
+	case ReconnectedEvent:
+		spilled.Reconnected = true
+	case DisconnectedEvent:
+		spilled.Err = newSpilledError(event.Err)
+		event.Err = nil
+		spilled.Disconnected = &event
+	case ErrorEvent:
+		spilled.Err = newSpilledError(event.Err)
+		spilled.ErrType = event.Type
+	default:
+		return nil, fmt.Errorf("unable to spill %T", event)
+	}
+	return json.Marshal(spilled)
+}
+
+func decodeSpilledEvent(b []byte) (Event, error) {
+	var spilled spilledEvent
+	if err := json.Unmarshal(b, &spilled); err != nil {
+		return nil, err
+	}
+	err := spilled.Err.decode()
+	switch {
+	case spilled.Message != nil:
+		return MessageEvent{*spilled.Message}, nil
+	case spilled.Pin != nil:
+		return *spilled.Pin, nil
+	case spilled.Unpin != nil:
+		return *spilled.Unpin, nil
+	case spilled.Conversation != nil:
+		return ConversationEvent{*spilled.Conversation}, nil
+	case spilled.Wallet != nil:
+		return WalletEvent{*spilled.Wallet}, nil
+	case spilled.Typing != nil:
+		return *spilled.Typing, nil
+	case spilled.Reconnected:
+		return ReconnectedEvent{}, nil
+	case spilled.Disconnected != nil:
+		event := *spilled.Disconnected
+		event.Err = err
+		return event, nil
+	default:
+		return ErrorEvent{Type: spilled.ErrType, Err: err}, nil
+	}
+}
@@ -0,0 +1,137 @@
+package kbchat
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/stretchr/testify/require"
+)
+
+func testMessage(id int) MessageEvent {
+	return MessageEvent{SubscriptionMessage{Message: chat1.MsgSummary{Id: chat1.MessageID(id)}}}
+}
+
+// readIDs reads n message events off the subscription.
+func readIDs(t *testing.T, sub *Subscription, n int) (ids []int) {
+	for range n {
+		event := (<-sub.Events()).(MessageEvent)
+		ids = append(ids, int(event.Message.Id))
+	}
+	return ids
+}
+
+func TestOverflowDrop(t *testing.T) {
+	sub := newSubscription(ListenOptions{BufferSize: 2, Overflow: OverflowDropNewest})
+	for id := 1; id <= 4; id++ {
+		require.True(t, sub.send(testMessage(id)))
+	}
+	require.Equal(t, SubscriptionStats{Buffered: 2, Dropped: 2}, sub.Stats())
+	require.Equal(t, []int{1, 2}, readIDs(t, sub, 2))
+
+	sub = newSubscription(ListenOptions{BufferSize: 2, Overflow: OverflowDropOldest})
+	for id := 1; id <= 4; id++ {
+		require.True(t, sub.send(testMessage(id)))
+	}
+	require.Equal(t, SubscriptionStats{Buffered: 2, Dropped: 2}, sub.Stats())
+	require.Equal(t, []int{3, 4}, readIDs(t, sub, 2))
+}
+
+func TestOverflowBlock(t *testing.T) {
+	sub := newSubscription(ListenOptions{BufferSize: 1})
+	require.True(t, sub.send(testMessage(1)))
+	sent := make(chan bool)
+	go func() { sent <- sub.send(testMessage(2)) }()
+	select {
+	case <-sent:
+		t.Fatal("send did not block on a full buffer")
+	case <-time.After(50 * time.Millisecond):
+	}
+	sub.Shutdown()
+	require.False(t, <-sent)
+}
+
+func TestOverflowSpill(t *testing.T) {
+	dir := t.TempDir()
+	sub := newSubscription(ListenOptions{BufferSize: 2, Overflow: OverflowSpill, SpillDir: dir})
+	go sub.spill.pump(sub.shutdownCh)
+	defer sub.spill.close()
+	defer sub.Shutdown()
+
+	for id := 1; id <= 10; id++ {
+		require.True(t, sub.send(testMessage(id)))
+	}
+	stats := sub.Stats()
+	require.Equal(t, 10, stats.Buffered)
+	require.GreaterOrEqual(t, stats.Spilled, 7)
+	require.Zero(t, stats.Dropped)
+
+	require.Equal(t, []int{1, 2, 3, 4, 5}, readIDs(t, sub, 5))
+	require.True(t, sub.send(testMessage(11)))
+	require.Equal(t, []int{6, 7, 8, 9, 10, 11}, readIDs(t, sub, 6))
+	require.Eventually(t, func() bool { return sub.Stats().Buffered == 0 }, 5*time.Second, 10*time.Millisecond)
+
+	// The spill file is emptied once it has been drained.
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	info, err := entries[0].Info()
+	require.NoError(t, err)
+	require.Zero(t, info.Size())
+}
+
+func TestSpilledEventRoundTrip(t *testing.T) {
+	for _, event := range []Event{
+		testMessage(1),
+		PinEvent{SubscriptionMessage: testMessage(2).SubscriptionMessage, PinnedMsgID: 1},
+		UnpinEvent{SubscriptionMessage: testMessage(3).SubscriptionMessage, PinnedMsgID: 1},
+		ConversationEvent{SubscriptionConversation{Conversation: chat1.ConvSummary{Id: "abc"}}},
+		WalletEvent{},
+		TypingEvent{ConvID: "abc", Typers: []chat1.TyperInfo{{Username: "alice"}}},
+		ReconnectedEvent{},
+		DisconnectedEvent{Attempts: 2, Err: errors.New("gone"), RetryIn: time.Second, GaveUp: true},
+		ErrorEvent{Err: errors.New("bad line")},
+	} {
+		b, err := encodeSpilledEvent(event)
+		require.NoError(t, err)
+		decoded, err := decodeSpilledEvent(b)
+		require.NoError(t, err)
+		require.Equal(t, event, decoded)
+	}
+
+	// Errors keep their category and FrameError.
+	frameErr := newFrameError([]byte(`{"type":"chat","msg":{"conversation_id":"abc"`), 1<<30, ErrFrameTooLarge)
+	for _, event := range []Event{
+		ErrorEvent{Type: "chat", Err: frameErr},
+		ErrorEvent{Err: fmt.Errorf("unable to fetch missed messages: %w", APIError{errors.New("broken pipe")})},
+		DisconnectedEvent{Err: fmt.Errorf("wrapped: %w", frameErr)},
+	} {
+		b, err := encodeSpilledEvent(event)
+		require.NoError(t, err)
+		decoded, err := decodeSpilledEvent(b)
+		require.NoError(t, err)
+		var want, got error
+		switch event := event.(type) {
+		case ErrorEvent:
+			require.Equal(t, event.Type, decoded.(ErrorEvent).Type)
+			want, got = event.Err, decoded.(ErrorEvent).Err
+		case DisconnectedEvent:
+			want, got = event.Err, decoded.(DisconnectedEvent).Err
+		}
+		require.EqualError(t, got, want.Error())
+		require.Equal(t, errors.Is(want, ErrServiceUnreachable), errors.Is(got, ErrServiceUnreachable))
+		require.Equal(t, errors.Is(want, ErrFrameTooLarge), errors.Is(got, ErrFrameTooLarge))
+		var wantFrame, gotFrame FrameError
+		require.Equal(t, errors.As(want, &wantFrame), errors.As(got, &gotFrame))
+		require.Equal(t, wantFrame.ConvID, gotFrame.ConvID)
+		require.Equal(t, wantFrame.Size, gotFrame.Size)
+	}
+	b, err := encodeSpilledEvent(ErrorEvent{Err: frameErr})
+	require.NoError(t, err)
+	decoded, err := decodeSpilledEvent(b)
+	require.NoError(t, err)
+	require.IsType(t, FrameError{}, decoded.(ErrorEvent).Err)
+}
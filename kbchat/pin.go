@@ -0,0 +1,213 @@
+package kbchat
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"sync"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+const (
+	// pinSearchPageSize is the number of messages read at once while looking
+	// for the pin of a conversation.
+	pinSearchPageSize = 100
+	// pinSearchMaxPages bounds the search, so a pin older than the latest
+	// 1000 messages isn't found.
+	pinSearchMaxPages = 10
+)
+
+type pinOptions struct {
+	Channel        chat1.ChatChannel `json:"channel"`
+	ConversationID chat1.ConvIDStr   `json:"conversation_id,omitempty"`
+	MsgID          chat1.MessageID   `json:"message_id,omitempty"`
+}
+
+type pinParams struct {
+	Options pinOptions
+}
+
+type pinArg struct {
+	Method string
+	Params pinParams
+}
+
+func (a *API) pin(ctx context.Context, method string, options pinOptions) (res chat1.PinMessageRes, err error) {
+	bArg, err := json.Marshal(pinArg{
+		Method: method,
+		Params: pinParams{Options: options},
+	})
+	if err != nil {
+		return res, err
+	}
+	err = a.call(ctx, ChatAPIName, bArg, &res)
+	return res, err
+}
+
+// PinByChannel pins a message to the top of a channel, replacing the
+// message pinned before.
+func (a *API) PinByChannel(channel chat1.ChatChannel, msgID chat1.MessageID) (chat1.PinMessageRes, error) {
+	return a.PinByChannelContext(context.Background(), channel, msgID)
+}
+
+func (a *API) PinByChannelContext(ctx context.Context, channel chat1.ChatChannel, msgID chat1.MessageID) (chat1.PinMessageRes, error) {
+	return a.pin(ctx, "pin", pinOptions{Channel: channel, MsgID: msgID})
+}
+
+func (a *API) PinByConvID(convID chat1.ConvIDStr, msgID chat1.MessageID) (chat1.PinMessageRes, error) {
+	return a.PinByConvIDContext(context.Background(), convID, msgID)
+}
+
+func (a *API) PinByConvIDContext(ctx context.Context, convID chat1.ConvIDStr, msgID chat1.MessageID) (chat1.PinMessageRes, error) {
+	return a.pin(ctx, "pin", pinOptions{ConversationID: convID, MsgID: msgID})
+}
+
+func (a *API) UnpinByChannel(channel chat1.ChatChannel) (chat1.PinMessageRes, error) {
+	return a.UnpinByChannelContext(context.Background(), channel)
+}
+
+func (a *API) UnpinByChannelContext(ctx context.Context, channel chat1.ChatChannel) (chat1.PinMessageRes, error) {
+	return a.pin(ctx, "unpin", pinOptions{Channel: channel})
+}
+
+func (a *API) UnpinByConvID(convID chat1.ConvIDStr) (chat1.PinMessageRes, error) {
+	return a.UnpinByConvIDContext(context.Background(), convID)
+}
+
+func (a *API) UnpinByConvIDContext(ctx context.Context, convID chat1.ConvIDStr) (chat1.PinMessageRes, error) {
+	return a.pin(ctx, "unpin", pinOptions{ConversationID: convID})
+}
+
+// PinnedMessage is the message pinned to a conversation.
+type PinnedMessage struct {
+	Message chat1.MsgSummary
+	// PinMsgID is the ID of the pin message, sent by PinnerUsername.
+	PinMsgID       chat1.MessageID
+	PinnerUsername string
+}
+
+// pinContent holds the content of pin messages, which chat1.MsgContent
+// leaves out.
+type pinContent struct {
+	Pin *chat1.MessagePin `json:"pin,omitempty"`
+}
+
+// pinThread is a page of a conversation, decoded for the pin messages.
+type pinThread struct {
+	Messages []struct {
+		Msg *struct {
+			Id      chat1.MessageID `json:"id"`
+			Sender  chat1.MsgSender `json:"sender"`
+			Content pinContent      `json:"content"`
+		} `json:"msg,omitempty"`
+	} `json:"messages"`
+	Pagination *chat1.Pagination `json:"pagination"`
+}
+
+// GetPinnedMessage returns the message pinned to a channel, or nil if there
+// is none among the latest 1000 messages.
+func (a *API) GetPinnedMessage(channel chat1.ChatChannel) (*PinnedMessage, error) {
+	return a.GetPinnedMessageContext(context.Background(), channel)
+}
+
+func (a *API) GetPinnedMessageContext(ctx context.Context, channel chat1.ChatChannel) (*PinnedMessage, error) {
+	return a.getPinnedMessage(ctx, map[string]any{"channel": channel}, func(msgID chat1.MessageID) ([]chat1.Message, error) {
+		return a.GetMessagesContext(ctx, channel, []chat1.MessageID{msgID})
+	})
+}
+
+func (a *API) GetPinnedMessageByConvID(convID chat1.ConvIDStr) (*PinnedMessage, error) {
+	return a.GetPinnedMessageByConvIDContext(context.Background(), convID)
+}
+
+func (a *API) GetPinnedMessageByConvIDContext(ctx context.Context, convID chat1.ConvIDStr) (*PinnedMessage, error) {
+	return a.getPinnedMessage(ctx, map[string]any{"conversation_id": convID}, func(msgID chat1.MessageID) ([]chat1.Message, error) {
+		return a.GetMessagesByConvIDContext(ctx, convID, []chat1.MessageID{msgID})
+	})
+}
+
+// getPinnedMessage looks for the latest pin message, newest first, reading
+// at most pinSearchMaxPages pages. Unpinning deletes it, so the latest one
+// left is the current pin.
+func (a *API) getPinnedMessage(ctx context.Context, conv map[string]any,
+	get func(chat1.MessageID) ([]chat1.Message, error)) (*PinnedMessage, error) {
+	pagination := &chat1.Pagination{Num: pinSearchPageSize}
+	for page := 0; page < pinSearchMaxPages; page++ {
+		var thread pinThread
+		if err := a.peek(ctx, conv, pagination, &thread); err != nil {
+			return nil, err
+		}
+		for _, msg := range thread.Messages {
+			if msg.Msg == nil || msg.Msg.Content.Pin == nil {
+				continue
+			}
+			msgs, err := get(msg.Msg.Content.Pin.MsgID)
+			if err != nil {
+				return nil, err
+			}
+			if len(msgs) == 0 || msgs[0].Msg == nil {
+				return nil, nil
+			}
+			return &PinnedMessage{
+				Message:        *msgs[0].Msg,
+				PinMsgID:       msg.Msg.Id,
+				PinnerUsername: msg.Msg.Sender.Username,
+			}, nil
+		}
+		if thread.Pagination == nil || thread.Pagination.Last || len(thread.Pagination.Next) == 0 {
+			return nil, nil
+		}
+		pagination = &chat1.Pagination{Num: pinSearchPageSize, Next: thread.Pagination.Next}
+	}
+	return nil, nil
+}
+
+// pinnedMsgID returns the message a pin notification pins.
+func pinnedMsgID(line []byte) chat1.MessageID {
+	var notification struct {
+		Msg struct {
+			Content pinContent `json:"content"`
+		} `json:"msg"`
+	}
+	if err := json.Unmarshal(line, &notification); err != nil || notification.Msg.Content.Pin == nil {
+		return 0
+	}
+	return notification.Msg.Content.Pin.MsgID
+}
+
+// pinTracker remembers the pins a listener has seen, to tell unpins from the
+// other deletions.
+type pinTracker struct {
+	sync.Mutex
+	pins map[chat1.ConvIDStr]trackedPin
+}
+
+type trackedPin struct {
+	pinMsgID, pinnedMsgID chat1.MessageID
+}
+
+// track returns an UnpinEvent for the deletion of a pin message seen
+// earlier, and event itself otherwise.
+func (t *pinTracker) track(event Event) Event {
+	t.Lock()
+	defer t.Unlock()
+	switch event := event.(type) {
+	case PinEvent:
+		if t.pins == nil {
+			t.pins = make(map[chat1.ConvIDStr]trackedPin)
+		}
+		t.pins[event.Message.ConvID] = trackedPin{pinMsgID: event.Message.Id, pinnedMsgID: event.PinnedMsgID}
+	case MessageEvent:
+		del := event.Message.Content.Delete
+		if event.Message.Content.TypeName != "delete" || del == nil {
+			break
+		}
+		pin, ok := t.pins[event.Message.ConvID]
+		if ok && slices.Contains(del.MessageIDs, pin.pinMsgID) {
+			delete(t.pins, event.Message.ConvID)
+			return UnpinEvent{SubscriptionMessage: event.SubscriptionMessage, PinnedMsgID: pin.pinnedMsgID}
+		}
+	}
+	return event
+}
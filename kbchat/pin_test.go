@@ -0,0 +1,114 @@
+package kbchat
+
+import (
+	"testing"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/stretchr/testify/require"
+)
+
+// pinMessage is a pin message as the API sends it, with the content that
+// chat1.MsgContent leaves out.
+func pinMessage(id, pinned int) map[string]any {
+	return map[string]any{
+		"id":              id,
+		"conversation_id": "abc",
+		"sender":          chat1.MsgSender{Username: "alice"},
+		"content":         map[string]any{"type": "pin", "pin": chat1.MessagePin{MsgID: chat1.MessageID(pinned)}},
+	}
+}
+
+func TestPinnedMessage(t *testing.T) {
+	var requests []string
+	transport := newFakeTransport(func(req fakeRequest) (any, error) {
+		requests = append(requests, string(req.request))
+		switch req.method {
+		case "pin", "unpin":
+			return map[string]any{"result": chat1.PinMessageRes{}}, nil
+		case "read":
+			return map[string]any{"result": map[string]any{
+				"messages": []map[string]any{
+					{"msg": chatMsg("abc", 6, 0)},
+					{"msg": pinMessage(5, 2)},
+					{"msg": pinMessage(4, 1)},
+				},
+			}}, nil
+		case "get":
+			msg := chatMsg("abc", 2, 0)
+			return map[string]any{"result": map[string]any{"messages": []chat1.Message{{Msg: &msg}}}}, nil
+		default:
+			return nil, nil
+		}
+	})
+	api, err := Start(RunOptions{}, WithTransport(transport))
+	require.NoError(t, err)
+
+	_, err = api.PinByConvID("abc", 2)
+	require.NoError(t, err)
+	_, err = api.UnpinByChannel(chat1.ChatChannel{Name: "team", MembersType: "team", TopicName: "general"})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"Method":"pin","Params":{"Options":{"channel":{"name":""},"conversation_id":"abc","message_id":2}}}`, requests[0])
+	require.JSONEq(t, `{"Method":"unpin","Params":{"Options":{"channel":{"name":"team","members_type":"team","topic_name":"general"}}}}`, requests[1])
+
+	pinned, err := api.GetPinnedMessageByConvID("abc")
+	require.NoError(t, err)
+	require.Equal(t, chat1.MessageID(2), pinned.Message.Id)
+	require.Equal(t, chat1.MessageID(5), pinned.PinMsgID)
+	require.Equal(t, "alice", pinned.PinnerUsername)
+}
+
+func TestPinnedMessageSearchIsBounded(t *testing.T) {
+	transport := newFakeTransport(func(req fakeRequest) (any, error) {
+		// A conversation that never runs out of messages without a pin.
+		return map[string]any{"result": map[string]any{
+			"messages":   []map[string]any{{"msg": chatMsg("abc", 1, 0)}},
+			"pagination": chat1.Pagination{Next: []byte("next"), Num: pinSearchPageSize},
+		}}, nil
+	})
+	api, err := Start(RunOptions{}, WithTransport(transport))
+	require.NoError(t, err)
+
+	pinned, err := api.GetPinnedMessageByConvID("abc")
+	require.NoError(t, err)
+	require.Nil(t, pinned)
+	require.Len(t, transport.sent(), pinSearchMaxPages)
+}
+
+func TestListenPinEvents(t *testing.T) {
+	sub, stream := listenFake(t, ListenOptions{Pins: true})
+	writeEvent(t, stream, map[string]any{"type": "chat", "msg": pinMessage(5, 2)})
+	// Only the deletion of the pin message is an unpin.
+	for _, id := range []int{3, 5} {
+		writeEvent(t, stream, msgNotification(chat1.MsgSummary{
+			Id:      chat1.MessageID(id + 1),
+			ConvID:  "abc",
+			Content: chat1.MsgContent{TypeName: "delete", Delete: &chat1.MessageDelete{MessageIDs: []chat1.MessageID{chat1.MessageID(id)}}},
+		}))
+	}
+
+	next := func() Event {
+		for event := range sub.Events() {
+			if _, ok := event.(ReconnectedEvent); !ok {
+				return event
+			}
+		}
+		return nil
+	}
+	event := next()
+	require.IsType(t, PinEvent{}, event)
+	require.Equal(t, chat1.MessageID(5), event.(PinEvent).Message.Id)
+	require.Equal(t, chat1.MessageID(2), event.(PinEvent).PinnedMsgID)
+	event = next()
+	require.IsType(t, MessageEvent{}, event)
+	event = next()
+	require.IsType(t, UnpinEvent{}, event)
+	require.Equal(t, chat1.MessageID(6), event.(UnpinEvent).Message.Id)
+	require.Equal(t, chat1.MessageID(2), event.(UnpinEvent).PinnedMsgID)
+
+	// Without Pins they are plain messages.
+	plain, stream := listenFake(t, ListenOptions{})
+	writeEvent(t, stream, map[string]any{"type": "chat", "msg": pinMessage(7, 6)})
+	msg, err := plain.Read()
+	require.NoError(t, err)
+	require.Equal(t, "pin", msg.Message.Content.TypeName)
+}
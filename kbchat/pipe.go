@@ -0,0 +1,382 @@
+package kbchat
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	minPipeRestartBackoff = 250 * time.Millisecond
+	maxPipeRestartBackoff = 30 * time.Second
+	// maxPipeAttempts bounds how often a retryable request is replayed after
+	// the pipe carrying it broke.
+	maxPipeAttempts = 3
+)
+
+// retryableMethods are the chat API methods that only read state, so they
+// can safely be replayed on another pipe if the one carrying them dies.
+var retryableMethods = map[string]bool{
+	"list":            true,
+	"read":            true,
+	"get":             true,
+	"listconvsonname": true,
+	"listcommands":    true,
+	"listmembers":     true,
+}
+
+type apiPipe struct {
+	// bulk is set for pipes reserved for bulk operations.
+	bulk bool
+	// inPool is set while the pipe sits on its dispatcher's free list, and
+	// is guarded by the dispatcher.
+	inPool bool
+	// lockCh is a one slot semaphore guarding the pipe, so that waiting for
+	// it can be abandoned when a request's context is done.
+	lockCh chan struct{}
+	input  io.WriteCloser
+	output *bufio.Reader
+	// cmdMu guards cmd, which is also touched by kill while the pipe is
+	// locked by a stuck request.
+	cmdMu   sync.Mutex
+	cmd     *exec.Cmd
+	exit    *pipeExit
+	healthy atomic.Bool
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+
+	statsMu   sync.Mutex
+	busySince time.Time
+	busyTime  time.Duration
+	requests  int64
+}
+
+// pipeExit records how a pipe's process ended. done is closed once the
+// process has exited, after which err is set. output is the read end of the
+// process's stdout, which stays open after it exits so that a response
+// written just before can still be read.
+type pipeExit struct {
+	done   chan struct{}
+	err    error
+	output *os.File
+}
+
+func newAPIPipe(bulk bool) *apiPipe {
+	return &apiPipe{
+		bulk:   bulk,
+		lockCh: make(chan struct{}, 1),
+		stopCh: make(chan struct{}),
+	}
+}
+
+func (p *apiPipe) lock(ctx context.Context) error {
+	select {
+	case p.lockCh <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *apiPipe) unlock() {
+	<-p.lockCh
+}
+
+func (p *apiPipe) markBusy() {
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
+	p.busySince = time.Now()
+	p.requests++
+}
+
+func (p *apiPipe) markIdle() {
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
+	p.busyTime += time.Since(p.busySince)
+	p.busySince = time.Time{}
+}
+
+func (p *apiPipe) stats() PipeStats {
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
+	stats := PipeStats{
+		Bulk:     p.bulk,
+		Healthy:  p.healthy.Load(),
+		Busy:     !p.busySince.IsZero(),
+		BusyTime: p.busyTime,
+		Requests: p.requests,
+	}
+	if stats.Busy {
+		stats.BusyTime += time.Since(p.busySince)
+	}
+	return stats
+}
+
+// start launches a fresh `keybase chat api` process for the pipe.
+func (p *apiPipe) start(runOpts RunOptions) (err error) {
+	cmd := runOpts.Command("chat", "api")
+	input, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("unable to get api stdin: %v", err)
+	}
+	// StdoutPipe would be closed by Wait while responses may still be
+	// unread, so the pipe is owned here and closed once it is replaced.
+	output, stdout, err := os.Pipe()
+	if err != nil {
+		input.Close()
+		return fmt.Errorf("unable to get api stdout: %v", err)
+	}
+	cmd.Stdout = stdout
+	if runtime.GOOS != "windows" {
+		cmd.ExtraFiles = []*os.File{output}
+	}
+	err = cmd.Start()
+	stdout.Close()
+	if err != nil {
+		input.Close()
+		output.Close()
+		return fmt.Errorf("unable to run chat api cmd: %v", err)
+	}
+	exit := &pipeExit{done: make(chan struct{}), output: output}
+	go func() {
+		exit.err = cmd.Wait()
+		close(exit.done)
+	}()
+	p.closeOutput()
+	p.cmdMu.Lock()
+	p.cmd = cmd
+	p.cmdMu.Unlock()
+	p.input = input
+	p.output = bufio.NewReader(output)
+	p.exit = exit
+	p.healthy.Store(true)
+	return nil
+}
+
+// closeOutput closes the stdout of the pipe's last process, which must have
+// exited, with the pipe locked.
+func (p *apiPipe) closeOutput() {
+	if p.exit != nil {
+		p.exit.output.Close()
+	}
+}
+
+// kill terminates the pipe's process without waiting for it to exit. Unless
+// the pipe is stopped, its supervisor will start a replacement.
+func (p *apiPipe) kill() error {
+	p.healthy.Store(false)
+	p.cmdMu.Lock()
+	defer p.cmdMu.Unlock()
+	if p.cmd == nil || p.cmd.Process == nil {
+		return nil
+	}
+	if err := p.cmd.Process.Kill(); err != nil && err != os.ErrProcessDone {
+		return err
+	}
+	return nil
+}
+
+// stopSupervision keeps the pipe's process from being respawned once it
+// exits.
+func (p *apiPipe) stopSupervision() {
+	p.stopOnce.Do(func() { close(p.stopCh) })
+}
+
+// stop ends supervision of the pipe and kills its process for good.
+func (p *apiPipe) stop() error {
+	p.stopSupervision()
+	return p.kill()
+}
+
+// shutdown stops supervising the pipe and closes its stdin, so its process
+// exits on its own. The process is killed if it is still running after the
+// grace period, or once ctx is done.
+func (p *apiPipe) shutdown(ctx context.Context, grace time.Duration) error {
+	p.stopSupervision()
+	if err := p.lock(ctx); err != nil {
+		// A request is still stuck on the pipe.
+		return p.kill()
+	}
+	defer p.unlock()
+	exit := p.exit
+	if exit == nil || !p.healthy.Load() {
+		return nil
+	}
+	p.healthy.Store(false)
+	if err := p.input.Close(); err != nil {
+		return p.kill()
+	}
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-exit.done:
+		p.closeOutput()
+		return exit.err
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	if err := p.kill(); err != nil {
+		return err
+	}
+	<-exit.done
+	p.closeOutput()
+	return nil
+}
+
+// supervise watches a running pipe and respawns its process with exponential
+// backoff whenever it exits, until the pipe is stopped.
+func (t *ExecTransport) supervise(pipe *apiPipe) {
+	backoff := minPipeRestartBackoff
+	exit := pipe.exit
+	for {
+		select {
+		case <-exit.done:
+		case <-pipe.stopCh:
+			return
+		}
+		pipe.healthy.Store(false)
+		t.Debug("supervise: API command exited: %v", exit.err)
+		for {
+			select {
+			case <-time.After(backoff):
+			case <-pipe.stopCh:
+				return
+			}
+			backoff = min(2*backoff, maxPipeRestartBackoff)
+			if err := pipe.lock(context.Background()); err != nil {
+				return
+			}
+			select {
+			case <-pipe.stopCh:
+				pipe.unlock()
+				return
+			default:
+			}
+			err := pipe.start(t.runOpts)
+			pipe.unlock()
+			if err != nil {
+				t.Debug("supervise: unable to restart API command: %v", err)
+				continue
+			}
+			t.Debug("supervise: restarted API command")
+			t.releasePipe(pipe)
+			backoff = minPipeRestartBackoff
+			exit = pipe.exit
+			break
+		}
+	}
+}
+
+type pipeResult struct {
+	output []byte
+	err    error
+}
+
+// apiMethod extracts the method name from a chat API request.
+func apiMethod(input []byte) string {
+	var req struct {
+		Method string
+	}
+	if err := json.Unmarshal(input, &req); err != nil {
+		return ""
+	}
+	return req.Method
+}
+
+// roundTrip sends a request to the chat API on the next free pipe. Requests
+// that only read state are transparently replayed if the pipe carrying them
+// breaks.
+func (t *ExecTransport) roundTrip(ctx context.Context, input []byte) (output []byte, err error) {
+	method := apiMethod(input)
+	attempts := 1
+	if retryableMethods[method] {
+		attempts = maxPipeAttempts
+	}
+	pool := t.pipePool(method)
+	backoff := minPipeRestartBackoff
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			t.Debug("roundTrip: retrying after broken pipe: %v", err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			backoff *= 2
+		}
+		pipe, aerr := pool.acquire(ctx)
+		if aerr != nil {
+			return nil, aerr
+		}
+		var broken bool
+		output, broken, err = t.pipeRoundTrip(ctx, pipe, input)
+		if !broken {
+			return output, err
+		}
+	}
+	return nil, err
+}
+
+// pipeRoundTrip writes a single request to an acquired pipe and reads back
+// the response line, then hands the pipe back to its dispatcher. broken
+// reports whether the pipe failed underneath the request, in which case its
+// process is killed so it gets replaced. If ctx is done before the response
+// arrives the process is killed as well, since its output stream can no
+// longer be matched up with requests.
+func (t *ExecTransport) pipeRoundTrip(ctx context.Context, pipe *apiPipe, input []byte) (output []byte, broken bool, err error) {
+	if err := pipe.lock(ctx); err != nil {
+		t.releasePipe(pipe)
+		return nil, false, err
+	}
+	done := func() {
+		pipe.unlock()
+		t.releasePipe(pipe)
+	}
+	if !pipe.healthy.Load() {
+		done()
+		return nil, true, errAPIDisconnected
+	}
+
+	pipe.markBusy()
+	resCh := make(chan pipeResult, 1)
+	go func() {
+		defer pipe.markIdle()
+		if _, err := pipe.input.Write(input); err != nil {
+			resCh <- pipeResult{err: err}
+			return
+		}
+		output, err := pipe.output.ReadBytes('\n')
+		resCh <- pipeResult{output: output, err: err}
+	}()
+
+	select {
+	case res := <-resCh:
+		if res.err != nil {
+			t.Debug("pipeRoundTrip: API pipe broke: %v", res.err)
+			if err := pipe.kill(); err != nil {
+				t.Debug("pipeRoundTrip: unable to kill broken API command: %v", err)
+			}
+		}
+		done()
+		return res.output, res.err != nil, res.err
+	case <-ctx.Done():
+		go func() {
+			defer done()
+			t.Debug("pipeRoundTrip: killing stuck API command")
+			if err := pipe.kill(); err != nil {
+				t.Debug("pipeRoundTrip: unable to kill stuck API command: %v", err)
+			}
+			<-resCh
+		}()
+		return nil, false, ctx.Err()
+	}
+}
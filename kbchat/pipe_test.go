@@ -0,0 +1,70 @@
+package kbchat
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeKeybase writes a shell script standing in for the keybase binary, so
+// the pipe plumbing can be exercised without a running service.
+func fakeKeybase(t *testing.T, script string) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake keybase binary requires a POSIX shell")
+	}
+	location := filepath.Join(t.TempDir(), "keybase")
+	err := os.WriteFile(location, []byte("#!/bin/sh\n"+script+"\n"), 0o700) //nolint:gosec // G306: test script must be executable
+	require.NoError(t, err)
+	return location
+}
+
+// fakeKeybaseAPI returns an API whose ExecTransport runs script for every
+// keybase command. No pipes are started.
+func fakeKeybaseAPI(t *testing.T, script string) (*API, *ExecTransport) {
+	runOpts := RunOptions{KeybaseLocation: fakeKeybase(t, script)}
+	transport := NewExecTransport(runOpts)
+	return NewAPI(runOpts, WithTransport(transport)), transport
+}
+
+func TestContextCancelsStuckPipe(t *testing.T) {
+	api, transport := fakeKeybaseAPI(t, "exec sleep 60")
+	pipe := newAPIPipe(false)
+	require.NoError(t, pipe.start(transport.runOpts))
+	go transport.supervise(pipe)
+	transport.pool.replace([]*apiPipe{pipe})
+	defer func() { require.NoError(t, pipe.stop()) }()
+	stuckExit := pipe.exit
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := api.SendMessageByConvIDContext(ctx, "convid", "hi")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// The stuck process is killed and the supervisor starts a replacement.
+	<-stuckExit.done
+	require.Eventually(t, pipe.healthy.Load, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSupervisorRetriesReads(t *testing.T) {
+	// Every chat api process answers one request and then dies.
+	api, transport := fakeKeybaseAPI(t,
+		`head -c 1 >/dev/null; echo '{"result":{"conversations":[{"id":"abc"}]}}'`)
+	pipe := newAPIPipe(false)
+	require.NoError(t, pipe.start(transport.runOpts))
+	go transport.supervise(pipe)
+	transport.pool.replace([]*apiPipe{pipe})
+	defer func() { require.NoError(t, pipe.stop()) }()
+
+	for range 3 {
+		convs, err := api.GetConversations(false)
+		require.NoError(t, err)
+		require.Len(t, convs, 1)
+		require.Equal(t, chat1.ConvIDStr("abc"), convs[0].Id)
+	}
+}
@@ -0,0 +1,150 @@
+package kbchat
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+// DefaultRateLimitThreshold is the fraction of a rate limit tank's capacity
+// below which outgoing chat calls are slowed down.
+const DefaultRateLimitThreshold = 0.1
+
+// RateLimit is the last known state of one of the service's rate limit
+// tanks.
+type RateLimit struct {
+	Tank     string
+	Capacity int
+	// Gas is what is left of the tank's capacity.
+	Gas int
+	// ResetAt is when the tank is refilled to its full capacity.
+	ResetAt time.Time
+}
+
+// rateLimiter tracks the rate limit tanks reported in chat API responses and
+// paces outgoing calls so tanks running low last until they are refilled.
+type rateLimiter struct {
+	sync.Mutex
+	threshold float64
+	tanks     map[string]RateLimit
+	// slots is when the last call reserved against each low tank may go out.
+	slots map[string]time.Time
+}
+
+func newRateLimiter(threshold float64) *rateLimiter {
+	return &rateLimiter{
+		threshold: threshold,
+		tanks:     make(map[string]RateLimit),
+		slots:     make(map[string]time.Time),
+	}
+}
+
+// RateLimitThreshold sets the fraction of a rate limit tank's capacity below
+// which outgoing chat calls are delayed. Zero disables throttling, although
+// the tanks are still tracked.
+func RateLimitThreshold(threshold float64) func(*API) {
+	return func(a *API) {
+		a.rateLimits = newRateLimiter(threshold)
+	}
+}
+
+// observe records the rate limits carried by a raw API response, if any.
+func (r *rateLimiter) observe(raw []byte) {
+	var resp struct {
+		Result struct {
+			RateLimits []chat1.RateLimitRes `json:"ratelimits"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(raw, &resp); err != nil || len(resp.Result.RateLimits) == 0 {
+		return
+	}
+	now := time.Now()
+	r.Lock()
+	defer r.Unlock()
+	for _, limit := range resp.Result.RateLimits {
+		r.tanks[limit.Tank] = RateLimit{
+			Tank:     limit.Tank,
+			Capacity: limit.Capacity,
+			Gas:      limit.Gas,
+			ResetAt:  now.Add(time.Duration(limit.Reset) * time.Second),
+		}
+	}
+}
+
+// snapshot returns the known tanks, sorted by name.
+func (r *rateLimiter) snapshot() []RateLimit {
+	now := time.Now()
+	r.Lock()
+	defer r.Unlock()
+	limits := make([]RateLimit, 0, len(r.tanks))
+	for _, limit := range r.tanks {
+		if !now.Before(limit.ResetAt) {
+			limit.Gas = limit.Capacity
+		}
+		limits = append(limits, limit)
+	}
+	sort.Slice(limits, func(i, j int) bool { return limits[i].Tank < limits[j].Tank })
+	return limits
+}
+
+// reserve books the next call's slot and reports how long the call should
+// wait for it. An empty tank holds calls until it is refilled, and a tank
+// below the threshold spreads its remaining gas evenly over the time left
+// until then. Slots are handed out one after the other, so concurrent calls
+// are paced rather than all sent after the same delay.
+func (r *rateLimiter) reserve() time.Duration {
+	if r.threshold <= 0 {
+		return 0
+	}
+	now := time.Now()
+	r.Lock()
+	defer r.Unlock()
+	at := now
+	for tank, limit := range r.tanks {
+		untilReset := limit.ResetAt.Sub(now)
+		if untilReset <= 0 || float64(limit.Gas) >= r.threshold*float64(limit.Capacity) {
+			delete(r.slots, tank)
+			continue
+		}
+		if limit.Gas <= 0 {
+			at = maxTime(at, limit.ResetAt)
+			continue
+		}
+		slot := maxTime(now, r.slots[tank]).Add(untilReset / time.Duration(limit.Gas))
+		r.slots[tank] = slot
+		at = maxTime(at, slot)
+	}
+	return at.Sub(now)
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// wait blocks until the next call may go out, or ctx is done.
+func (r *rateLimiter) wait(ctx context.Context) error {
+	delay := r.reserve()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// RateLimits returns the last known state of the service's rate limit tanks.
+func (a *API) RateLimits() []RateLimit {
+	return a.rateLimits.snapshot()
+}
@@ -0,0 +1,88 @@
+package kbchat
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimitsTracked(t *testing.T) {
+	transport := newFakeTransport(func(req fakeRequest) (any, error) {
+		return map[string]any{"result": chat1.SendRes{
+			Message: "message sent",
+			RateLimits: []chat1.RateLimitRes{
+				{Tank: "chat", Capacity: 100, Gas: 90, Reset: 60},
+				{Tank: "bots", Capacity: 10, Gas: 10, Reset: 60},
+			},
+		}}, nil
+	})
+	api, err := Start(RunOptions{}, WithTransport(transport))
+	require.NoError(t, err)
+	require.Empty(t, api.RateLimits())
+
+	_, err = api.SendMessageByConvID("abc", "hi")
+	require.NoError(t, err)
+	limits := api.RateLimits()
+	require.Len(t, limits, 2)
+	require.Equal(t, "bots", limits[0].Tank)
+	require.Equal(t, "chat", limits[1].Tank)
+	require.Equal(t, 100, limits[1].Capacity)
+	require.Equal(t, 90, limits[1].Gas)
+	require.WithinDuration(t, time.Now().Add(time.Minute), limits[1].ResetAt, 5*time.Second)
+
+	// Healthy tanks don't hold up calls.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = api.SendMessageByConvIDContext(ctx, "abc", "hi")
+	require.NoError(t, err)
+}
+
+func TestRateLimitsThrottle(t *testing.T) {
+	transport := newFakeTransport(func(req fakeRequest) (any, error) {
+		return map[string]any{"result": chat1.SendRes{
+			Message:    "message sent",
+			RateLimits: []chat1.RateLimitRes{{Tank: "chat", Capacity: 100, Gas: 0, Reset: 60}},
+		}}, nil
+	})
+	api, err := Start(RunOptions{}, WithTransport(transport))
+	require.NoError(t, err)
+	_, err = api.SendMessageByConvID("abc", "hi")
+	require.NoError(t, err)
+
+	// The tank is empty, so the next call waits for it to be refilled.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = api.SendMessageByConvIDContext(ctx, "abc", "hi")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Len(t, transport.sent(), 1)
+
+	// Unless throttling is disabled.
+	api, err = Start(RunOptions{}, WithTransport(transport), RateLimitThreshold(0))
+	require.NoError(t, err)
+	_, err = api.SendMessageByConvID("abc", "hi")
+	require.NoError(t, err)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = api.SendMessageByConvIDContext(ctx, "abc", "hi")
+	require.NoError(t, err)
+}
+
+func TestRateLimiterReserve(t *testing.T) {
+	r := newRateLimiter(0.5)
+	r.tanks["chat"] = RateLimit{Tank: "chat", Capacity: 10, Gas: 8, ResetAt: time.Now().Add(10 * time.Second)}
+	require.Zero(t, r.reserve())
+
+	// Below the threshold the remaining gas is spread until the reset, one
+	// slot after the other.
+	r.tanks["chat"] = RateLimit{Tank: "chat", Capacity: 10, Gas: 4, ResetAt: time.Now().Add(10 * time.Second)}
+	require.InDelta(t, 2500*time.Millisecond, r.reserve(), float64(100*time.Millisecond))
+	require.InDelta(t, 5000*time.Millisecond, r.reserve(), float64(100*time.Millisecond))
+
+	// Tanks past their reset are full again.
+	r.tanks["chat"] = RateLimit{Tank: "chat", Capacity: 10, Gas: 0, ResetAt: time.Now().Add(-time.Second)}
+	require.Zero(t, r.reserve())
+	require.Equal(t, 10, r.snapshot()[0].Gas)
+}
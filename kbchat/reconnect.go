@@ -0,0 +1,87 @@
+package kbchat
+
+import (
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// ReconnectPolicy controls how Listen retries when it can't authenticate or
+// its listener goes away.
+type ReconnectPolicy struct {
+	// InitialBackoff is the pause after the first failed attempt.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the pause between attempts.
+	MaxBackoff time.Duration
+	// Multiplier grows the pause after every further failed attempt. Values
+	// below 1 keep it constant.
+	Multiplier float64
+	// Jitter randomizes every pause by up to that fraction of it, so bots
+	// sharing a service don't all reconnect at once.
+	Jitter float64
+	// MaxAttempts is the number of consecutive failed attempts after which
+	// Listen gives up. Zero retries forever.
+	MaxAttempts int
+}
+
+// DefaultReconnectPolicy is used when ListenOptions has no ReconnectPolicy.
+// It retries every two seconds and gives up after 30 attempts.
+var DefaultReconnectPolicy = ReconnectPolicy{
+	InitialBackoff: 2 * time.Second,
+	MaxBackoff:     2 * time.Second,
+	Multiplier:     1,
+	MaxAttempts:    30,
+}
+
+// backoff returns the pause after the given number of consecutive failed
+// attempts.
+func (p ReconnectPolicy) backoff(attempts int) time.Duration {
+	d := float64(p.InitialBackoff)
+	if p.Multiplier > 1 {
+		d *= math.Pow(p.Multiplier, float64(attempts-1))
+	}
+	if p.MaxBackoff > 0 {
+		d = min(d, float64(p.MaxBackoff))
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1) //nolint:gosec // G404: jitter doesn't need a secure random source
+	}
+	return time.Duration(max(d, 0))
+}
+
+// ConnectionState describes the state of a Subscription's listener.
+type ConnectionState int
+
+const (
+	// ConnectionConnected is reported whenever the listener (re)starts.
+	ConnectionConnected ConnectionState = iota
+	// ConnectionDisconnected is reported for every failed attempt and when
+	// the listener goes away. Listen retries after RetryIn.
+	ConnectionDisconnected
+	// ConnectionGaveUp is reported once Listen exhausted its
+	// ReconnectPolicy. The Subscription is shut down afterwards.
+	ConnectionGaveUp
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case ConnectionConnected:
+		return "connected"
+	case ConnectionDisconnected:
+		return "disconnected"
+	case ConnectionGaveUp:
+		return "gave up"
+	default:
+		return "unknown"
+	}
+}
+
+// SubscriptionConnectionEvent reports a change in a Subscription's
+// connection to the service.
+type SubscriptionConnectionEvent struct {
+	State ConnectionState
+	// Attempts is the number of consecutive failed attempts so far.
+	Attempts int
+	Err      error
+	RetryIn  time.Duration
+}
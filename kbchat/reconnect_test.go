@@ -0,0 +1,94 @@
+package kbchat
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenGivesUpWithoutPanicking(t *testing.T) {
+	transport := newFakeTransport(func(req fakeRequest) (any, error) {
+		return nil, errors.New("unexpected request")
+	})
+	listenErr := errors.New("service down")
+	transport.listenErr = listenErr
+	api := NewAPI(RunOptions{}, WithTransport(transport))
+
+	gaveUp := make(chan error, 1)
+	sub, err := api.Listen(ListenOptions{
+		ReconnectPolicy: &ReconnectPolicy{InitialBackoff: time.Millisecond, MaxAttempts: 3},
+		OnGiveUp:        func(err error) { gaveUp <- err },
+	})
+	require.NoError(t, err)
+
+	require.ErrorIs(t, <-gaveUp, listenErr)
+	var events []DisconnectedEvent
+	for event := range sub.Events() {
+		events = append(events, event.(DisconnectedEvent))
+	}
+	require.Len(t, events, 3)
+	for i, event := range events {
+		require.Equal(t, i+1, event.Attempts)
+		require.ErrorIs(t, event.Err, listenErr)
+		require.Equal(t, i == 2, event.GaveUp)
+	}
+	require.Equal(t, time.Millisecond, events[0].RetryIn)
+}
+
+func TestListenReconnects(t *testing.T) {
+	transport := newFakeTransport(func(req fakeRequest) (any, error) {
+		return nil, errors.New("unexpected request")
+	})
+	api := NewAPI(RunOptions{}, WithTransport(transport))
+	sub, err := api.Listen(ListenOptions{
+		ReconnectPolicy: &ReconnectPolicy{InitialBackoff: time.Millisecond},
+	})
+	require.NoError(t, err)
+	defer sub.Shutdown()
+
+	event, err := sub.ReadConnection()
+	require.NoError(t, err)
+	require.Equal(t, ConnectionConnected, event.State)
+
+	// The listener goes away, and Listen starts a new one.
+	require.NoError(t, (<-transport.streams).Close())
+	event, err = sub.ReadConnection()
+	require.NoError(t, err)
+	require.Equal(t, ConnectionDisconnected, event.State)
+	require.Equal(t, 1, event.Attempts)
+	event, err = sub.ReadConnection()
+	require.NoError(t, err)
+	require.Equal(t, ConnectionConnected, event.State)
+
+	writeEvent(t, <-transport.streams, chat1.MsgNotification{
+		Type: "chat",
+		Msg:  &chat1.MsgSummary{Id: 1, ConvID: "abc"},
+	})
+	msg, err := sub.Read()
+	require.NoError(t, err)
+	require.Equal(t, chat1.ConvIDStr("abc"), msg.Message.ConvID)
+}
+
+func TestReconnectPolicyBackoff(t *testing.T) {
+	policy := ReconnectPolicy{
+		InitialBackoff: time.Second,
+		MaxBackoff:     5 * time.Second,
+		Multiplier:     2,
+	}
+	require.Equal(t, time.Second, policy.backoff(1))
+	require.Equal(t, 2*time.Second, policy.backoff(2))
+	require.Equal(t, 4*time.Second, policy.backoff(3))
+	require.Equal(t, 5*time.Second, policy.backoff(4))
+
+	policy.Jitter = 0.5
+	for range 100 {
+		d := policy.backoff(1)
+		require.GreaterOrEqual(t, d, 500*time.Millisecond)
+		require.LessOrEqual(t, d, 1500*time.Millisecond)
+	}
+
+	require.Equal(t, 2*time.Second, DefaultReconnectPolicy.backoff(10))
+}
@@ -0,0 +1,284 @@
+package kbchat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRecordMaxSize    = 100 * 1024 * 1024
+	defaultRecordMaxBackups = 3
+)
+
+// RecordOptions configures the recording of a listener's raw notifications.
+type RecordOptions struct {
+	// Path is the file notifications are appended to, one JSON record per
+	// line.
+	Path string
+	// MaxSize is the size the file grows to before it is rotated, 100MB by
+	// default. Rotated files are named Path.1, Path.2 and so on, newest
+	// first.
+	MaxSize int64
+	// MaxBackups is the number of rotated files kept, three by default.
+	MaxBackups int
+}
+
+// recordedFrame is a line of a recording.
+type recordedFrame struct {
+	At    time.Time `json:"at"`
+	Frame string    `json:"frame"`
+}
+
+// recorder appends the notifications read by a listener to a rotating file.
+// Listeners recording to the same path share a recorder, which the mutex
+// guards.
+type recorder struct {
+	sync.Mutex
+	opts RecordOptions
+	f    *os.File
+	size int64
+	// key is the recorder's entry in API.recorders, and refs the number of
+	// listeners using it.
+	key  string
+	refs int
+}
+
+func newRecorder(opts RecordOptions) (*recorder, error) {
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = defaultRecordMaxSize
+	}
+	if opts.MaxBackups <= 0 {
+		opts.MaxBackups = defaultRecordMaxBackups
+	}
+	r := &recorder{opts: opts}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *recorder) open() error {
+	f, err := os.OpenFile(r.opts.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open recording: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("unable to open recording: %w", err)
+	}
+	r.f = f
+	r.size = info.Size()
+	return nil
+}
+
+// record appends a notification read at the given time.
+func (r *recorder) record(at time.Time, frame []byte) error {
+	r.Lock()
+	defer r.Unlock()
+	b, err := json.Marshal(recordedFrame{At: at, Frame: string(frame)})
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if r.size > 0 && r.size+int64(len(b)) > r.opts.MaxSize {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := r.f.Write(b)
+	r.size += int64(n)
+	return err
+}
+
+// rotate moves the file out of the way, dropping the oldest backup, and
+// starts a new one. The file is only swapped once the new one is open, so
+// recording carries on in the old one if rotating fails.
+func (r *recorder) rotate() error {
+	for i := r.opts.MaxBackups; i > 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", r.opts.Path, i-1), fmt.Sprintf("%s.%d", r.opts.Path, i))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("unable to rotate recording: %w", err)
+		}
+	}
+	if err := os.Rename(r.opts.Path, r.opts.Path+".1"); err != nil {
+		return fmt.Errorf("unable to rotate recording: %w", err)
+	}
+	old := r.f
+	if err := r.open(); err != nil {
+		// Move the old file back, so it is still the one being recorded to.
+		if rerr := os.Rename(r.opts.Path+".1", r.opts.Path); rerr != nil {
+			return errors.Join(err, fmt.Errorf("unable to restore recording: %w", rerr))
+		}
+		return err
+	}
+	return old.Close()
+}
+
+func (r *recorder) close() error {
+	r.Lock()
+	defer r.Unlock()
+	return r.f.Close()
+}
+
+// openRecorderLocked returns the recorder for the path in opts, opening it
+// unless another listener already records there, in which case its options
+// win. a.Lock must be held.
+func (a *API) openRecorderLocked(opts RecordOptions) (*recorder, error) {
+	key, err := filepath.Abs(opts.Path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open recording: %w", err)
+	}
+	if r, ok := a.recorders[key]; ok {
+		r.refs++
+		return r, nil
+	}
+	r, err := newRecorder(opts)
+	if err != nil {
+		return nil, err
+	}
+	r.key = key
+	r.refs = 1
+	if a.recorders == nil {
+		a.recorders = make(map[string]*recorder)
+	}
+	a.recorders[key] = r
+	return r, nil
+}
+
+// closeRecorder lets go of a recorder, closing it once no listener uses it.
+func (a *API) closeRecorder(r *recorder) error {
+	a.Lock()
+	r.refs--
+	last := r.refs == 0
+	if last {
+		delete(a.recorders, r.key)
+	}
+	a.Unlock()
+	if !last {
+		return nil
+	}
+	return r.close()
+}
+
+// ReplayOptions configures ReplaySubscription.
+type ReplayOptions struct {
+	// Speed scales the pace of the recording: 1 replays it at the original
+	// pace, 10 ten times as fast. With 0 there is no delay at all.
+	Speed float64
+	// Listen holds the options the subscription applies to the recorded
+	// notifications, such as Typing, ConvIDs and Filter. The ones handed to
+	// api-listen, and Resume, don't apply.
+	Listen ListenOptions
+}
+
+// ReplaySubscription feeds a recording made with ListenOptions.Record to a
+// Subscription, decoding it the way Listen does, so handlers see the exact
+// notifications the listener saw. The subscription shuts down once the
+// recording has been delivered.
+func ReplaySubscription(path string, opts ReplayOptions) (*Subscription, error) {
+	return ReplaySubscriptionContext(context.Background(), path, opts)
+}
+
+// ReplaySubscriptionContext is like ReplaySubscription, but the returned
+// Subscription is shut down once ctx is done.
+func ReplaySubscriptionContext(ctx context.Context, path string, opts ReplayOptions) (*Subscription, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open recording: %w", err)
+	}
+	a := &API{DebugOutput: NewDebugOutput("Replay")}
+	listenOpts := opts.Listen
+	listenOpts.Resume = nil
+	sub := newSubscription(listenOpts)
+	s := newSubscriber(a, sub, listenOpts)
+	pumpDone := make(chan struct{})
+	if sub.spill != nil {
+		go func() {
+			defer close(pumpDone)
+			sub.spill.pump(sub.shutdownCh)
+		}()
+	}
+	replayDone := make(chan struct{})
+	go func() {
+		defer close(replayDone)
+		defer f.Close()
+		var pins pinTracker
+		decode := func(line []byte) Event {
+			if event := a.decodeEvent(line); event != nil {
+				return pins.track(event)
+			}
+			return nil
+		}
+		// Nothing else delivers to the subscription, so the replay
+		// waits for it to read rather than queueing the recording.
+		deliver := func(event Event) { s.process(event) }
+		if err := replay(f, opts.Speed, sub.shutdownCh, deliver, decode); err != nil {
+			a.Debug("Replay: %v", err)
+			deliver(ErrorEvent{Err: err})
+		}
+		sub.Shutdown()
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			sub.Shutdown()
+		case <-sub.shutdownCh:
+		}
+		<-replayDone
+		s.cancel()
+		if sub.spill != nil {
+			<-pumpDone
+			sub.spill.close()
+		}
+		close(sub.eventsCh)
+		close(sub.stoppedCh)
+	}()
+	return sub, nil
+}
+
+// replay decodes and delivers the notifications of a recording, waiting
+// between them as long as the listener did, divided by speed.
+func replay(r io.Reader, speed float64, stop <-chan struct{}, deliver func(Event), decode func([]byte) Event) error {
+	// Escaping makes recorded notifications larger than the listener's.
+	frames := newFrameReader(r, math.MaxInt)
+	var last time.Time
+	for {
+		line, err := frames.next()
+		switch {
+		case errors.Is(err, io.EOF):
+			return nil
+		case err != nil:
+			return fmt.Errorf("unable to read recording: %w", err)
+		case len(line) == 0:
+			continue
+		}
+		var rec recordedFrame
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return fmt.Errorf("unable to read recording: %w", err)
+		}
+		var wait <-chan time.Time
+		if speed > 0 && !last.IsZero() && rec.At.After(last) {
+			wait = time.After(time.Duration(float64(rec.At.Sub(last)) / speed))
+		} else {
+			wait = time.After(0)
+		}
+		select {
+		case <-wait:
+		case <-stop:
+			return nil
+		}
+		last = rec.At
+		if event := decode([]byte(rec.Frame)); event != nil {
+			deliver(event)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package kbchat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/stretchr/testify/require"
+)
+
+// describeEvents reads the messages, typing and error events of sub, until
+// it has read n of them or sub shuts down.
+func describeEvents(sub *Subscription, n int) (got []string) {
+	for event := range sub.Events() {
+		switch event := event.(type) {
+		case MessageEvent:
+			got = append(got, fmt.Sprintf("message %s/%d", event.Message.ConvID, event.Message.Id))
+		case TypingEvent:
+			got = append(got, fmt.Sprintf("typing %s %s", event.ConvID, event.Typers[0].Username))
+		case ErrorEvent:
+			got = append(got, "error")
+		}
+		if len(got) == n {
+			break
+		}
+	}
+	return got
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "listen.jsonl")
+	sub, stream := listenFake(t, ListenOptions{Typing: true, Record: &RecordOptions{Path: path}})
+	writeEvent(t, stream, msgNotification(chat1.MsgSummary{Id: 1, ConvID: "abc"}))
+	writeEvent(t, stream, TypingNotification{Type: "typing", ConvID: "abc", Typers: []chat1.TyperInfo{{Username: "alice"}}})
+	_, err := fmt.Fprintln(stream, "not json")
+	require.NoError(t, err)
+	writeEvent(t, stream, msgNotification(chat1.MsgSummary{Id: 2, ConvID: "def"}))
+	want := []string{"message abc/1", "typing abc alice", "error", "message def/2"}
+	require.Equal(t, want, describeEvents(sub, len(want)))
+	sub.Shutdown()
+
+	replayed, err := ReplaySubscription(path, ReplayOptions{Listen: ListenOptions{Typing: true}})
+	require.NoError(t, err)
+	require.Equal(t, want, describeEvents(replayed, -1))
+
+	// The subscription's own filters apply to the recording.
+	replayed, err = ReplaySubscription(path, ReplayOptions{Listen: ListenOptions{ConvIDs: []chat1.ConvIDStr{"def"}}})
+	require.NoError(t, err)
+	require.Equal(t, []string{"error", "message def/2"}, describeEvents(replayed, -1))
+}
+
+func TestReplaySpeed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "listen.jsonl")
+	start := time.Now()
+	var lines []string
+	for i, at := range []time.Time{start, start.Add(400 * time.Millisecond)} {
+		frame, err := json.Marshal(msgNotification(chat1.MsgSummary{Id: chat1.MessageID(i + 1), ConvID: "abc"}))
+		require.NoError(t, err)
+		line, err := json.Marshal(recordedFrame{At: at, Frame: string(frame)})
+		require.NoError(t, err)
+		lines = append(lines, string(line))
+	}
+	require.NoError(t, os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600))
+
+	replayStart := time.Now()
+	sub, err := ReplaySubscription(path, ReplayOptions{Speed: 4})
+	require.NoError(t, err)
+	require.Equal(t, []string{"abc/1", "abc/2"}, readMsgs(t, sub, 2))
+	elapsed := time.Since(replayStart)
+	require.GreaterOrEqual(t, elapsed, 100*time.Millisecond)
+	require.Less(t, elapsed, 400*time.Millisecond)
+}
+
+func TestRecorderRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "listen.jsonl")
+	rec, err := newRecorder(RecordOptions{Path: path, MaxSize: 100, MaxBackups: 2})
+	require.NoError(t, err)
+	frame := []byte(`{"type":"chat","msg":{"id":1}}`)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, rec.record(time.Now(), frame))
+	}
+	require.NoError(t, rec.close())
+
+	// Each file holds a single record, and only two backups are kept.
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		b, err := os.ReadFile(name)
+		require.NoError(t, err)
+		require.Equal(t, 1, strings.Count(string(b), "\n"))
+	}
+	_, err = os.Stat(path + ".3")
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestRecorderKeepsRecordingWhenRotationFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "listen.jsonl")
+	rec, err := newRecorder(RecordOptions{Path: path, MaxSize: 100, MaxBackups: 1})
+	require.NoError(t, err)
+	defer rec.close()
+	frame := []byte(`{"type":"chat","msg":{"id":1}}`)
+	require.NoError(t, rec.record(time.Now(), frame))
+
+	// A directory in the way of the backup makes rotating fail.
+	require.NoError(t, os.MkdirAll(filepath.Join(path+".1", "blocker"), 0700))
+	require.ErrorContains(t, rec.record(time.Now(), frame), "unable to rotate recording")
+	require.NoError(t, os.RemoveAll(path+".1"))
+	require.NoError(t, rec.record(time.Now(), frame))
+	require.NoError(t, rec.record(time.Now(), frame))
+
+	b, err := os.ReadFile(path + ".1")
+	require.NoError(t, err)
+	require.Equal(t, 1, strings.Count(string(b), "\n"))
+	b, err = os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, 1, strings.Count(string(b), "\n"))
+}
+
+func TestListenersShareRecorder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "listen.jsonl")
+	transport := newFakeTransport(func(req fakeRequest) (any, error) {
+		return nil, errors.New("unexpected request")
+	})
+	api := NewAPI(RunOptions{}, WithTransport(transport))
+	record := &RecordOptions{Path: path, MaxSize: 300, MaxBackups: 10}
+	chat, err := api.Listen(ListenOptions{Record: record})
+	require.NoError(t, err)
+	wallet, err := api.Listen(ListenOptions{Wallet: true, Record: record})
+	require.NoError(t, err)
+	streams := []io.Writer{<-transport.streams, <-transport.streams}
+	api.Lock()
+	require.Len(t, api.recorders, 1)
+	api.Unlock()
+
+	// Both listeners record to the same file, which rotates as one.
+	for id := 1; id <= 5; id++ {
+		for _, stream := range streams {
+			writeEvent(t, stream, msgNotification(chat1.MsgSummary{Id: chat1.MessageID(id), ConvID: "abc"}))
+		}
+	}
+	readMsgs(t, chat, 5)
+	readMsgs(t, wallet, 5)
+	require.NoError(t, chat.ShutdownContext(context.Background()))
+	require.NoError(t, wallet.ShutdownContext(context.Background()))
+	api.Lock()
+	require.Empty(t, api.recorders)
+	api.Unlock()
+
+	matches, err := filepath.Glob(path + "*")
+	require.NoError(t, err)
+	require.Greater(t, len(matches), 2)
+	records := 0
+	for _, name := range matches {
+		b, err := os.ReadFile(name)
+		require.NoError(t, err)
+		for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+			var frame recordedFrame
+			require.NoError(t, json.Unmarshal([]byte(line), &frame))
+			records++
+		}
+	}
+	require.Equal(t, 10, records)
+}
@@ -0,0 +1,307 @@
+package kbchat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+const (
+	defaultResumeMaxBackfill  = 100
+	defaultResumeSaveInterval = 10 * time.Second
+	backfillPageSize          = 50
+)
+
+// Checkpoint records how far a subscription got through the chat, so
+// delivery can pick up where it left off.
+type Checkpoint struct {
+	// Convs holds the ID of the last message delivered from each
+	// conversation.
+	Convs map[chat1.ConvIDStr]chat1.MessageID `json:"convs"`
+	// SentAtMs is when the last message delivered was sent, by the server's
+	// clock. Conversations active since then are checked for messages too.
+	SentAtMs int64 `json:"sent_at_ms"`
+}
+
+// CheckpointStore persists a subscription's Checkpoint, so delivery also
+// resumes after the bot restarts.
+type CheckpointStore interface {
+	Load(ctx context.Context) (Checkpoint, error)
+	Save(ctx context.Context, checkpoint Checkpoint) error
+}
+
+// FileCheckpointStore keeps the checkpoint in a JSON file.
+type FileCheckpointStore struct {
+	Path string
+}
+
+func (s FileCheckpointStore) Load(ctx context.Context) (checkpoint Checkpoint, err error) {
+	b, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Checkpoint{}, nil
+	} else if err != nil {
+		return Checkpoint{}, err
+	}
+	if err := json.Unmarshal(b, &checkpoint); err != nil {
+		return Checkpoint{}, UnmarshalError{err}
+	}
+	return checkpoint, nil
+}
+
+func (s FileCheckpointStore) Save(ctx context.Context, checkpoint Checkpoint) error {
+	b, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.Path, b)
+}
+
+// KVStoreCheckpointStore keeps the checkpoint in a single entry of the bot's
+// kvstore.
+type KVStoreCheckpointStore struct {
+	API *API
+	// Team is the team whose kvstore is used, or the bot's own if nil.
+	Team      *string
+	Namespace string
+	EntryKey  string
+}
+
+func (s KVStoreCheckpointStore) Load(ctx context.Context) (checkpoint Checkpoint, err error) {
+	res, err := s.API.GetEntryContext(ctx, s.Team, s.Namespace, s.EntryKey)
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	if res.EntryValue == nil || *res.EntryValue == "" {
+		return Checkpoint{}, nil
+	}
+	if err := json.Unmarshal([]byte(*res.EntryValue), &checkpoint); err != nil {
+		return Checkpoint{}, UnmarshalError{err}
+	}
+	return checkpoint, nil
+}
+
+func (s KVStoreCheckpointStore) Save(ctx context.Context, checkpoint Checkpoint) error {
+	b, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	_, err = s.API.PutEntryContext(ctx, s.Team, s.Namespace, s.EntryKey, string(b))
+	return err
+}
+
+// ResumeOptions makes a subscription fetch the messages it missed while the
+// listener was down, before delivering new ones.
+type ResumeOptions struct {
+	// Store persists the checkpoint, so delivery also resumes after the bot
+	// restarts. Without one, it only resumes across reconnects.
+	Store CheckpointStore
+	// MaxBackfill caps the number of missed messages fetched from each
+	// conversation, keeping the newest. It defaults to 100.
+	MaxBackfill int
+	// SaveInterval is how often the checkpoint is saved, ten seconds by
+	// default. Messages delivered since the last save are delivered again
+	// after a crash.
+	SaveInterval time.Duration
+}
+
+// resumer tracks the last message a subscription delivered from each
+// conversation and backfills the ones it missed after a reconnect.
+type resumer struct {
+	sync.Mutex
+	api        *API
+	opts       ResumeOptions
+	listen     ListenOptions
+	loaded     bool
+	checkpoint Checkpoint
+	// version counts the changes to the checkpoint, and saved is the last
+	// version stored.
+	version int
+	saved   int
+	saveMu  sync.Mutex
+}
+
+func newResumer(a *API, listen ListenOptions) *resumer {
+	opts := *listen.Resume
+	if opts.MaxBackfill <= 0 {
+		opts.MaxBackfill = defaultResumeMaxBackfill
+	}
+	if opts.SaveInterval <= 0 {
+		opts.SaveInterval = defaultResumeSaveInterval
+	}
+	return &resumer{
+		api:        a,
+		opts:       opts,
+		listen:     listen,
+		checkpoint: Checkpoint{Convs: make(map[chat1.ConvIDStr]chat1.MessageID)},
+	}
+}
+
+// load reads the stored checkpoint the first time it is called.
+func (r *resumer) load(ctx context.Context) error {
+	r.Lock()
+	loaded := r.loaded
+	r.Unlock()
+	if loaded || r.opts.Store == nil {
+		return nil
+	}
+	checkpoint, err := r.opts.Store.Load(ctx)
+	if err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+	for conv, id := range checkpoint.Convs {
+		r.checkpoint.Convs[conv] = max(r.checkpoint.Convs[conv], id)
+	}
+	r.checkpoint.SentAtMs = max(r.checkpoint.SentAtMs, checkpoint.SentAtMs)
+	r.loaded = true
+	return nil
+}
+
+// seen reports whether msg was already delivered.
+func (r *resumer) seen(msg chat1.MsgSummary) bool {
+	r.Lock()
+	defer r.Unlock()
+	return msg.Id <= r.checkpoint.Convs[msg.ConvID]
+}
+
+// delivered moves the checkpoint past msg.
+func (r *resumer) delivered(msg chat1.MsgSummary) {
+	r.Lock()
+	defer r.Unlock()
+	if msg.Id > r.checkpoint.Convs[msg.ConvID] {
+		r.checkpoint.Convs[msg.ConvID] = msg.Id
+		r.version++
+	}
+	if msg.SentAtMs > r.checkpoint.SentAtMs {
+		r.checkpoint.SentAtMs = msg.SentAtMs
+		r.version++
+	}
+}
+
+// save stores the checkpoint if it changed since the last save. Nothing is
+// saved until the stored checkpoint has been loaded, so it isn't overwritten.
+func (r *resumer) save(ctx context.Context) error {
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+	r.Lock()
+	version := r.version
+	if r.opts.Store == nil || !r.loaded || version == r.saved {
+		r.Unlock()
+		return nil
+	}
+	checkpoint := Checkpoint{
+		Convs:    maps.Clone(r.checkpoint.Convs),
+		SentAtMs: r.checkpoint.SentAtMs,
+	}
+	r.Unlock()
+	if err := r.opts.Store.Save(ctx, checkpoint); err != nil {
+		return err
+	}
+	r.Lock()
+	r.saved = version
+	r.Unlock()
+	return nil
+}
+
+// autosave saves the checkpoint every SaveInterval until stop is closed.
+func (r *resumer) autosave(stop <-chan struct{}) {
+	ticker := time.NewTicker(r.opts.SaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), r.api.Timeout)
+			if err := r.save(ctx); err != nil {
+				r.api.Debug("unable to save checkpoint: %v", err)
+			}
+			cancel()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// missed fetches the messages sent since the checkpoint, in the order they
+// were sent, loading the stored checkpoint first. Nothing is missed until a
+// first message has been delivered.
+func (r *resumer) missed(ctx context.Context) (msgs []chat1.MsgSummary, err error) {
+	if err := r.load(ctx); err != nil {
+		return nil, fmt.Errorf("unable to load checkpoint: %w", err)
+	}
+	r.Lock()
+	sinceMs := r.checkpoint.SentAtMs
+	last := maps.Clone(r.checkpoint.Convs)
+	r.Unlock()
+	if sinceMs == 0 && len(last) == 0 {
+		return nil, nil
+	}
+	convs, err := r.api.GetConversationsContext(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	var perConv [][]chat1.MsgSummary
+	for _, conv := range convs {
+		if conv.ActiveAtMs < sinceMs || !r.listen.matchConv(conv) {
+			continue
+		}
+		convMsgs, err := r.missedInConv(ctx, conv.Id, last[conv.Id], sinceMs)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s: %w", conv.Id, err)
+		}
+		if len(convMsgs) > 0 {
+			slices.Reverse(convMsgs)
+			perConv = append(perConv, convMsgs)
+		}
+	}
+	// Merge the conversations by send time, keeping each one in order.
+	for len(perConv) > 0 {
+		next := 0
+		for i, convMsgs := range perConv {
+			if convMsgs[0].SentAtMs < perConv[next][0].SentAtMs {
+				next = i
+			}
+		}
+		msgs = append(msgs, perConv[next][0])
+		if perConv[next] = perConv[next][1:]; len(perConv[next]) == 0 {
+			perConv = slices.Delete(perConv, next, next+1)
+		}
+	}
+	return msgs, nil
+}
+
+// missedInConv pages back through a conversation until it reaches the last
+// message delivered from it, or, for a conversation never delivered from,
+// the first one sent before sinceMs. Messages are returned newest first.
+func (r *resumer) missedInConv(ctx context.Context, convID chat1.ConvIDStr, lastID chat1.MessageID,
+	sinceMs int64) (msgs []chat1.MsgSummary, err error) {
+	pagination := &chat1.Pagination{Num: backfillPageSize}
+	for {
+		thread, err := r.api.peekThread(ctx, convID, pagination)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range thread.Messages {
+			if msg.Msg == nil {
+				continue
+			}
+			if msg.Msg.Id <= lastID || (lastID == 0 && msg.Msg.SentAtMs < sinceMs) ||
+				len(msgs) == r.opts.MaxBackfill {
+				return msgs, nil
+			}
+			msgs = append(msgs, *msg.Msg)
+		}
+		if thread.Pagination == nil || thread.Pagination.Last || len(thread.Pagination.Next) == 0 {
+			return msgs, nil
+		}
+		pagination = &chat1.Pagination{Num: backfillPageSize, Next: thread.Pagination.Next}
+	}
+}
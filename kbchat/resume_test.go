@@ -0,0 +1,189 @@
+package kbchat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeReadRequest struct {
+	Params struct {
+		Options struct {
+			ConversationID chat1.ConvIDStr   `json:"conversation_id"`
+			Peek           bool              `json:"peek"`
+			Pagination     *chat1.Pagination `json:"pagination"`
+		} `json:"options"`
+	} `json:"params"`
+}
+
+// fakeChat answers list with convs and read with pages of threads, newest
+// message first, keyed by conversation ID and pagination cursor.
+func fakeChat(t *testing.T, convs []chat1.ConvSummary, threads map[string]chat1.Thread) func(req fakeRequest) (any, error) {
+	return func(req fakeRequest) (any, error) {
+		switch req.method {
+		case "list":
+			return map[string]any{"result": chat1.ChatList{Conversations: convs}}, nil
+		case "read":
+			var read fakeReadRequest
+			require.NoError(t, json.Unmarshal(req.request, &read))
+			require.True(t, read.Params.Options.Peek)
+			key := string(read.Params.Options.ConversationID)
+			if p := read.Params.Options.Pagination; p != nil && len(p.Next) > 0 {
+				key += "/" + string(p.Next)
+			}
+			return map[string]any{"result": threads[key]}, nil
+		default:
+			return nil, fmt.Errorf("unexpected request %s", req.method)
+		}
+	}
+}
+
+func threadOf(msgs ...chat1.MsgSummary) chat1.Thread {
+	var thread chat1.Thread
+	for i := range msgs {
+		thread.Messages = append(thread.Messages, chat1.Message{Msg: &msgs[i]})
+	}
+	return thread
+}
+
+func chatMsg(conv chat1.ConvIDStr, id int, sentAtMs int64) chat1.MsgSummary {
+	return chat1.MsgSummary{Id: chat1.MessageID(id), ConvID: conv, SentAtMs: sentAtMs}
+}
+
+func msgNotification(msg chat1.MsgSummary) chat1.MsgNotification {
+	return chat1.MsgNotification{Type: "chat", Msg: &msg}
+}
+
+func readMsgs(t *testing.T, sub *Subscription, n int) (msgs []string) {
+	for range n {
+		msg, err := sub.Read()
+		require.NoError(t, err)
+		msgs = append(msgs, fmt.Sprintf("%s/%d", msg.Message.ConvID, msg.Message.Id))
+	}
+	return msgs
+}
+
+func TestListenResumesAfterReconnect(t *testing.T) {
+	transport := newFakeTransport(fakeChat(t,
+		[]chat1.ConvSummary{{Id: "abc", ActiveAtMs: 5000}},
+		map[string]chat1.Thread{"abc": threadOf(
+			chatMsg("abc", 5, 5000),
+			chatMsg("abc", 4, 4000),
+			chatMsg("abc", 3, 3000),
+			chatMsg("abc", 2, 2000),
+			chatMsg("abc", 1, 1000),
+		)},
+	))
+	api := NewAPI(RunOptions{}, WithTransport(transport))
+	store := FileCheckpointStore{Path: filepath.Join(t.TempDir(), "checkpoint.json")}
+	sub, err := api.Listen(ListenOptions{
+		ReconnectPolicy: &ReconnectPolicy{InitialBackoff: time.Millisecond},
+		Resume:          &ResumeOptions{Store: store},
+	})
+	require.NoError(t, err)
+
+	stream := <-transport.streams
+	writeEvent(t, stream, msgNotification(chatMsg("abc", 1, 1000)))
+	writeEvent(t, stream, msgNotification(chatMsg("abc", 2, 2000)))
+	require.Equal(t, []string{"abc/1", "abc/2"}, readMsgs(t, sub, 2))
+
+	// Messages 3 to 5 arrive while the listener is down. Once it is back they
+	// are backfilled, and the live copy of 5 is skipped.
+	require.NoError(t, stream.Close())
+	stream = <-transport.streams
+	writeEvent(t, stream, msgNotification(chatMsg("abc", 5, 5000)))
+	writeEvent(t, stream, msgNotification(chatMsg("abc", 6, 6000)))
+	require.Equal(t, []string{"abc/3", "abc/4", "abc/5", "abc/6"}, readMsgs(t, sub, 4))
+
+	require.NoError(t, sub.ShutdownContext(context.Background()))
+	checkpoint, err := store.Load(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, Checkpoint{
+		Convs:    map[chat1.ConvIDStr]chat1.MessageID{"abc": 6},
+		SentAtMs: 6000,
+	}, checkpoint)
+}
+
+func TestListenResumesFromStoredCheckpoint(t *testing.T) {
+	transport := newFakeTransport(fakeChat(t,
+		[]chat1.ConvSummary{
+			{Id: "abc", ActiveAtMs: 5000},
+			{Id: "def", ActiveAtMs: 4500},
+			{Id: "ghi", ActiveAtMs: 1000},
+		},
+		map[string]chat1.Thread{
+			"abc": {
+				Messages:   threadOf(chatMsg("abc", 5, 5000), chatMsg("abc", 4, 3000)).Messages,
+				Pagination: &chat1.Pagination{Next: []byte("2")},
+			},
+			"abc/2": threadOf(chatMsg("abc", 3, 2500), chatMsg("abc", 2, 2000)),
+			"def":   threadOf(chatMsg("def", 7, 4500), chatMsg("def", 6, 2200), chatMsg("def", 1, 1500)),
+		},
+	))
+	api := NewAPI(RunOptions{}, WithTransport(transport))
+	store := FileCheckpointStore{Path: filepath.Join(t.TempDir(), "checkpoint.json")}
+	require.NoError(t, store.Save(context.Background(), Checkpoint{
+		Convs:    map[chat1.ConvIDStr]chat1.MessageID{"abc": 2},
+		SentAtMs: 2000,
+	}))
+	sub, err := api.Listen(ListenOptions{Resume: &ResumeOptions{Store: store}})
+	require.NoError(t, err)
+	defer sub.Shutdown()
+
+	// Conversations are merged by send time, and one that has been quiet
+	// since the checkpoint is not read at all.
+	require.Equal(t, []string{"def/6", "abc/3", "abc/4", "def/7", "abc/5"}, readMsgs(t, sub, 5))
+	for _, req := range transport.sent() {
+		require.NotContains(t, string(req.request), "ghi")
+	}
+}
+
+func TestListenResumeTellsOwnMessages(t *testing.T) {
+	sent := func(id int, username string) chat1.MsgSummary {
+		msg := chatMsg("abc", id, int64(id)*1000)
+		msg.Sender = chat1.MsgSender{Username: username, DeviceName: "bot-device"}
+		return msg
+	}
+	transport := newFakeTransport(fakeChat(t,
+		[]chat1.ConvSummary{{Id: "abc", ActiveAtMs: 4000}},
+		map[string]chat1.Thread{"abc": threadOf(sent(4, "bob"), sent(3, "alice"), sent(2, "bob"))},
+	))
+	api, err := Start(RunOptions{}, WithTransport(transport))
+	require.NoError(t, err)
+
+	// The bot is alice, so its own backfilled message is only delivered to
+	// the subscription for local messages.
+	for _, c := range []struct {
+		source MessageSource
+		want   []string
+	}{
+		{SourceRemote, []string{"abc/2", "abc/4"}},
+		{SourceLocal, []string{"abc/3"}},
+	} {
+		store := FileCheckpointStore{Path: filepath.Join(t.TempDir(), "checkpoint.json")}
+		require.NoError(t, store.Save(context.Background(), Checkpoint{
+			Convs:    map[chat1.ConvIDStr]chat1.MessageID{"abc": 1},
+			SentAtMs: 1000,
+		}))
+		sub, err := api.Listen(ListenOptions{Source: c.source, Resume: &ResumeOptions{Store: store}})
+		require.NoError(t, err)
+		require.Equal(t, c.want, readMsgs(t, sub, len(c.want)))
+		sub.Shutdown()
+	}
+
+	// With the bot's device known, its messages from other devices are
+	// remote.
+	api.deviceName = "bot-device"
+	source := api.fetchedSource()
+	require.Equal(t, "local", source(sent(3, "alice")))
+	other := sent(3, "alice")
+	other.Sender.DeviceName = "phone"
+	require.Equal(t, "remote", source(other))
+	require.Equal(t, "remote", source(sent(2, "bob")))
+}
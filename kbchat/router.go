@@ -0,0 +1,190 @@
+package kbchat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+// HandlerError is an error returned by one of a Router's handlers, or a
+// panic it recovered from.
+type HandlerError struct {
+	// ContentType is the content type of the message being handled.
+	ContentType string
+	Message     SubscriptionMessage
+	Err         error
+}
+
+func (e HandlerError) Error() string {
+	return fmt.Sprintf("%s handler failed on message %d in %s: %v",
+		e.ContentType, e.Message.Message.Id, e.Message.Message.ConvID, e.Err)
+}
+
+func (e HandlerError) Unwrap() error {
+	return e.Err
+}
+
+// Router calls a handler for every message, picked by its content type.
+// Handlers get the message along with its content. Register handlers before
+// running the router.
+type Router struct {
+	*DebugOutput
+	handlers       map[string]func(SubscriptionMessage) error
+	defaultHandler func(SubscriptionMessage) error
+	onError        func(error)
+}
+
+func NewRouter() *Router {
+	return &Router{
+		DebugOutput: NewDebugOutput("Router"),
+		handlers:    make(map[string]func(SubscriptionMessage) error),
+	}
+}
+
+// route registers h for messages of type typ, whose content content picks.
+func route[T any](r *Router, typ string, content func(chat1.MsgContent) *T, h func(SubscriptionMessage, T) error) {
+	r.handlers[typ] = func(msg SubscriptionMessage) error {
+		c := content(msg.Message.Content)
+		if c == nil {
+			return fmt.Errorf("%s message without %s content", typ, typ)
+		}
+		return h(msg, *c)
+	}
+}
+
+func (r *Router) OnText(h func(msg SubscriptionMessage, text chat1.MsgTextContent) error) {
+	route(r, "text", func(c chat1.MsgContent) *chat1.MsgTextContent { return c.Text }, h)
+}
+
+func (r *Router) OnEdit(h func(msg SubscriptionMessage, edit chat1.MessageEdit) error) {
+	route(r, "edit", func(c chat1.MsgContent) *chat1.MessageEdit { return c.Edit }, h)
+}
+
+func (r *Router) OnDelete(h func(msg SubscriptionMessage, del chat1.MessageDelete) error) {
+	route(r, "delete", func(c chat1.MsgContent) *chat1.MessageDelete { return c.Delete }, h)
+}
+
+func (r *Router) OnReaction(h func(msg SubscriptionMessage, reaction chat1.MessageReaction) error) {
+	route(r, "reaction", func(c chat1.MsgContent) *chat1.MessageReaction { return c.Reaction }, h)
+}
+
+func (r *Router) OnAttachment(h func(msg SubscriptionMessage, attachment chat1.MessageAttachment) error) {
+	route(r, "attachment", func(c chat1.MsgContent) *chat1.MessageAttachment { return c.Attachment }, h)
+}
+
+func (r *Router) OnAttachmentUploaded(h func(msg SubscriptionMessage, uploaded chat1.MessageAttachmentUploaded) error) {
+	route(r, "attachmentuploaded", func(c chat1.MsgContent) *chat1.MessageAttachmentUploaded { return c.AttachmentUploaded }, h)
+}
+
+func (r *Router) OnSystem(h func(msg SubscriptionMessage, system chat1.MessageSystem) error) {
+	route(r, "system", func(c chat1.MsgContent) *chat1.MessageSystem { return c.System }, h)
+}
+
+func (r *Router) OnSendPayment(h func(msg SubscriptionMessage, payment chat1.MessageSendPayment) error) {
+	route(r, "sendpayment", func(c chat1.MsgContent) *chat1.MessageSendPayment { return c.SendPayment }, h)
+}
+
+func (r *Router) OnRequestPayment(h func(msg SubscriptionMessage, request chat1.MessageRequestPayment) error) {
+	route(r, "requestpayment", func(c chat1.MsgContent) *chat1.MessageRequestPayment { return c.RequestPayment }, h)
+}
+
+func (r *Router) OnUnfurl(h func(msg SubscriptionMessage, unfurl chat1.MessageUnfurl) error) {
+	route(r, "unfurl", func(c chat1.MsgContent) *chat1.MessageUnfurl { return c.Unfurl }, h)
+}
+
+func (r *Router) OnFlip(h func(msg SubscriptionMessage, flip chat1.MsgFlipContent) error) {
+	route(r, "flip", func(c chat1.MsgContent) *chat1.MsgFlipContent { return c.Flip }, h)
+}
+
+func (r *Router) OnHeadline(h func(msg SubscriptionMessage, headline chat1.MessageHeadline) error) {
+	route(r, "headline", func(c chat1.MsgContent) *chat1.MessageHeadline { return c.Headline }, h)
+}
+
+func (r *Router) OnMetadata(h func(msg SubscriptionMessage, metadata chat1.MessageConversationMetadata) error) {
+	route(r, "metadata", func(c chat1.MsgContent) *chat1.MessageConversationMetadata { return c.Metadata }, h)
+}
+
+// OnJoin and OnLeave handle members joining and leaving a channel, which
+// carry no content of their own.
+func (r *Router) OnJoin(h func(msg SubscriptionMessage) error) {
+	r.handlers["join"] = h
+}
+
+func (r *Router) OnLeave(h func(msg SubscriptionMessage) error) {
+	r.handlers["leave"] = h
+}
+
+// Default handles the messages no other handler takes. Without it they are
+// ignored.
+func (r *Router) Default(h func(msg SubscriptionMessage) error) {
+	r.defaultHandler = h
+}
+
+// OnError is called with every HandlerError, and with the ErrorEvents
+// received by Run. Without it they are only logged.
+func (r *Router) OnError(h func(err error)) {
+	r.onError = h
+}
+
+// Handle calls the handler for msg, returning its error as a HandlerError.
+// Panics in the handler are recovered and returned too.
+func (r *Router) Handle(msg SubscriptionMessage) (err error) {
+	typ := msg.Message.Content.TypeName
+	h, ok := r.handlers[typ]
+	if !ok {
+		h = r.defaultHandler
+	}
+	if h == nil {
+		return nil
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			err = HandlerError{ContentType: typ, Message: msg, Err: fmt.Errorf("panic: %v", p)}
+		}
+	}()
+	if err := h(msg); err != nil {
+		return HandlerError{ContentType: typ, Message: msg, Err: err}
+	}
+	return nil
+}
+
+func (r *Router) reportError(err error) {
+	if r.onError != nil {
+		r.onError(err)
+		return
+	}
+	r.Debug("%v", err)
+}
+
+// Run handles the messages received by sub, one at a time, until it shuts
+// down. With ListenOptions.MarkRead, messages handled without an error are
+// marked as read.
+func (r *Router) Run(sub *Subscription) error {
+	return r.RunContext(context.Background(), sub)
+}
+
+// RunContext is like Run, but also returns ctx.Err() once ctx is done.
+func (r *Router) RunContext(ctx context.Context, sub *Subscription) error {
+	for {
+		select {
+		case event, ok := <-sub.Events():
+			if !ok {
+				return errors.New("Subscription shutdown")
+			}
+			switch event := event.(type) {
+			case MessageEvent:
+				if err := r.Handle(event.SubscriptionMessage); err != nil {
+					r.reportError(err)
+				} else {
+					sub.handled(event.SubscriptionMessage)
+				}
+			case ErrorEvent:
+				r.reportError(event.Err)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package kbchat
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/stretchr/testify/require"
+)
+
+func routedMessage(id int, content chat1.MsgContent) SubscriptionMessage {
+	return SubscriptionMessage{Message: chat1.MsgSummary{Id: chat1.MessageID(id), ConvID: "abc", Content: content}}
+}
+
+func TestRouterHandle(t *testing.T) {
+	var handled []string
+	r := NewRouter()
+	r.OnText(func(msg SubscriptionMessage, text chat1.MsgTextContent) error {
+		handled = append(handled, "text "+text.Body)
+		return nil
+	})
+	r.OnReaction(func(msg SubscriptionMessage, reaction chat1.MessageReaction) error {
+		handled = append(handled, fmt.Sprintf("reaction %s on %d", reaction.Body, reaction.MessageID))
+		return nil
+	})
+	r.OnJoin(func(msg SubscriptionMessage) error {
+		handled = append(handled, "join")
+		return nil
+	})
+
+	require.NoError(t, r.Handle(routedMessage(1, chat1.MsgContent{TypeName: "text", Text: &chat1.MsgTextContent{Body: "hi"}})))
+	require.NoError(t, r.Handle(routedMessage(2, chat1.MsgContent{TypeName: "reaction", Reaction: &chat1.MessageReaction{MessageID: 1, Body: ":+1:"}})))
+	require.NoError(t, r.Handle(routedMessage(3, chat1.MsgContent{TypeName: "join"})))
+	// Messages without a handler are ignored until there is a default one.
+	require.NoError(t, r.Handle(routedMessage(4, chat1.MsgContent{TypeName: "headline"})))
+	r.Default(func(msg SubscriptionMessage) error {
+		handled = append(handled, "default "+msg.Message.Content.TypeName)
+		return nil
+	})
+	require.NoError(t, r.Handle(routedMessage(5, chat1.MsgContent{TypeName: "headline"})))
+	require.Equal(t, []string{"text hi", "reaction :+1: on 1", "join", "default headline"}, handled)
+
+	// A message missing the content of its type is an error.
+	err := r.Handle(routedMessage(6, chat1.MsgContent{TypeName: "text"}))
+	var handlerErr HandlerError
+	require.True(t, errors.As(err, &handlerErr))
+	require.Equal(t, "text", handlerErr.ContentType)
+	require.Equal(t, chat1.MessageID(6), handlerErr.Message.Message.Id)
+}
+
+func TestRouterHandlerErrors(t *testing.T) {
+	failed := errors.New("failed")
+	r := NewRouter()
+	r.OnEdit(func(msg SubscriptionMessage, edit chat1.MessageEdit) error {
+		return failed
+	})
+	r.OnDelete(func(msg SubscriptionMessage, del chat1.MessageDelete) error {
+		panic("boom")
+	})
+
+	err := r.Handle(routedMessage(1, chat1.MsgContent{TypeName: "edit", Edit: &chat1.MessageEdit{}}))
+	require.ErrorIs(t, err, failed)
+	err = r.Handle(routedMessage(2, chat1.MsgContent{TypeName: "delete", Delete: &chat1.MessageDelete{}}))
+	var handlerErr HandlerError
+	require.True(t, errors.As(err, &handlerErr))
+	require.Equal(t, "delete", handlerErr.ContentType)
+	require.ErrorContains(t, err, "panic: boom")
+}
+
+func TestRouterRun(t *testing.T) {
+	sub, stream := listenFake(t, ListenOptions{})
+	bodies := make(chan string, 2)
+	errs := make(chan error, 2)
+	r := NewRouter()
+	r.OnText(func(msg SubscriptionMessage, text chat1.MsgTextContent) error {
+		bodies <- text.Body
+		if text.Body == "bad" {
+			return errors.New("bad body")
+		}
+		return nil
+	})
+	r.OnError(func(err error) { errs <- err })
+	runErr := make(chan error, 1)
+	go func() { runErr <- r.Run(sub) }()
+
+	for _, body := range []string{"good", "bad"} {
+		writeEvent(t, stream, msgNotification(chat1.MsgSummary{
+			ConvID:  "abc",
+			Content: chat1.MsgContent{TypeName: "text", Text: &chat1.MsgTextContent{Body: body}},
+		}))
+	}
+	require.Equal(t, "good", <-bodies)
+	require.Equal(t, "bad", <-bodies)
+	require.ErrorContains(t, <-errs, "bad body")
+
+	sub.Shutdown()
+	require.Error(t, <-runErr)
+}
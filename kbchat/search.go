@@ -0,0 +1,121 @@
+package kbchat
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/gregor1"
+)
+
+type searchOptions struct {
+	Channel        *chat1.ChatChannel `json:"channel,omitempty"`
+	ConversationID chat1.ConvIDStr    `json:"conversation_id,omitempty"`
+	Query          string             `json:"query"`
+	IsRegex        bool               `json:"is_regex,omitempty"`
+	SentBy         string             `json:"sent_by,omitempty"`
+	SentTo         string             `json:"sent_to,omitempty"`
+	MatchMentions  bool               `json:"match_mentions,omitempty"`
+	SentBefore     string             `json:"sent_before,omitempty"`
+	SentAfter      string             `json:"sent_after,omitempty"`
+	MaxHits        int                `json:"max_hits,omitempty"`
+	MaxMessages    int                `json:"max_messages,omitempty"`
+	BeforeContext  int                `json:"before_context,omitempty"`
+	AfterContext   int                `json:"after_context,omitempty"`
+}
+
+type searchParams struct {
+	Options searchOptions
+}
+
+type searchArg struct {
+	Method string
+	Params searchParams
+}
+
+func newSearchOptions(query string, opts chat1.SearchOpts) searchOptions {
+	searchTime := func(t gregor1.Time) string {
+		if t == 0 {
+			return ""
+		}
+		return time.UnixMilli(int64(t)).UTC().Format(time.RFC3339)
+	}
+	return searchOptions{
+		Query:         query,
+		SentBy:        opts.SentBy,
+		SentTo:        opts.SentTo,
+		MatchMentions: opts.MatchMentions,
+		SentBefore:    searchTime(opts.SentBefore),
+		SentAfter:     searchTime(opts.SentAfter),
+		MaxHits:       opts.MaxHits,
+		MaxMessages:   opts.MaxMessages,
+		BeforeContext: opts.BeforeContext,
+		AfterContext:  opts.AfterContext,
+	}
+}
+
+func (a *API) search(ctx context.Context, method string, options searchOptions, result any) error {
+	bArg, err := json.Marshal(searchArg{
+		Method: method,
+		Params: searchParams{Options: options},
+	})
+	if err != nil {
+		return err
+	}
+	return a.call(ctx, ChatAPIName, bArg, result)
+}
+
+// SearchRegexp returns the messages of a conversation matching pattern,
+// newest first. Of opts, SentBy, SentTo, SentBefore, SentAfter, MaxHits,
+// MaxMessages, BeforeContext and AfterContext apply. Every hit carries
+// BeforeContext messages before it and AfterContext after.
+func (a *API) SearchRegexp(convID chat1.ConvIDStr, pattern string, opts chat1.SearchOpts) ([]chat1.ChatSearchHit, error) {
+	return a.SearchRegexpContext(context.Background(), convID, pattern, opts)
+}
+
+func (a *API) SearchRegexpContext(ctx context.Context, convID chat1.ConvIDStr, pattern string, opts chat1.SearchOpts) ([]chat1.ChatSearchHit, error) {
+	options := newSearchOptions(pattern, opts)
+	options.ConversationID = convID
+	return a.searchRegexp(ctx, options)
+}
+
+func (a *API) SearchRegexpByChannel(channel chat1.ChatChannel, pattern string, opts chat1.SearchOpts) ([]chat1.ChatSearchHit, error) {
+	return a.SearchRegexpByChannelContext(context.Background(), channel, pattern, opts)
+}
+
+func (a *API) SearchRegexpByChannelContext(ctx context.Context, channel chat1.ChatChannel, pattern string, opts chat1.SearchOpts) ([]chat1.ChatSearchHit, error) {
+	options := newSearchOptions(pattern, opts)
+	options.Channel = &channel
+	return a.searchRegexp(ctx, options)
+}
+
+func (a *API) searchRegexp(ctx context.Context, options searchOptions) ([]chat1.ChatSearchHit, error) {
+	options.IsRegex = true
+	var res chat1.RegexpRes
+	if err := a.search(ctx, "searchregexp", options, &res); err != nil {
+		return nil, err
+	}
+	return res.Hits, nil
+}
+
+// SearchInbox searches every conversation of the bot for query, using the
+// search index of the keybase service. Of opts, SentBy, SentTo,
+// MatchMentions, SentBefore, SentAfter, MaxHits, BeforeContext and
+// AfterContext apply. The hits are grouped by conversation.
+func (a *API) SearchInbox(query string, opts chat1.SearchOpts) (chat1.ChatSearchInboxResults, error) {
+	return a.SearchInboxContext(context.Background(), query, opts)
+}
+
+func (a *API) SearchInboxContext(ctx context.Context, query string, opts chat1.SearchOpts) (chat1.ChatSearchInboxResults, error) {
+	options := newSearchOptions(query, opts)
+	options.MaxMessages = 0
+	var res chat1.SearchInboxResOutput
+	if err := a.search(ctx, "searchinbox", options, &res); err != nil {
+		return chat1.ChatSearchInboxResults{}, err
+	}
+	if res.Results == nil {
+		return chat1.ChatSearchInboxResults{}, nil
+	}
+	return *res.Results, nil
+}
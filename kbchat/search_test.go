@@ -0,0 +1,65 @@
+package kbchat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/gregor1"
+	"github.com/stretchr/testify/require"
+)
+
+func searchHit(id int, context ...int) chat1.ChatSearchHit {
+	uiMessage := func(id int) chat1.UIMessage {
+		return chat1.NewUIMessageWithValid(chat1.UIMessageValid{MessageID: chat1.MessageID(id), SenderUsername: "alice"})
+	}
+	hit := chat1.ChatSearchHit{
+		HitMessage: uiMessage(id),
+		Matches:    []chat1.ChatSearchMatch{{StartIndex: 4, EndIndex: 23, Match: "https://keybase.io/"}},
+	}
+	for _, id := range context {
+		hit.BeforeMessages = append(hit.BeforeMessages, uiMessage(id))
+	}
+	return hit
+}
+
+func TestSearch(t *testing.T) {
+	var requests []string
+	transport := newFakeTransport(func(req fakeRequest) (any, error) {
+		requests = append(requests, string(req.request))
+		switch req.method {
+		case "searchregexp":
+			return map[string]any{"result": chat1.RegexpRes{Hits: []chat1.ChatSearchHit{searchHit(5, 4)}}}, nil
+		case "searchinbox":
+			return map[string]any{"result": chat1.SearchInboxResOutput{Results: &chat1.ChatSearchInboxResults{
+				Hits: []chat1.ChatSearchInboxHit{{ConvName: "alice,bot", Query: "release", Hits: []chat1.ChatSearchHit{searchHit(7)}}},
+			}}}, nil
+		default:
+			return nil, nil
+		}
+	})
+	api, err := Start(RunOptions{}, WithTransport(transport))
+	require.NoError(t, err)
+
+	since := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	hits, err := api.SearchRegexp("abc", `https://\S+`, chat1.SearchOpts{
+		SentBy:        "alice",
+		SentAfter:     gregor1.Time(since.UnixMilli()),
+		MaxHits:       10,
+		BeforeContext: 1,
+	})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"Method":"searchregexp","Params":{"Options":{"conversation_id":"abc","query":"https://\\S+",
+		"is_regex":true,"sent_by":"alice","sent_after":"2026-09-01T00:00:00Z","max_hits":10,"before_context":1}}}`, requests[0])
+	require.Len(t, hits, 1)
+	require.Equal(t, chat1.MessageID(5), hits[0].HitMessage.Valid().MessageID)
+	require.Equal(t, chat1.MessageID(4), hits[0].BeforeMessages[0].Valid().MessageID)
+	require.Equal(t, "https://keybase.io/", hits[0].Matches[0].Match)
+
+	res, err := api.SearchInbox("release", chat1.SearchOpts{MaxHits: 5, MaxMessages: 100})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"Method":"searchinbox","Params":{"Options":{"query":"release","max_hits":5}}}`, requests[1])
+	require.Len(t, res.Hits, 1)
+	require.Equal(t, "alice,bot", res.Hits[0].ConvName)
+	require.Equal(t, chat1.MessageID(7), res.Hits[0].Hits[0].HitMessage.Valid().MessageID)
+}
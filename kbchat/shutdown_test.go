@@ -0,0 +1,117 @@
+package kbchat
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/stretchr/testify/require"
+)
+
+// startFakePipe starts a supervised pipe running the transport's fake keybase
+// binary.
+func startFakePipe(t *testing.T, transport *ExecTransport) *apiPipe {
+	pipe := newAPIPipe(false)
+	require.NoError(t, pipe.start(transport.runOpts))
+	go transport.supervise(pipe)
+	transport.pool.replace([]*apiPipe{pipe})
+	return pipe
+}
+
+func TestShutdownClosesStdin(t *testing.T) {
+	// The process exits as soon as its stdin is closed.
+	api, transport := fakeKeybaseAPI(t, "exec cat >/dev/null")
+	pipe := startFakePipe(t, transport)
+
+	start := time.Now()
+	require.NoError(t, api.ShutdownContext(context.Background()))
+	require.Less(t, time.Since(start), defaultShutdownGracePeriod)
+	<-pipe.exit.done
+	require.NoError(t, pipe.exit.err)
+
+	_, err := api.GetConversations(false)
+	require.ErrorIs(t, err, ErrShutdown)
+	_, err = api.Listen(ListenOptions{})
+	require.ErrorIs(t, err, ErrShutdown)
+}
+
+func TestShutdownKillsAfterGracePeriod(t *testing.T) {
+	runOpts := RunOptions{
+		KeybaseLocation:     fakeKeybase(t, "exec sleep 60"),
+		ShutdownGracePeriod: 100 * time.Millisecond,
+	}
+	transport := NewExecTransport(runOpts)
+	api := NewAPI(runOpts, WithTransport(transport))
+	pipe := startFakePipe(t, transport)
+
+	start := time.Now()
+	require.NoError(t, api.ShutdownContext(context.Background()))
+	require.Less(t, time.Since(start), 5*time.Second)
+	<-pipe.exit.done
+	require.False(t, pipe.healthy.Load())
+}
+
+func TestShutdownDrainsInFlightCalls(t *testing.T) {
+	release := make(chan struct{})
+	transport := newFakeTransport(func(req fakeRequest) (any, error) {
+		<-release
+		return map[string]any{"result": chat1.SendRes{Message: "message sent"}}, nil
+	})
+	api, err := Start(RunOptions{}, WithTransport(transport))
+	require.NoError(t, err)
+	sub, err := api.Listen(ListenOptions{})
+	require.NoError(t, err)
+	<-transport.streams
+
+	sent := make(chan error, 1)
+	go func() {
+		_, err := api.SendMessageByConvID("abc", "hi")
+		sent <- err
+	}()
+	require.Eventually(t, func() bool { return len(transport.sent()) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- api.ShutdownContext(context.Background()) }()
+	<-sub.stoppedCh
+	select {
+	case <-shutdown:
+		t.Fatal("shutdown did not wait for the in-flight call")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	require.NoError(t, <-sent)
+	require.NoError(t, <-shutdown)
+}
+
+func TestShutdownReportsEveryFailure(t *testing.T) {
+	runOpts := RunOptions{
+		KeybaseLocation: fakeKeybase(t, "exit 1"),
+		Oneshot:         &OneshotOptions{Username: "alice"},
+		StartService:    true,
+	}
+	api := NewAPI(runOpts)
+
+	err := api.ShutdownContext(context.Background())
+	require.ErrorContains(t, err, "unable to log out")
+	require.ErrorContains(t, err, "unable to stop service")
+}
+
+func TestShutdownLogsOutAfterDeadline(t *testing.T) {
+	ran := filepath.Join(t.TempDir(), "ran")
+	runOpts := RunOptions{
+		KeybaseLocation: fakeKeybase(t, `echo "$@" >>`+ran),
+		Oneshot:         &OneshotOptions{Username: "alice"},
+		StartService:    true,
+	}
+	api := NewAPI(runOpts)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.NoError(t, api.ShutdownContext(ctx))
+	b, err := os.ReadFile(ran)
+	require.NoError(t, err)
+	require.Equal(t, "logout --force\nctl stop --shutdown\n", string(b))
+}
@@ -1,11 +1,9 @@
 package kbchat
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
-	"strings"
 
 	"github.com/keybase/go-keybase-chat-bot/kbchat/types/keybase1"
 )
@@ -26,59 +24,35 @@ type ListUserMemberships struct {
 }
 
 func (a *API) ListMembersOfTeam(teamName string) (res keybase1.TeamMembersDetails, err error) {
+	return a.ListMembersOfTeamContext(context.Background(), teamName)
+}
+
+func (a *API) ListMembersOfTeamContext(ctx context.Context, teamName string) (res keybase1.TeamMembersDetails, err error) {
 	teamNameEscaped, err := json.Marshal(teamName)
 	if err != nil {
 		return res, err
 	}
 	apiInput := fmt.Sprintf(`{"method": "list-team-memberships", "params": {"options": {"team": %s}}}`, teamNameEscaped)
-	cmd := a.runOpts.Command("team", "api")
-	cmd.Stdin = strings.NewReader(apiInput)
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-	output, err := cmd.Output()
-	if err != nil {
-		return res, APIError{err}
-	}
-	if stderr.Len() != 0 {
-		log.Printf("ListMembersOfTeam error: %s", stderr.String())
-	}
-
 	members := ListTeamMembers{}
-	err = json.Unmarshal(output, &members)
-	if err != nil {
-		return res, UnmarshalError{err}
-	}
-	if members.Error.Message != "" {
-		return res, members.Error
+	if err := a.call(ctx, TeamAPIName, []byte(apiInput), &members.Result); err != nil {
+		return res, err
 	}
 	return members.Result.Members, nil
 }
 
 func (a *API) ListUserMemberships(username string) ([]keybase1.AnnotatedMemberInfo, error) {
+	return a.ListUserMembershipsContext(context.Background(), username)
+}
+
+func (a *API) ListUserMembershipsContext(ctx context.Context, username string) ([]keybase1.AnnotatedMemberInfo, error) {
 	usernameEscaped, err := json.Marshal(username)
 	if err != nil {
 		return nil, err
 	}
 	apiInput := fmt.Sprintf(`{"method": "list-user-memberships", "params": {"options": {"username": %s}}}`, usernameEscaped)
-	cmd := a.runOpts.Command("team", "api")
-	cmd.Stdin = strings.NewReader(apiInput)
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-	output, err := cmd.Output()
-	if err != nil {
-		return nil, APIError{err}
-	}
-	if stderr.Len() != 0 {
-		log.Printf("ListUserMemberships error: %s", stderr.String())
-	}
-
 	members := ListUserMemberships{}
-	err = json.Unmarshal(output, &members)
-	if err != nil {
-		return nil, UnmarshalError{err}
-	}
-	if members.Error.Message != "" {
-		return nil, members.Error
+	if err := a.call(ctx, TeamAPIName, []byte(apiInput), &members.Result); err != nil {
+		return nil, err
 	}
 	return members.Result.Teams, nil
 }
@@ -0,0 +1,183 @@
+package kbchat
+
+import (
+	"context"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+const defaultThreadPageSize = 100
+
+// ThreadOptions configures a ThreadReader.
+type ThreadOptions struct {
+	// PageSize is the number of messages read at once, 100 by default.
+	PageSize int
+	// ContentTypes, if set, limits the messages to those types, such as
+	// "text", "edit", "reaction", "attachment" or "system".
+	ContentTypes []string
+	// Since and Before, if set, limit the messages to the ones sent from
+	// Since up to Before. Reading stops at the first message past them.
+	Since  time.Time
+	Before time.Time
+	// Peek reads without marking the conversation as read.
+	Peek bool
+	// UnreadOnly only reads the unread messages.
+	UnreadOnly bool
+	// Pagination, if set, is where to start, such as ThreadReader.Pagination
+	// of an earlier reader. With Next set, reading continues toward older
+	// messages, and with Previous set toward newer ones.
+	Pagination *chat1.Pagination
+}
+
+// ThreadReader reads a conversation a page at a time, newest messages first.
+// Started from a Previous cursor, it reads toward newer messages, oldest
+// first. Unlike GetTextMessages it returns messages of every content type.
+type ThreadReader struct {
+	api  *API
+	conv map[string]any
+	opts ThreadOptions
+
+	pagination *chat1.Pagination
+	newer      bool
+	done       bool
+	buf        []chat1.MsgSummary
+}
+
+// ReadThread starts reading a channel. Nothing is read until the first call
+// to Read or ReadPage.
+func (a *API) ReadThread(channel chat1.ChatChannel, opts ThreadOptions) *ThreadReader {
+	return a.newThreadReader(map[string]any{"channel": channel}, opts)
+}
+
+// ReadThreadByConvID is like ReadThread, for a conversation picked by ID.
+func (a *API) ReadThreadByConvID(convID chat1.ConvIDStr, opts ThreadOptions) *ThreadReader {
+	return a.newThreadReader(map[string]any{"conversation_id": convID}, opts)
+}
+
+func (a *API) newThreadReader(conv map[string]any, opts ThreadOptions) *ThreadReader {
+	if opts.PageSize <= 0 {
+		opts.PageSize = defaultThreadPageSize
+	}
+	r := &ThreadReader{
+		api:        a,
+		conv:       conv,
+		opts:       opts,
+		pagination: &chat1.Pagination{},
+	}
+	if p := opts.Pagination; p != nil {
+		r.pagination = p
+		r.newer = len(p.Next) == 0 && len(p.Previous) > 0
+	}
+	return r
+}
+
+// Pagination returns the cursors of the last page read, to start another
+// reader from later on.
+func (r *ThreadReader) Pagination() *chat1.Pagination {
+	return r.pagination
+}
+
+// Read returns the next message, or io.EOF once there are none left.
+func (r *ThreadReader) Read() (chat1.MsgSummary, error) {
+	return r.ReadContext(context.Background())
+}
+
+func (r *ThreadReader) ReadContext(ctx context.Context) (chat1.MsgSummary, error) {
+	for len(r.buf) == 0 {
+		page, err := r.ReadPageContext(ctx)
+		if err != nil {
+			return chat1.MsgSummary{}, err
+		}
+		r.buf = page
+	}
+	msg := r.buf[0]
+	r.buf = r.buf[1:]
+	return msg, nil
+}
+
+// ReadPage returns the messages of the next page that match the options,
+// which may be none. It returns io.EOF once there are no pages left. Don't
+// mix it with Read, which buffers a page.
+func (r *ThreadReader) ReadPage() ([]chat1.MsgSummary, error) {
+	return r.ReadPageContext(context.Background())
+}
+
+func (r *ThreadReader) ReadPageContext(ctx context.Context) ([]chat1.MsgSummary, error) {
+	if r.done {
+		return nil, io.EOF
+	}
+	opts := map[string]any{
+		"peek":        r.opts.Peek,
+		"unread_only": r.opts.UnreadOnly,
+	}
+	for k, v := range r.conv {
+		opts[k] = v
+	}
+	var thread chat1.Thread
+	if err := r.api.readPage(ctx, opts, r.cursor(), &thread); err != nil {
+		return nil, err
+	}
+	var msgs []chat1.MsgSummary
+	for _, msg := range thread.Messages {
+		if msg.Msg == nil {
+			continue
+		}
+		if r.past(*msg.Msg) {
+			r.done = true
+		}
+		if r.matches(*msg.Msg) {
+			msgs = append(msgs, *msg.Msg)
+		}
+	}
+	if r.newer {
+		slices.Reverse(msgs)
+	}
+	r.advance(thread)
+	return msgs, nil
+}
+
+// past reports whether msg is beyond the end of the time window, in the
+// direction of reading, so no later page can match.
+func (r *ThreadReader) past(msg chat1.MsgSummary) bool {
+	if r.newer {
+		return !r.opts.Before.IsZero() && msg.SentAtMs >= r.opts.Before.UnixMilli()
+	}
+	return !r.opts.Since.IsZero() && msg.SentAtMs < r.opts.Since.UnixMilli()
+}
+
+func (r *ThreadReader) matches(msg chat1.MsgSummary) bool {
+	if !r.opts.Since.IsZero() && msg.SentAtMs < r.opts.Since.UnixMilli() {
+		return false
+	}
+	if !r.opts.Before.IsZero() && msg.SentAtMs >= r.opts.Before.UnixMilli() {
+		return false
+	}
+	return len(r.opts.ContentTypes) == 0 || slices.Contains(r.opts.ContentTypes, msg.Content.TypeName)
+}
+
+// advance moves on to the page after the one just read.
+func (r *ThreadReader) advance(thread chat1.Thread) {
+	p := thread.Pagination
+	if p == nil || len(thread.Messages) == 0 {
+		r.done = true
+		return
+	}
+	r.pagination = p
+	if r.newer {
+		r.done = r.done || len(p.Previous) == 0
+	} else {
+		r.done = r.done || p.Last || len(p.Next) == 0
+	}
+}
+
+// cursor returns the pagination requesting the page after the last one
+// read.
+func (r *ThreadReader) cursor() *chat1.Pagination {
+	if r.newer {
+		return &chat1.Pagination{Num: r.opts.PageSize, Previous: r.pagination.Previous}
+	}
+	return &chat1.Pagination{Num: r.opts.PageSize, Next: r.pagination.Next}
+}
@@ -0,0 +1,112 @@
+package kbchat
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeThread serves a conversation of ten messages, sent a second apart, in
+// pages of three, newest first. Pages are keyed by the ID of the message
+// they continue from, and every request is handed to the test.
+func fakeThread(t *testing.T) (*fakeTransport, chan fakeReadRequest) {
+	types := []string{"text", "edit", "reaction", "attachment", "system"}
+	reads := make(chan fakeReadRequest, 20)
+	transport := newFakeTransport(func(req fakeRequest) (any, error) {
+		if req.method != "read" {
+			return nil, errors.New("unexpected request")
+		}
+		var read fakeReadRequest
+		require.NoError(t, json.Unmarshal(req.request, &read))
+		reads <- read
+		p := read.Params.Options.Pagination
+		require.Equal(t, 3, p.Num)
+		// Next pages toward older messages, Previous toward newer ones.
+		newest := 10
+		if len(p.Next) > 0 {
+			newest = int(p.Next[0]) - 1
+		} else if len(p.Previous) > 0 {
+			newest = min(10, int(p.Previous[0])+3)
+		}
+		oldest := max(1, newest-2)
+		var thread chat1.Thread
+		for id := newest; id >= oldest; id-- {
+			msg := chat1.MsgSummary{
+				Id:       chat1.MessageID(id),
+				ConvID:   "abc",
+				SentAtMs: int64(id) * 1000,
+				Content:  chat1.MsgContent{TypeName: types[id%len(types)]},
+			}
+			thread.Messages = append(thread.Messages, chat1.Message{Msg: &msg})
+		}
+		thread.Pagination = &chat1.Pagination{Num: 3, Last: oldest == 1, Next: []byte{byte(oldest)}}
+		if newest < 10 {
+			thread.Pagination.Previous = []byte{byte(newest)}
+		}
+		return map[string]any{"result": thread}, nil
+	})
+	return transport, reads
+}
+
+func readAll(t *testing.T, r *ThreadReader) (ids []chat1.MessageID) {
+	for {
+		msg, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			return ids
+		}
+		require.NoError(t, err)
+		ids = append(ids, msg.Id)
+	}
+}
+
+func TestThreadReader(t *testing.T) {
+	transport, reads := fakeThread(t)
+	api, err := Start(RunOptions{}, WithTransport(transport))
+	require.NoError(t, err)
+
+	r := api.ReadThreadByConvID("abc", ThreadOptions{PageSize: 3, Peek: true})
+	require.Equal(t, []chat1.MessageID{10, 9, 8, 7, 6, 5, 4, 3, 2, 1}, readAll(t, r))
+	require.Len(t, reads, 4)
+	read := <-reads
+	require.True(t, read.Params.Options.Peek)
+	require.Equal(t, chat1.ConvIDStr("abc"), read.Params.Options.ConversationID)
+
+	// Reading stops at the first page past Since.
+	for len(reads) > 0 {
+		<-reads
+	}
+	r = api.ReadThreadByConvID("abc", ThreadOptions{
+		PageSize:     3,
+		ContentTypes: []string{"text", "edit"},
+		Since:        time.UnixMilli(5000),
+		Before:       time.UnixMilli(10000),
+	})
+	require.Equal(t, []chat1.MessageID{6, 5}, readAll(t, r))
+	require.Len(t, reads, 3)
+}
+
+func TestThreadReaderResumes(t *testing.T) {
+	transport, _ := fakeThread(t)
+	api, err := Start(RunOptions{}, WithTransport(transport))
+	require.NoError(t, err)
+
+	r := api.ReadThreadByConvID("abc", ThreadOptions{PageSize: 3})
+	page, err := r.ReadPage()
+	require.NoError(t, err)
+	require.Len(t, page, 3)
+	page, err = r.ReadPage()
+	require.NoError(t, err)
+	require.Equal(t, chat1.MessageID(5), page[2].Id)
+
+	// A reader started from the cursor continues toward older messages.
+	older := api.ReadThreadByConvID("abc", ThreadOptions{PageSize: 3, Pagination: &chat1.Pagination{Next: r.Pagination().Next}})
+	require.Equal(t, []chat1.MessageID{4, 3, 2, 1}, readAll(t, older))
+	// And toward newer ones, oldest first, from a Previous cursor.
+	newer := api.ReadThreadByConvID("abc", ThreadOptions{PageSize: 3, Pagination: &chat1.Pagination{Previous: []byte{4}}})
+	require.Equal(t, []chat1.MessageID{5, 6, 7, 8, 9, 10}, readAll(t, newer))
+}
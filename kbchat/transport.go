@@ -0,0 +1,249 @@
+package kbchat
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+)
+
+// APIName names one of the Keybase JSON APIs a request can be sent to.
+type APIName string
+
+const (
+	ChatAPIName    APIName = "chat"
+	TeamAPIName    APIName = "team"
+	KVStoreAPIName APIName = "kvstore"
+	WalletAPIName  APIName = "wallet"
+)
+
+// Transport carries JSON API requests and notifications between the API and
+// a Keybase service.
+type Transport interface {
+	// Send delivers a single JSON request to the named API and returns the
+	// raw JSON response.
+	Send(ctx context.Context, api APIName, request []byte) ([]byte, error)
+	// Listen opens a stream of newline delimited JSON notifications, as
+	// printed by `keybase chat api-listen`. Closing the stream stops it and
+	// reports why it ended, if it ended on its own.
+	Listen(ctx context.Context, opts ListenOptions) (io.ReadCloser, error)
+}
+
+// Authenticator is implemented by transports that know which user they are
+// logged in as. Without it the API authenticates with the local keybase
+// binary, logging in with RunOptions.Oneshot if needed.
+type Authenticator interface {
+	Auth(ctx context.Context) (username string, err error)
+}
+
+// TransportStarter is implemented by transports whose connections have to be
+// (re)established every time the API authenticates.
+type TransportStarter interface {
+	Start(ctx context.Context) error
+}
+
+// contextCloser is implemented by transports that can bound how long closing
+// them takes.
+type contextCloser interface {
+	CloseContext(ctx context.Context) error
+}
+
+// WithTransport makes the API talk to the service through t instead of
+// spawning keybase processes.
+func WithTransport(t Transport) func(*API) {
+	return func(a *API) {
+		a.transport = t
+	}
+}
+
+// ExecTransport is the default Transport. It serves chat requests from a pool
+// of supervised `keybase chat api` processes and runs a `keybase <api> api`
+// process per request for the other APIs.
+type ExecTransport struct {
+	*DebugOutput
+	runOpts RunOptions
+	// Dispatchers handing out free API pipes to allow concurrent API
+	// requests.
+	pool     *pipeDispatcher
+	bulkPool *pipeDispatcher
+}
+
+var (
+	_ Transport        = (*ExecTransport)(nil)
+	_ TransportStarter = (*ExecTransport)(nil)
+	_ io.Closer        = (*ExecTransport)(nil)
+	_ contextCloser    = (*ExecTransport)(nil)
+)
+
+func NewExecTransport(runOpts RunOptions) *ExecTransport {
+	return &ExecTransport{
+		DebugOutput: NewDebugOutput("ExecTransport"),
+		runOpts:     runOpts,
+		pool:        newPipeDispatcher(),
+		bulkPool:    newPipeDispatcher(),
+	}
+}
+
+// Start replaces any running chat API processes with NumPipes fresh ones,
+// plus NumBulkPipes reserved for bulk operations.
+func (t *ExecTransport) Start(ctx context.Context) error {
+	for _, pipe := range t.apiPipes() {
+		if err := pipe.stop(); err != nil {
+			return fmt.Errorf("unable to kill previous API command %v", err)
+		}
+	}
+	t.pool.replace(nil)
+	t.bulkPool.replace(nil)
+
+	pipes, err := t.spawnPipes(ctx, int(math.Max(float64(t.runOpts.NumPipes), 1)), false)
+	if err != nil {
+		return err
+	}
+	bulkPipes, err := t.spawnPipes(ctx, t.runOpts.NumBulkPipes, true)
+	if err != nil {
+		stopPipes(pipes)
+		return err
+	}
+	t.pool.replace(pipes)
+	t.bulkPool.replace(bulkPipes)
+	return nil
+}
+
+func (t *ExecTransport) spawnPipes(ctx context.Context, n int, bulk bool) (pipes []*apiPipe, err error) {
+	for i := 0; i < n; i++ {
+		if err := ctx.Err(); err != nil {
+			stopPipes(pipes)
+			return nil, err
+		}
+		pipe := newAPIPipe(bulk)
+		if err := pipe.start(t.runOpts); err != nil {
+			stopPipes(pipes)
+			return nil, err
+		}
+		pipes = append(pipes, pipe)
+		go t.supervise(pipe)
+	}
+	return pipes, nil
+}
+
+func stopPipes(pipes []*apiPipe) {
+	for _, pipe := range pipes {
+		_ = pipe.stop()
+	}
+}
+
+func (t *ExecTransport) apiPipes() []*apiPipe {
+	return append(t.pool.snapshot(), t.bulkPool.snapshot()...)
+}
+
+func (t *ExecTransport) Send(ctx context.Context, api APIName, request []byte) ([]byte, error) {
+	if api == ChatAPIName {
+		return t.roundTrip(ctx, request)
+	}
+	cmd := t.runOpts.CommandContext(ctx, string(api), "api")
+	cmd.Stdin = bytes.NewReader(request)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	if stderr.Len() != 0 {
+		t.Debug("%s api error: %s", api, stderr.String())
+	}
+	return output, nil
+}
+
+func (t *ExecTransport) Listen(ctx context.Context, opts ListenOptions) (io.ReadCloser, error) {
+	args, err := opts.listenArgs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %v", err)
+	}
+	cmdElements := append([]string{"chat", "api-listen"}, args...)
+	p := t.runOpts.CommandContext(ctx, cmdElements...)
+	output, err := p.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %v", err)
+	}
+	stream := &execEventStream{cmd: p, output: output}
+	p.Stderr = &stream.stderr
+	if runtime.GOOS != "windows" {
+		p.ExtraFiles = []*os.File{output.(*os.File)}
+	}
+	if err := p.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start listener: %v", err)
+	}
+	return stream, nil
+}
+
+// Close stops the chat API processes, see CloseContext.
+func (t *ExecTransport) Close() error {
+	return t.CloseContext(context.Background())
+}
+
+// CloseContext stops supervising the chat API processes and closes their
+// stdin. Processes that haven't exited after the grace period set in
+// RunOptions, or once ctx is done, are killed.
+func (t *ExecTransport) CloseContext(ctx context.Context) error {
+	pipes := t.apiPipes()
+	errs := make([]error, len(pipes))
+	var wg sync.WaitGroup
+	for i, pipe := range pipes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = pipe.shutdown(ctx, t.runOpts.shutdownGracePeriod())
+		}()
+	}
+	wg.Wait()
+	t.pool.replace(nil)
+	t.bulkPool.replace(nil)
+	return errors.Join(errs...)
+}
+
+// execEventStream is the output of a `keybase chat api-listen` process.
+type execEventStream struct {
+	cmd    *exec.Cmd
+	output io.Reader
+	stderr bytes.Buffer
+
+	sync.Mutex
+	sawEOF bool
+}
+
+func (s *execEventStream) Read(p []byte) (int, error) {
+	n, err := s.output.Read(p)
+	if errors.Is(err, io.EOF) || errors.Is(err, os.ErrClosed) {
+		s.Lock()
+		s.sawEOF = true
+		s.Unlock()
+	}
+	return n, err
+}
+
+// Close kills the listener if it is still running. If the listener had
+// already ended on its own, its exit error is returned.
+func (s *execEventStream) Close() error {
+	s.Lock()
+	exited := s.sawEOF
+	s.Unlock()
+	if !exited {
+		if err := s.cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			return err
+		}
+	}
+	err := s.cmd.Wait()
+	if !exited {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%v (```%s```)", err, s.stderr.String())
+	}
+	return nil
+}
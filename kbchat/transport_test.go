@@ -0,0 +1,150 @@
+package kbchat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeRequest struct {
+	api     APIName
+	method  string
+	request []byte
+}
+
+// fakeTransport is an in-process Transport. Requests are answered by handler,
+// and every Listen call hands the test a writer for the notification stream.
+type fakeTransport struct {
+	sync.Mutex
+	username string
+	handler  func(req fakeRequest) (any, error)
+	requests []fakeRequest
+	streams  chan *io.PipeWriter
+	// listenErr, if set, fails every Listen call.
+	listenErr error
+	// auths counts the Auth calls.
+	auths int
+}
+
+var (
+	_ Transport     = (*fakeTransport)(nil)
+	_ Authenticator = (*fakeTransport)(nil)
+)
+
+func newFakeTransport(handler func(req fakeRequest) (any, error)) *fakeTransport {
+	return &fakeTransport{
+		username: "alice",
+		handler:  handler,
+		streams:  make(chan *io.PipeWriter, 10),
+	}
+}
+
+func (f *fakeTransport) Auth(ctx context.Context) (string, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.auths++
+	return f.username, nil
+}
+
+func (f *fakeTransport) Send(ctx context.Context, api APIName, request []byte) ([]byte, error) {
+	req := fakeRequest{api: api, method: apiMethod(request), request: request}
+	f.Lock()
+	f.requests = append(f.requests, req)
+	f.Unlock()
+	res, err := f.handler(req)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(res)
+}
+
+func (f *fakeTransport) Listen(ctx context.Context, opts ListenOptions) (io.ReadCloser, error) {
+	f.Lock()
+	err := f.listenErr
+	f.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	r, w := io.Pipe()
+	f.streams <- w
+	return r, nil
+}
+
+func (f *fakeTransport) sent() []fakeRequest {
+	f.Lock()
+	defer f.Unlock()
+	return append([]fakeRequest(nil), f.requests...)
+}
+
+// writeEvent writes a single api-listen notification to the stream.
+func writeEvent(t *testing.T, w io.Writer, event any) {
+	b, err := json.Marshal(event)
+	require.NoError(t, err)
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	require.NoError(t, err)
+}
+
+func TestTransportRoutesRequests(t *testing.T) {
+	transport := newFakeTransport(func(req fakeRequest) (any, error) {
+		switch req.api {
+		case ChatAPIName:
+			return map[string]any{"result": map[string]any{
+				"conversations": []chat1.ConvSummary{{Id: "abc"}},
+			}}, nil
+		case KVStoreAPIName:
+			return map[string]any{"result": map[string]any{"revision": 2}}, nil
+		default:
+			return nil, fmt.Errorf("unexpected api %s", req.api)
+		}
+	})
+	api, err := Start(RunOptions{}, WithTransport(transport))
+	require.NoError(t, err)
+	require.Equal(t, "alice", api.GetUsername())
+
+	convs, err := api.GetConversations(false)
+	require.NoError(t, err)
+	require.Len(t, convs, 1)
+	require.Equal(t, chat1.ConvIDStr("abc"), convs[0].Id)
+
+	team := "team"
+	res, err := api.PutEntry(&team, "ns", "key", "value")
+	require.NoError(t, err)
+	require.Equal(t, 2, res.Revision)
+
+	sent := transport.sent()
+	require.Len(t, sent, 2)
+	require.Equal(t, ChatAPIName, sent[0].api)
+	require.Equal(t, "list", sent[0].method)
+	require.Equal(t, KVStoreAPIName, sent[1].api)
+	require.Equal(t, "put", sent[1].method)
+}
+
+func TestTransportListen(t *testing.T) {
+	transport := newFakeTransport(func(req fakeRequest) (any, error) {
+		return nil, fmt.Errorf("unexpected request")
+	})
+	api := NewAPI(RunOptions{}, WithTransport(transport))
+	sub, err := api.Listen(ListenOptions{})
+	require.NoError(t, err)
+	defer sub.Shutdown()
+
+	stream := <-transport.streams
+	writeEvent(t, stream, chat1.MsgNotification{
+		Type: "chat",
+		Msg: &chat1.MsgSummary{
+			Id:      1,
+			ConvID:  "abc",
+			Content: chat1.MsgContent{TypeName: "text", Text: &chat1.MsgTextContent{Body: "hi"}},
+		},
+	})
+	msg, err := sub.Read()
+	require.NoError(t, err)
+	require.Equal(t, chat1.ConvIDStr("abc"), msg.Conversation.Id)
+	require.Equal(t, "hi", msg.Message.Content.Text.Body)
+}
@@ -0,0 +1,93 @@
+package kbchat
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+// typingRefreshInterval is how often WithTyping tells the service the bot is
+// still typing, before the indicator times out.
+const typingRefreshInterval = 5 * time.Second
+
+type typingOptions struct {
+	ConversationID chat1.ConvIDStr `json:"conversation_id"`
+	Typing         bool            `json:"typing"`
+}
+
+type typingParams struct {
+	Options typingOptions `json:"options"`
+}
+
+type typingArg struct {
+	Method string       `json:"method"`
+	Params typingParams `json:"params"`
+}
+
+// TypingNotification is the api-listen notification of who is typing in a
+// conversation.
+type TypingNotification struct {
+	Type   string            `json:"type"`
+	ConvID chat1.ConvIDStr   `json:"conversation_id"`
+	Typers []chat1.TyperInfo `json:"typers"`
+}
+
+// SetTyping shows or hides the bot's typing indicator in a conversation.
+func (a *API) SetTyping(convID chat1.ConvIDStr, typing bool) error {
+	return a.SetTypingContext(context.Background(), convID, typing)
+}
+
+func (a *API) SetTypingContext(ctx context.Context, convID chat1.ConvIDStr, typing bool) error {
+	_, err := a.doSend(ctx, typingArg{
+		Method: "typing",
+		Params: typingParams{Options: typingOptions{
+			ConversationID: convID,
+			Typing:         typing,
+		}},
+	})
+	return err
+}
+
+// WithTyping shows the bot as typing in a conversation while f runs, and
+// returns what f returns. Failing to update the indicator doesn't stop f.
+func (a *API) WithTyping(convID chat1.ConvIDStr, f func() error) error {
+	return a.WithTypingContext(context.Background(), convID, f)
+}
+
+func (a *API) WithTypingContext(ctx context.Context, convID chat1.ConvIDStr, f func() error) error {
+	setTyping := func(ctx context.Context, typing bool) {
+		if err := a.SetTypingContext(ctx, convID, typing); err != nil {
+			a.Debug("unable to set typing to %v in %s: %v", typing, convID, err)
+		}
+	}
+	setTyping(ctx, true)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(typingRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				setTyping(ctx, true)
+			case <-stop:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		wg.Wait()
+		// Clear the indicator even if ctx is done already.
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), a.Timeout)
+		defer cancel()
+		setTyping(ctx, false)
+	}()
+	return f()
+}
@@ -0,0 +1,54 @@
+package kbchat
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithTyping(t *testing.T) {
+	transport := newFakeTransport(func(req fakeRequest) (any, error) {
+		return map[string]any{"result": map[string]any{}}, nil
+	})
+	api := NewAPI(RunOptions{}, WithTransport(transport))
+
+	failed := errors.New("failed")
+	err := api.WithTyping("abc", func() error {
+		require.Len(t, transport.sent(), 1)
+		return failed
+	})
+	require.ErrorIs(t, err, failed)
+
+	var typing []bool
+	for _, req := range transport.sent() {
+		require.Equal(t, "typing", req.method)
+		var arg typingArg
+		require.NoError(t, json.Unmarshal(req.request, &arg))
+		require.Equal(t, chat1.ConvIDStr("abc"), arg.Params.Options.ConversationID)
+		typing = append(typing, arg.Params.Options.Typing)
+	}
+	require.Equal(t, []bool{true, false}, typing)
+}
+
+func TestSubscriptionTypingEvents(t *testing.T) {
+	typers := TypingNotification{
+		Type:   "typing",
+		ConvID: "abc",
+		Typers: []chat1.TyperInfo{{Username: "alice"}},
+	}
+	sub, stream := listenFake(t, ListenOptions{Typing: true})
+	writeEvent(t, stream, typers)
+	event, err := sub.ReadTyping()
+	require.NoError(t, err)
+	require.Equal(t, TypingEvent{ConvID: "abc", Typers: typers.Typers}, event)
+
+	// Without ListenOptions.Typing they are left out.
+	sub, stream = listenFake(t, ListenOptions{})
+	writeEvent(t, stream, typers)
+	writeEvent(t, stream, msgNotification(chat1.MsgSummary{Id: 1, ConvID: "abc"}))
+	require.Equal(t, ReconnectedEvent{}, <-sub.Events())
+	require.IsType(t, MessageEvent{}, <-sub.Events())
+}
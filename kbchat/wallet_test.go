@@ -0,0 +1,40 @@
+package kbchat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/stellar1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetWalletTxDetails(t *testing.T) {
+	transport := newFakeTransport(func(req fakeRequest) (any, error) {
+		return map[string]any{"result": stellar1.PaymentCLILocal{TxID: "tx", Amount: "1"}}, nil
+	})
+	api, err := Start(RunOptions{}, WithTransport(transport))
+	require.NoError(t, err)
+
+	done := make(chan error, 1)
+	go func() {
+		out, err := api.GetWalletTxDetails(`a"b`)
+		if err == nil {
+			require.Equal(t, stellar1.TransactionID("tx"), out.Result.TxID)
+			require.Equal(t, "1", out.Result.Amount)
+			// The API is free for the next call.
+			_, err = api.GetWalletTxDetails("c")
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("GetWalletTxDetails never returned")
+	}
+
+	sent := transport.sent()
+	require.Len(t, sent, 2)
+	require.Equal(t, WalletAPIName, sent[0].api)
+	require.JSONEq(t, `{"method": "details", "params": {"options": {"txid": "a\"b"}}}`, string(sent[0].request))
+}
@@ -0,0 +1,275 @@
+package kbchat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+const (
+	defaultPoolWorkers   = 8
+	defaultPoolQueueSize = 100
+)
+
+// WorkerPoolOptions configures a WorkerPool.
+type WorkerPoolOptions struct {
+	// Workers is the number of messages handled at once, eight by default.
+	Workers int
+	// QueueSize is the number of messages each conversation queues before
+	// Submit blocks, 100 by default.
+	QueueSize int
+	// Timeout, if set, bounds the context each handler call gets. A handler
+	// still running after it no longer takes up a worker, though the next
+	// message of its conversation waits for it to return.
+	Timeout time.Duration
+	// OnError is called with every HandlerError, and with the ErrorEvents
+	// received by Run. Without it they are only logged.
+	OnError func(err error)
+}
+
+// WorkerPool handles messages from different conversations concurrently,
+// while the messages of each conversation are handled one at a time, in the
+// order they were submitted.
+type WorkerPool struct {
+	*DebugOutput
+	handler func(ctx context.Context, msg SubscriptionMessage) error
+	opts    WorkerPoolOptions
+
+	mu     sync.Mutex
+	closed bool
+	// convs holds the conversations with messages queued or being handled.
+	convs map[chat1.ConvIDStr]*poolConv
+	// ready lists the conversations waiting for a worker, in turn.
+	ready   []*poolConv
+	workers int
+	// dequeued is closed and replaced whenever a message leaves its queue,
+	// waking up the Submit calls waiting for room.
+	dequeued chan struct{}
+	wg       sync.WaitGroup
+}
+
+// poolConv is the queue of a conversation. It sits on the ready list, or is
+// being handled, for as long as it is in the pool's convs.
+type poolConv struct {
+	id   chat1.ConvIDStr
+	jobs []poolJob
+}
+
+// poolJob is a message waiting for its worker, and what to call once it has
+// been handled without an error.
+type poolJob struct {
+	msg  SubscriptionMessage
+	done func(SubscriptionMessage)
+}
+
+// NewWorkerPool returns a pool whose workers call handler for every message
+// submitted to it.
+func NewWorkerPool(handler func(ctx context.Context, msg SubscriptionMessage) error, opts WorkerPoolOptions) *WorkerPool {
+	if opts.Workers <= 0 {
+		opts.Workers = defaultPoolWorkers
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = defaultPoolQueueSize
+	}
+	return &WorkerPool{
+		DebugOutput: NewDebugOutput("WorkerPool"),
+		handler:     handler,
+		opts:        opts,
+		convs:       make(map[chat1.ConvIDStr]*poolConv),
+		dequeued:    make(chan struct{}),
+	}
+}
+
+// schedule puts c on the ready list and starts a worker for it if there are
+// fewer than Workers. It must be called with p.mu held.
+func (p *WorkerPool) schedule(c *poolConv) {
+	p.ready = append(p.ready, c)
+	if p.workers < p.opts.Workers {
+		p.workers++
+		p.wg.Add(1)
+		go p.work()
+	}
+}
+
+// work handles the next message of every ready conversation until there are
+// none left.
+func (p *WorkerPool) work() {
+	defer p.wg.Done()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.ready) > 0 {
+		c := p.ready[0]
+		p.ready = p.ready[1:]
+		job := c.jobs[0]
+		c.jobs = c.jobs[1:]
+		close(p.dequeued)
+		p.dequeued = make(chan struct{})
+		p.mu.Unlock()
+		finished := p.process(c, job)
+		p.mu.Lock()
+		if finished {
+			p.requeue(c)
+		}
+	}
+	p.workers--
+}
+
+// requeue puts c back in turn once its last message has been handled, or
+// lets it go if nothing is queued. It must be called with p.mu held.
+func (p *WorkerPool) requeue(c *poolConv) {
+	if len(c.jobs) == 0 {
+		delete(p.convs, c.id)
+		return
+	}
+	p.schedule(c)
+}
+
+// process handles job, waiting no longer than the Timeout. It reports
+// whether the handler has returned; if not, c is requeued once it does.
+func (p *WorkerPool) process(c *poolConv, job poolJob) (finished bool) {
+	if p.opts.Timeout <= 0 {
+		p.finish(job, p.handle(job.msg))
+		return true
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.finish(job, p.handle(job.msg))
+	}()
+	timer := time.NewTimer(p.opts.Timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+	}
+	p.Debug("process: handler for %s is past its timeout", c.id)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		<-done
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.requeue(c)
+	}()
+	return false
+}
+
+func (p *WorkerPool) finish(job poolJob, err error) {
+	if err != nil {
+		p.reportError(err)
+	} else if job.done != nil {
+		job.done(job.msg)
+	}
+}
+
+// handle calls the handler for msg, returning its error or panic as a
+// HandlerError.
+func (p *WorkerPool) handle(msg SubscriptionMessage) (err error) {
+	ctx := context.Background()
+	if p.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.opts.Timeout)
+		defer cancel()
+	}
+	typ := msg.Message.Content.TypeName
+	defer func() {
+		if r := recover(); r != nil {
+			err = HandlerError{ContentType: typ, Message: msg, Err: fmt.Errorf("panic: %v", r)}
+		}
+	}()
+	err = p.handler(ctx, msg)
+	var handlerErr HandlerError
+	if err != nil && !errors.As(err, &handlerErr) {
+		return HandlerError{ContentType: typ, Message: msg, Err: err}
+	}
+	return err
+}
+
+func (p *WorkerPool) reportError(err error) {
+	if p.opts.OnError != nil {
+		p.opts.OnError(err)
+		return
+	}
+	p.Debug("%v", err)
+}
+
+// Submit queues msg behind the other messages of its conversation, blocking
+// while QueueSize of them are waiting. It returns ctx.Err() if ctx is done
+// first, and ErrShutdown once the pool is closed.
+func (p *WorkerPool) Submit(ctx context.Context, msg SubscriptionMessage) error {
+	return p.submit(ctx, poolJob{msg: msg})
+}
+
+func (p *WorkerPool) submit(ctx context.Context, job poolJob) error {
+	convID := job.msg.Message.ConvID
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return ErrShutdown
+		}
+		c, ok := p.convs[convID]
+		if !ok {
+			c = &poolConv{id: convID, jobs: []poolJob{job}}
+			p.convs[convID] = c
+			p.schedule(c)
+			p.mu.Unlock()
+			return nil
+		}
+		if len(c.jobs) < p.opts.QueueSize {
+			c.jobs = append(c.jobs, job)
+			p.mu.Unlock()
+			return nil
+		}
+		dequeued := p.dequeued
+		p.mu.Unlock()
+		select {
+		case <-dequeued:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Run submits the messages received by sub until it shuts down. With
+// ListenOptions.MarkRead, messages handled without an error are marked as
+// read.
+func (p *WorkerPool) Run(sub *Subscription) error {
+	return p.RunContext(context.Background(), sub)
+}
+
+// RunContext is like Run, but also returns ctx.Err() once ctx is done.
+func (p *WorkerPool) RunContext(ctx context.Context, sub *Subscription) error {
+	for {
+		select {
+		case event, ok := <-sub.Events():
+			if !ok {
+				return errors.New("Subscription shutdown")
+			}
+			switch event := event.(type) {
+			case MessageEvent:
+				if err := p.submit(ctx, poolJob{msg: event.SubscriptionMessage, done: sub.handled}); err != nil {
+					return err
+				}
+			case ErrorEvent:
+				p.reportError(event.Err)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Close stops accepting messages and waits for the queued ones to be
+// handled.
+func (p *WorkerPool) Close() {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	p.wg.Wait()
+}
@@ -0,0 +1,120 @@
+package kbchat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/stretchr/testify/require"
+)
+
+func poolMessage(conv chat1.ConvIDStr, id int) SubscriptionMessage {
+	return SubscriptionMessage{Message: chat1.MsgSummary{Id: chat1.MessageID(id), ConvID: conv}}
+}
+
+func TestWorkerPoolOrdersConversations(t *testing.T) {
+	var mu sync.Mutex
+	handled := make(map[chat1.ConvIDStr][]int)
+	release := make(chan struct{})
+	pool := NewWorkerPool(func(ctx context.Context, msg SubscriptionMessage) error {
+		if msg.Message.ConvID == "slow" && msg.Message.Id == 1 {
+			<-release
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		handled[msg.Message.ConvID] = append(handled[msg.Message.ConvID], int(msg.Message.Id))
+		return nil
+	}, WorkerPoolOptions{Workers: 4})
+
+	for id := 1; id <= 10; id++ {
+		require.NoError(t, pool.Submit(context.Background(), poolMessage("slow", id)))
+		require.NoError(t, pool.Submit(context.Background(), poolMessage("fast", id)))
+	}
+	// A slow conversation doesn't hold up the others.
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(handled["fast"]) == 10
+	}, 5*time.Second, 10*time.Millisecond)
+	mu.Lock()
+	require.Empty(t, handled["slow"])
+	mu.Unlock()
+
+	close(release)
+	pool.Close()
+	want := []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	require.Equal(t, want, handled["slow"])
+	require.Equal(t, want, handled["fast"])
+	require.ErrorIs(t, pool.Submit(context.Background(), poolMessage("fast", 11)), ErrShutdown)
+}
+
+func TestWorkerPoolReportsFailures(t *testing.T) {
+	errs := make(chan error, 3)
+	pool := NewWorkerPool(func(ctx context.Context, msg SubscriptionMessage) error {
+		switch msg.Message.Id {
+		case 1:
+			<-ctx.Done()
+			return ctx.Err()
+		case 2:
+			panic("boom")
+		}
+		return nil
+	}, WorkerPoolOptions{Timeout: 10 * time.Millisecond, OnError: func(err error) { errs <- err }})
+	for id := 1; id <= 3; id++ {
+		require.NoError(t, pool.Submit(context.Background(), poolMessage("abc", id)))
+	}
+	pool.Close()
+	close(errs)
+
+	var failed []chat1.MessageID
+	for err := range errs {
+		var handlerErr HandlerError
+		require.True(t, errors.As(err, &handlerErr))
+		failed = append(failed, handlerErr.Message.Message.Id)
+		if handlerErr.Message.Message.Id == 1 {
+			require.ErrorIs(t, err, context.DeadlineExceeded)
+		} else {
+			require.ErrorContains(t, err, "panic: boom")
+		}
+	}
+	require.Equal(t, []chat1.MessageID{1, 2}, failed)
+}
+
+func TestWorkerPoolFreesWorkersAfterTimeout(t *testing.T) {
+	var mu sync.Mutex
+	var handled []string
+	release := make(chan struct{})
+	pool := NewWorkerPool(func(ctx context.Context, msg SubscriptionMessage) error {
+		if msg.Message.ConvID == "stuck" && msg.Message.Id == 1 {
+			// Ignores its context.
+			<-release
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		handled = append(handled, fmt.Sprintf("%s/%d", msg.Message.ConvID, msg.Message.Id))
+		return nil
+	}, WorkerPoolOptions{Workers: 1, QueueSize: 1, Timeout: 10 * time.Millisecond})
+
+	require.NoError(t, pool.Submit(context.Background(), poolMessage("stuck", 1)))
+	require.NoError(t, pool.Submit(context.Background(), poolMessage("stuck", 2)))
+	// The stuck conversation's queue is full, which holds up nobody else.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, pool.Submit(ctx, poolMessage("stuck", 3)), context.DeadlineExceeded)
+	for id := 1; id <= 3; id++ {
+		require.NoError(t, pool.Submit(context.Background(), poolMessage("other", id)))
+	}
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(handled) == 3
+	}, 5*time.Second, time.Millisecond)
+
+	close(release)
+	pool.Close()
+	require.Equal(t, []string{"other/1", "other/2", "other/3", "stuck/1", "stuck/2"}, handled)
+}